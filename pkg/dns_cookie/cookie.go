@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_cookie
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ClientCookieLen = 8
+
+	// See RFC 7873 4.
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+)
+
+var ErrMalformedCookie = errors.New("malformed cookie option")
+
+// FromOpt finds and parses the COOKIE option in opt. opt can be nil.
+// If opt does not have a COOKIE option, found will be false.
+// If the COOKIE option has an invalid length, a ErrMalformedCookie
+// will be returned. (RFC 7873 5.2.2)
+func FromOpt(opt *dns.OPT) (clientCookie, serverCookie []byte, found bool, err error) {
+	if opt == nil {
+		return nil, nil, false, nil
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(c.Cookie)
+		if err != nil {
+			return nil, nil, true, ErrMalformedCookie
+		}
+		switch l := len(b); {
+		case l == ClientCookieLen:
+			return b, nil, true, nil
+		case l >= ClientCookieLen+minServerCookieLen && l <= ClientCookieLen+maxServerCookieLen:
+			return b[:ClientCookieLen], b[ClientCookieLen:], true, nil
+		default:
+			return nil, nil, true, ErrMalformedCookie
+		}
+	}
+	return nil, nil, false, nil
+}
+
+// NewOption builds a COOKIE option. serverCookie can be nil.
+func NewOption(clientCookie, serverCookie []byte) *dns.EDNS0_COOKIE {
+	b := make([]byte, 0, len(clientCookie)+len(serverCookie))
+	b = append(b, clientCookie...)
+	b = append(b, serverCookie...)
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(b)}
+}
+
+// NewClientCookie returns a random client cookie.
+func NewClientCookie() []byte {
+	b := make([]byte, ClientCookieLen)
+	_, _ = rand.Read(b)
+	return b
+}
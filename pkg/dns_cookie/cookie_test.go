@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_cookie
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cc := NewClientCookie()
+	addr := netip.MustParseAddr("127.0.0.1")
+	sc := s.Generate(cc, addr)
+	if !s.Verify(cc, sc, addr) {
+		t.Fatal("valid cookie failed the verification")
+	}
+	if !s.Verify(cc, sc, netip.MustParseAddr("::ffff:127.0.0.1")) {
+		t.Fatal("mapped address failed the verification")
+	}
+	if s.Verify(cc, sc, netip.MustParseAddr("127.0.0.2")) {
+		t.Fatal("cookie of another client passed the verification")
+	}
+	if s.Verify(NewClientCookie(), sc, addr) {
+		t.Fatal("cookie with another client cookie passed the verification")
+	}
+
+	// Cookies are still valid after one rotation but not after two.
+	s.Rotate()
+	if !s.Verify(cc, sc, addr) {
+		t.Fatal("cookie failed the verification after one rotation")
+	}
+	s.Rotate()
+	if s.Verify(cc, sc, addr) {
+		t.Fatal("cookie passed the verification after two rotations")
+	}
+}
+
+func TestFromOpt(t *testing.T) {
+	cc := NewClientCookie()
+	sc := bytes.Repeat([]byte{1}, 16)
+
+	opt := new(dns.OPT)
+	if _, _, found, _ := FromOpt(opt); found {
+		t.Fatal("opt has no cookie")
+	}
+
+	opt.Option = []dns.EDNS0{NewOption(cc, sc)}
+	gotC, gotS, found, err := FromOpt(opt)
+	if err != nil || !found || !bytes.Equal(gotC, cc) || !bytes.Equal(gotS, sc) {
+		t.Fatalf("FromOpt() = %x, %x, %v, %v", gotC, gotS, found, err)
+	}
+
+	opt.Option = []dns.EDNS0{NewOption(cc, []byte{1})}
+	if _, _, _, err := FromOpt(opt); err != ErrMalformedCookie {
+		t.Fatalf("want ErrMalformedCookie, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns_cookie
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	secretLen       = 16
+	serverCookieLen = 16
+
+	cookieVersion = 1
+
+	// See RFC 9018 4.3.
+	maxCookieAge       = time.Hour
+	maxCookieFutureAge = time.Minute * 5
+)
+
+// Server generates and verifies server cookies. The cookie has the
+// layout that RFC 9018 suggested, except its hash is a truncated
+// HMAC-SHA256.
+// Server keeps the previous secret after a rotation, so cookies that
+// were generated just before the rotation are still valid.
+type Server struct {
+	mu         sync.RWMutex
+	secret     [secretLen]byte
+	prevSecret [secretLen]byte
+	hasPrev    bool
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewServer creates a *Server. If secret is empty, a random one
+// will be used. If rotateInterval > 0, the secret will be replaced by a random
+// one every rotateInterval.
+func NewServer(secret []byte, rotateInterval time.Duration) (*Server, error) {
+	s := &Server{closeNotify: make(chan struct{})}
+	switch len(secret) {
+	case 0:
+		_, _ = rand.Read(s.secret[:])
+	case secretLen:
+		copy(s.secret[:], secret)
+	default:
+		return nil, errors.New("cookie secret must be 16 bytes long")
+	}
+
+	if rotateInterval > 0 {
+		go s.rotateLoop(rotateInterval)
+	}
+	return s, nil
+}
+
+func (s *Server) rotateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Rotate()
+		case <-s.closeNotify:
+			return
+		}
+	}
+}
+
+// Rotate replaces the secret with a random one.
+func (s *Server) Rotate() {
+	var newSecret [secretLen]byte
+	_, _ = rand.Read(newSecret[:])
+	s.mu.Lock()
+	s.prevSecret = s.secret
+	s.hasPrev = true
+	s.secret = newSecret
+	s.mu.Unlock()
+}
+
+// Generate generates a server cookie for the client.
+func (s *Server) Generate(clientCookie []byte, clientAddr netip.Addr) []byte {
+	s.mu.RLock()
+	secret := s.secret
+	s.mu.RUnlock()
+	return genServerCookie(secret, clientCookie, clientAddr, uint32(time.Now().Unix()))
+}
+
+// Verify reports whether serverCookie is a valid, unexpired cookie that was
+// generated for the client.
+func (s *Server) Verify(clientCookie, serverCookie []byte, clientAddr netip.Addr) bool {
+	if len(serverCookie) != serverCookieLen || serverCookie[0] != cookieVersion {
+		return false
+	}
+	ts := binary.BigEndian.Uint32(serverCookie[4:8])
+	now := time.Now()
+	t := time.Unix(int64(ts), 0)
+	if t.Before(now.Add(-maxCookieAge)) || t.After(now.Add(maxCookieFutureAge)) {
+		return false
+	}
+
+	s.mu.RLock()
+	secret, prevSecret, hasPrev := s.secret, s.prevSecret, s.hasPrev
+	s.mu.RUnlock()
+	if hmac.Equal(serverCookie, genServerCookie(secret, clientCookie, clientAddr, ts)) {
+		return true
+	}
+	return hasPrev && hmac.Equal(serverCookie, genServerCookie(prevSecret, clientCookie, clientAddr, ts))
+}
+
+// Close stops the secret rotation.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeNotify)
+	})
+	return nil
+}
+
+// genServerCookie returns a server cookie.
+// Layout: Version(1) | Reserved(3) | Timestamp(4) | Hash(8)
+func genServerCookie(secret [secretLen]byte, clientCookie []byte, clientAddr netip.Addr, ts uint32) []byte {
+	b := make([]byte, 8, serverCookieLen)
+	b[0] = cookieVersion
+	binary.BigEndian.PutUint32(b[4:8], ts)
+
+	h := hmac.New(sha256.New, secret[:])
+	h.Write(clientCookie)
+	h.Write(b)
+	h.Write(clientAddr.Unmap().AsSlice())
+	return append(b, h.Sum(nil)[:serverCookieLen-8]...)
+}
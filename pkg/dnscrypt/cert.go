@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	certMagic      = "DNSC"
+	clientMagicLen = 8
+	certSize       = 124 // without extensions
+)
+
+// Cert is a DNSCrypt resolver certificate.
+type Cert struct {
+	ESVersion   ESVersion
+	Signature   [ed25519.SignatureSize]byte
+	ResolverPk  [32]byte
+	ClientMagic [clientMagicLen]byte
+	Serial      uint32
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Extensions  []byte
+}
+
+// Valid reports whether t is within the validity period of the cert.
+func (c *Cert) Valid(t time.Time) bool {
+	return !t.Before(c.NotBefore) && t.Before(c.NotAfter)
+}
+
+// signedPart returns the data that the signature covers.
+func (c *Cert) signedPart() []byte {
+	b := make([]byte, 0, 52+len(c.Extensions))
+	b = append(b, c.ResolverPk[:]...)
+	b = append(b, c.ClientMagic[:]...)
+	b = binary.BigEndian.AppendUint32(b, c.Serial)
+	b = binary.BigEndian.AppendUint32(b, uint32(c.NotBefore.Unix()))
+	b = binary.BigEndian.AppendUint32(b, uint32(c.NotAfter.Unix()))
+	return append(b, c.Extensions...)
+}
+
+// Sign signs the cert with the provider secret key.
+func (c *Cert) Sign(providerSk ed25519.PrivateKey) {
+	copy(c.Signature[:], ed25519.Sign(providerSk, c.signedPart()))
+}
+
+// Verify verifies the cert signature.
+func (c *Cert) Verify(providerPk ed25519.PublicKey) bool {
+	return ed25519.Verify(providerPk, c.signedPart(), c.Signature[:])
+}
+
+// Marshal returns the wire format of the cert.
+func (c *Cert) Marshal() []byte {
+	b := make([]byte, 0, certSize+len(c.Extensions))
+	b = append(b, certMagic...)
+	b = binary.BigEndian.AppendUint16(b, uint16(c.ESVersion))
+	b = append(b, 0, 0) // protocol minor version
+	b = append(b, c.Signature[:]...)
+	return append(b, c.signedPart()...)
+}
+
+// UnmarshalCert parses a cert from its wire format.
+func UnmarshalCert(b []byte) (*Cert, error) {
+	if len(b) < certSize {
+		return nil, fmt.Errorf("invalid cert length %d", len(b))
+	}
+	if !bytes.Equal(b[:4], []byte(certMagic)) {
+		return nil, errors.New("invalid cert magic")
+	}
+	c := new(Cert)
+	c.ESVersion = ESVersion(binary.BigEndian.Uint16(b[4:6]))
+	if !c.ESVersion.valid() {
+		return nil, fmt.Errorf("unsupported es version %d", c.ESVersion)
+	}
+	b = b[8:]
+	copy(c.Signature[:], b[:64])
+	copy(c.ResolverPk[:], b[64:96])
+	copy(c.ClientMagic[:], b[96:104])
+	c.Serial = binary.BigEndian.Uint32(b[104:108])
+	c.NotBefore = time.Unix(int64(binary.BigEndian.Uint32(b[108:112])), 0)
+	c.NotAfter = time.Unix(int64(binary.BigEndian.Uint32(b[112:116])), 0)
+	if len(b) > 116 {
+		c.Extensions = bytes.Clone(b[116:])
+	}
+	return c, nil
+}
+
+// escapeTXT converts raw bytes to the presentation format of a TXT string,
+// which is used by miekg/dns.
+func escapeTXT(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			sb.WriteString(fmt.Sprintf("\\%03d", c))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// unescapeTXT converts the presentation format of a TXT string
+// from miekg/dns to raw bytes.
+func unescapeTXT(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// certRefreshInterval is the maximum interval between two cert fetches.
+	certRefreshInterval = time.Hour
+	// certRetryInterval is the interval of retries if a cert fetch failed
+	// but the current cert is still valid.
+	certRetryInterval = time.Minute
+	// certFetchTimeout is the timeout of a cert fetch.
+	certFetchTimeout = time.Second * 5
+
+	maxUDPMsgSize = 65535
+)
+
+var (
+	errNoValidCert = errors.New("no valid cert")
+	errInvalidResp = errors.New("invalid dnscrypt response")
+	errMsgTooShort = errors.New("message is too short")
+)
+
+type ClientOpts struct {
+	// Required.
+	Stamp *Stamp
+
+	// DialUDP and DialTCP dial to the server. Required.
+	DialUDP func(ctx context.Context) (net.Conn, error)
+	DialTCP func(ctx context.Context) (net.Conn, error)
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// Client is a DNSCrypt v2 client. Queries are sent over UDP and will
+// be retried over TCP if the response is truncated.
+type Client struct {
+	opts ClientOpts
+
+	m  sync.Mutex
+	s  *session
+	sf singleflight.Group // de-duplicates cert fetches.
+}
+
+// session is the state of the current resolver cert.
+type session struct {
+	cert      *Cert
+	pk        [keySize]byte // client public key
+	key       [keySize]byte // shared key
+	refreshAt time.Time
+}
+
+func NewClient(opts ClientOpts) *Client {
+	if opts.Logger == nil {
+		opts.Logger = mlog.Nop()
+	}
+	return &Client{opts: opts}
+}
+
+// ExchangeContext implements upstream.Upstream.
+func (c *Client) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	s, err := c.getSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cert, %w", err)
+	}
+	r, err := c.exchange(ctx, s, m, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(*r) > 2 && (*r)[2]&0x02 != 0 { // truncated
+		pool.ReleaseBuf(r)
+		return c.exchange(ctx, s, m, true)
+	}
+	return r, nil
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+// getSession returns the current session, and fetches a new cert
+// if it is time to refresh. If the current cert is still valid, it is
+// refreshed in the background.
+func (c *Client) getSession(ctx context.Context) (*session, error) {
+	c.m.Lock()
+	s := c.s
+	c.m.Unlock()
+
+	now := time.Now()
+	if s != nil && now.Before(s.refreshAt) {
+		return s, nil
+	}
+	if s != nil && s.cert.Valid(now) {
+		c.refreshSession()
+		return s, nil
+	}
+
+	// No valid session. Wait for the fetch.
+	select {
+	case res := <-c.refreshSession():
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*session), nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// refreshSession fetches a new cert in the background. Concurrent calls
+// share the same fetch.
+func (c *Client) refreshSession() <-chan singleflight.Result {
+	return c.sf.DoChan("", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), certFetchTimeout)
+		defer cancel()
+		s, err := c.newSession(ctx)
+
+		c.m.Lock()
+		defer c.m.Unlock()
+		if err != nil {
+			if c.s != nil && c.s.cert.Valid(time.Now()) {
+				c.opts.Logger.Warn("failed to refresh dnscrypt cert", zap.Error(err))
+				// Sessions are read without lock. Don't modify it.
+				retry := *c.s
+				retry.refreshAt = time.Now().Add(certRetryInterval)
+				c.s = &retry
+			}
+			return nil, err
+		}
+		c.s = s
+		return s, nil
+	})
+}
+
+func (c *Client) newSession(ctx context.Context) (*session, error) {
+	cert, err := c.fetchCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pk, sk, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	key, err := sharedKey(cert.ESVersion, &sk, &cert.ResolverPk)
+	if err != nil {
+		return nil, err
+	}
+	refreshAt := time.Now().Add(certRefreshInterval)
+	if cert.NotAfter.Before(refreshAt) {
+		refreshAt = cert.NotAfter
+	}
+	return &session{cert: cert, pk: pk, key: key, refreshAt: refreshAt}, nil
+}
+
+// fetchCert fetches certs from the server and returns the best valid one.
+func (c *Client) fetchCert(ctx context.Context) (*Cert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(c.opts.Stamp.ProviderName), dns.TypeTXT)
+	q.Id = dns.Id()
+	r, err := c.exchangePlain(ctx, q, false)
+	if err == nil && r.Truncated {
+		r, err = c.exchangePlain(ctx, q, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	providerPk := ed25519.PublicKey(c.opts.Stamp.ProviderPk)
+	var best *Cert
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := UnmarshalCert(unescapeTXT(strings.Join(txt.Txt, "")))
+		if err != nil {
+			c.opts.Logger.Debug("invalid dnscrypt cert", zap.Error(err))
+			continue
+		}
+		if !cert.Verify(providerPk) || !cert.Valid(now) {
+			continue
+		}
+		if best == nil || cert.Serial > best.Serial ||
+			(cert.Serial == best.Serial && cert.ESVersion == XChaCha20Poly1305) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, errNoValidCert
+	}
+	return best, nil
+}
+
+// exchangePlain exchanges an unencrypted query. It is used to fetch certs.
+func (c *Client) exchangePlain(ctx context.Context, q *dns.Msg, useTCP bool) (*dns.Msg, error) {
+	conn, err := c.dial(ctx, useTCP)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var r *dns.Msg
+	if useTCP {
+		if _, err := dnsutils.WriteMsgToTCP(conn, q); err != nil {
+			return nil, err
+		}
+		r, _, err = dnsutils.ReadMsgFromTCP(conn)
+	} else {
+		if _, err := dnsutils.WriteMsgToUDP(conn, q); err != nil {
+			return nil, err
+		}
+		r, _, err = dnsutils.ReadMsgFromUDP(conn, maxUDPMsgSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Id != q.Id {
+		return nil, errInvalidResp
+	}
+	return r, nil
+}
+
+// exchange sends an encrypted query m and returns the decrypted response.
+func (c *Client) exchange(ctx context.Context, s *session, m []byte, useTCP bool) (*[]byte, error) {
+	var clientNonce [halfNonceSize]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return nil, err
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], clientNonce[:])
+
+	minSize := minUDPQuerySize
+	if useTCP {
+		minSize = 0
+	}
+	packet := make([]byte, 0, clientMagicLen+keySize+halfNonceSize+tagSize+len(m)+minSize+padBlockSize)
+	packet = append(packet, s.cert.ClientMagic[:]...)
+	packet = append(packet, s.pk[:]...)
+	packet = append(packet, clientNonce[:]...)
+	packet = seal(s.cert.ESVersion, packet, pad(m, minSize), &nonce, &s.key)
+
+	conn, err := c.dial(ctx, useTCP)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if useTCP {
+		if _, err := dnsutils.WriteRawMsgToTCP(conn, packet); err != nil {
+			return nil, err
+		}
+		b, err := dnsutils.ReadRawMsgFromTCP(conn)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.ReleaseBuf(b)
+		return openResponse(s, *b, &clientNonce)
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	b := pool.GetBuf(maxUDPMsgSize)
+	defer pool.ReleaseBuf(b)
+	for {
+		n, err := conn.Read(*b)
+		if err != nil {
+			return nil, err
+		}
+		r, err := openResponse(s, (*b)[:n], &clientNonce)
+		if err != nil {
+			// Maybe a spoofed packet. Keep reading until timeout.
+			c.opts.Logger.Debug("invalid dnscrypt response", zap.Error(err))
+			continue
+		}
+		return r, nil
+	}
+}
+
+// dial dials a new connection. The connection will be closed if ctx is done.
+func (c *Client) dial(ctx context.Context, useTCP bool) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if useTCP {
+		conn, err = c.opts.DialTCP(ctx)
+	} else {
+		conn, err = c.opts.DialUDP(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ddl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(ddl)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &stopConn{Conn: conn, stop: stop}, nil
+}
+
+type stopConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *stopConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// openResponse decrypts a response. The returned buffer should be released
+// by pool.ReleaseBuf.
+func openResponse(s *session, b []byte, clientNonce *[halfNonceSize]byte) (*[]byte, error) {
+	if len(b) < len(resolverMagic)+nonceSize+tagSize {
+		return nil, errMsgTooShort
+	}
+	if [8]byte(b[:8]) != resolverMagic || [halfNonceSize]byte(b[8:8+halfNonceSize]) != *clientNonce {
+		return nil, errInvalidResp
+	}
+	nonce := [nonceSize]byte(b[8 : 8+nonceSize])
+	m, err := open(s.cert.ESVersion, nil, b[8+nonceSize:], &nonce, &s.key)
+	if err != nil {
+		return nil, err
+	}
+	m, err = unpad(m)
+	if err != nil {
+		return nil, err
+	}
+	if len(m) < dnsutils.DnsHeaderLen {
+		return nil, errMsgTooShort
+	}
+	r := pool.GetBuf(len(m))
+	copy(*r, m)
+	return r, nil
+}
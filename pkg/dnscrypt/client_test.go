@@ -0,0 +1,271 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const testProviderName = "2.dnscrypt-cert.example.com."
+
+// testServer is a minimal DNSCrypt server. It answers every query with
+// an A record 127.0.0.1. UDP responses of qname "tc." are truncated.
+type testServer struct {
+	t    *testing.T
+	cert *Cert
+	sk   [keySize]byte
+	uc   net.PacketConn
+	tl   net.Listener
+}
+
+func newTestServer(t *testing.T, es ESVersion) (*testServer, *Stamp) {
+	providerPk, providerSk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, sk, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &Cert{
+		ESVersion:  es,
+		ResolverPk: pk,
+		Serial:     1,
+		NotBefore:  time.Now().Add(-time.Hour),
+		NotAfter:   time.Now().Add(time.Hour),
+	}
+	copy(cert.ClientMagic[:], pk[:clientMagicLen])
+	cert.Sign(providerSk)
+
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen("tcp", uc.LocalAddr().String())
+	if err != nil {
+		uc.Close()
+		t.Fatal(err)
+	}
+	s := &testServer{t: t, cert: cert, sk: sk, uc: uc, tl: tl}
+	t.Cleanup(func() {
+		uc.Close()
+		tl.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+
+	stamp := &Stamp{
+		ServerAddr:   netip.MustParseAddrPort(uc.LocalAddr().String()),
+		ProviderPk:   providerPk,
+		ProviderName: testProviderName,
+	}
+	return s, stamp
+}
+
+func (s *testServer) serveUDP() {
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := s.uc.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if r := s.handle(b[:n], true); r != nil {
+			_, _ = s.uc.WriteTo(r, addr)
+		}
+	}
+}
+
+func (s *testServer) serveTCP() {
+	for {
+		c, err := s.tl.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			b, err := dnsutils.ReadRawMsgFromTCP(c)
+			if err != nil {
+				return
+			}
+			defer pool.ReleaseBuf(b)
+			if r := s.handle(*b, false); r != nil {
+				_, _ = dnsutils.WriteRawMsgToTCP(c, r)
+			}
+		}()
+	}
+}
+
+func (s *testServer) handle(b []byte, udp bool) []byte {
+	if !bytes.HasPrefix(b, s.cert.ClientMagic[:]) {
+		// Plain query, must be a cert query.
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil || q.Question[0].Name != testProviderName {
+			return nil
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: testProviderName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{escapeTXT(s.cert.Marshal())},
+		})
+		out, _ := r.Pack()
+		return out
+	}
+
+	b = b[clientMagicLen:]
+	clientPk := [keySize]byte(b[:keySize])
+	var nonce [nonceSize]byte
+	copy(nonce[:], b[keySize:keySize+halfNonceSize])
+	key, err := sharedKey(s.cert.ESVersion, &s.sk, &clientPk)
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	m, err := open(s.cert.ESVersion, nil, b[keySize+halfNonceSize:], &nonce, &key)
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	if udp && len(m) < minUDPQuerySize {
+		s.t.Errorf("udp query is not padded, length %d", len(m))
+	}
+	m, err = unpad(m)
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		s.t.Error(err)
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if udp && q.Question[0].Name == "tc." {
+		r.Truncated = true
+	} else {
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 127.0.0.1")
+		r.Answer = append(r.Answer, rr)
+	}
+	rb, _ := r.Pack()
+
+	_, _ = rand.Read(nonce[halfNonceSize:])
+	out := append(resolverMagic[:], nonce[:]...)
+	return seal(s.cert.ESVersion, out, pad(rb, 0), &nonce, &key)
+}
+
+func TestClient(t *testing.T) {
+	for _, es := range []ESVersion{XSalsa20Poly1305, XChaCha20Poly1305} {
+		t.Run(es.String(), func(t *testing.T) {
+			_, stamp := newTestServer(t, es)
+			addr := stamp.ServerAddr.String()
+			c := NewClient(ClientOpts{
+				Stamp: stamp,
+				DialUDP: func(ctx context.Context) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "udp", addr)
+				},
+				DialTCP: func(ctx context.Context) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "tcp", addr)
+				},
+			})
+			defer c.Close()
+
+			for _, qName := range []string{"example.com.", "tc."} {
+				q := new(dns.Msg)
+				q.SetQuestion(qName, dns.TypeA)
+				qb, _ := q.Pack()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				rb, err := c.ExchangeContext(ctx, qb)
+				cancel()
+				if err != nil {
+					t.Fatalf("%s: %v", qName, err)
+				}
+				r := new(dns.Msg)
+				if err := r.Unpack(*rb); err != nil {
+					t.Fatal(err)
+				}
+				pool.ReleaseBuf(rb)
+				if r.Id != q.Id || len(r.Answer) != 1 {
+					t.Fatalf("%s: unexpected response %s", qName, r)
+				}
+			}
+		})
+	}
+}
+
+func TestStamp(t *testing.T) {
+	pk := make([]byte, 32)
+	pk[0] = 1
+	for _, addr := range []string{"1.2.3.4:443", "1.2.3.4:5353", "[2001:db8::1]:443", "[2001:db8::1]:8443"} {
+		st := &Stamp{
+			Props:        StampPropDNSSEC | StampPropNoLog,
+			ServerAddr:   netip.MustParseAddrPort(addr),
+			ProviderPk:   pk,
+			ProviderName: "2.dnscrypt-cert.example.com",
+		}
+		got, err := ParseStamp(st.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Props != st.Props || got.ServerAddr != st.ServerAddr ||
+			!bytes.Equal(got.ProviderPk, pk) || got.ProviderName != st.ProviderName {
+			t.Fatalf("stamp mismatched, want %+v, got %+v", st, got)
+		}
+	}
+
+	if _, err := ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjE"); err == nil {
+		t.Fatal("non-dnscrypt stamp should be rejected")
+	}
+}
+
+func TestCert(t *testing.T) {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	if got := unescapeTXT(escapeTXT(b)); !bytes.Equal(got, b) {
+		t.Fatal("txt escape round trip failed")
+	}
+
+	pk, sk, _ := ed25519.GenerateKey(rand.Reader)
+	c := &Cert{ESVersion: XChaCha20Poly1305, Serial: 7, NotBefore: time.Unix(100, 0), NotAfter: time.Unix(200, 0), Extensions: []byte{1, 2}}
+	c.Sign(sk)
+	got, err := UnmarshalCert(c.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Verify(pk) || got.Serial != 7 || !got.NotAfter.Equal(c.NotAfter) {
+		t.Fatal("cert round trip failed")
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/poly1305"
+)
+
+// ESVersion is the encryption system version of a cert.
+type ESVersion uint16
+
+const (
+	XSalsa20Poly1305  ESVersion = 1
+	XChaCha20Poly1305 ESVersion = 2
+)
+
+func (v ESVersion) valid() bool {
+	return v == XSalsa20Poly1305 || v == XChaCha20Poly1305
+}
+
+func (v ESVersion) String() string {
+	switch v {
+	case XSalsa20Poly1305:
+		return "xsalsa20poly1305"
+	case XChaCha20Poly1305:
+		return "xchacha20poly1305"
+	default:
+		return fmt.Sprintf("es%d", uint16(v))
+	}
+}
+
+const (
+	nonceSize     = 24
+	halfNonceSize = nonceSize / 2
+	tagSize       = poly1305.TagSize
+	keySize       = 32
+
+	// padBlockSize is the block size of padded messages.
+	padBlockSize = 64
+	// minUDPQuerySize is the minimum size of padded UDP queries.
+	minUDPQuerySize = 256
+)
+
+var (
+	resolverMagic = [8]byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+
+	errDecryptFailed = errors.New("failed to decrypt message")
+	errInvalidPad    = errors.New("invalid message padding")
+)
+
+// GenerateKey generates a X25519 key pair.
+func GenerateKey() (pk, sk [keySize]byte, err error) {
+	p, s, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return pk, sk, err
+	}
+	return *p, *s, nil
+}
+
+// sharedKey computes the shared key of the encryption system es.
+func sharedKey(es ESVersion, sk, pk *[keySize]byte) (key [keySize]byte, err error) {
+	switch es {
+	case XSalsa20Poly1305:
+		box.Precompute(&key, pk, sk)
+		return key, nil
+	case XChaCha20Poly1305:
+		s, err := curve25519.X25519(sk[:], pk[:])
+		if err != nil {
+			return key, err
+		}
+		k, err := chacha20.HChaCha20(s, make([]byte, 16))
+		if err != nil {
+			return key, err
+		}
+		copy(key[:], k)
+		return key, nil
+	default:
+		return key, fmt.Errorf("unsupported es version %d", es)
+	}
+}
+
+// seal encrypts and authenticates msg and appends the result (tag || ciphertext)
+// to out.
+func seal(es ESVersion, out, msg []byte, nonce *[nonceSize]byte, key *[keySize]byte) []byte {
+	if es == XSalsa20Poly1305 {
+		return box.SealAfterPrecomputation(out, msg, nonce, key)
+	}
+
+	// XChaCha20Poly1305 in secretbox construction. The first 32 bytes
+	// of the key stream are the poly1305 key.
+	buf := make([]byte, 32+len(msg))
+	copy(buf[32:], msg)
+	c, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:]) // key and nonce sizes are always valid.
+	c.XORKeyStream(buf, buf)
+	var polyKey [32]byte
+	copy(polyKey[:], buf[:32])
+	var tag [tagSize]byte
+	poly1305.Sum(&tag, buf[32:], &polyKey)
+	out = append(out, tag[:]...)
+	return append(out, buf[32:]...)
+}
+
+// open authenticates and decrypts b and appends the result to out.
+func open(es ESVersion, out, b []byte, nonce *[nonceSize]byte, key *[keySize]byte) ([]byte, error) {
+	if es == XSalsa20Poly1305 {
+		m, ok := box.OpenAfterPrecomputation(out, b, nonce, key)
+		if !ok {
+			return nil, errDecryptFailed
+		}
+		return m, nil
+	}
+
+	if len(b) < tagSize {
+		return nil, errDecryptFailed
+	}
+	tag, ct := b[:tagSize], b[tagSize:]
+	buf := make([]byte, 32+len(ct))
+	copy(buf[32:], ct)
+	c, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	c.XORKeyStream(polyKey[:], polyKey[:])
+	var wantTag [tagSize]byte
+	poly1305.Sum(&wantTag, ct, &polyKey)
+	if subtle.ConstantTimeCompare(tag, wantTag[:]) != 1 {
+		return nil, errDecryptFailed
+	}
+	c.XORKeyStream(buf[32:], buf[32:])
+	return append(out, buf[32:]...), nil
+}
+
+// pad pads msg to at least minSize bytes and to a multiple of padBlockSize
+// with ISO/IEC 7816-4 padding.
+func pad(msg []byte, minSize int) []byte {
+	l := len(msg) + 1
+	if l < minSize {
+		l = minSize
+	}
+	l = (l + padBlockSize - 1) / padBlockSize * padBlockSize
+	b := make([]byte, l)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+// unpad removes the ISO/IEC 7816-4 padding from b.
+func unpad(b []byte) ([]byte, error) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return b[:i], nil
+		default:
+			return nil, errInvalidPad
+		}
+	}
+	return nil, errInvalidPad
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTCPIdleTimeout = time.Second * 10
+	tcpFirstReadTimeout   = time.Second * 2
+)
+
+var (
+	errListenerCtxCanceled   = errors.New("listener ctx canceled")
+	errConnectionCtxCanceled = errors.New("connection ctx canceled")
+)
+
+type ServeOpts struct {
+	// Nil logger == nop
+	Logger *zap.Logger
+
+	// IdleTimeout of TCP connections. Default is defaultTCPIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// ServeUDP starts a DNSCrypt server at c. It returns if c had a read error.
+// It always returns a non-nil error.
+func ServeUDP(c net.PacketConn, h server.Handler, s *Server, opts ServeOpts) error {
+	logger := opts.Logger
+	if logger == nil {
+		logger = mlog.Nop()
+	}
+
+	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(errListenerCtxCanceled)
+
+	rb := pool.GetBuf(dns.MaxMsgSize)
+	defer pool.ReleaseBuf(rb)
+	for {
+		n, remoteAddr, err := c.ReadFrom(*rb)
+		if err != nil {
+			if n == 0 {
+				return fmt.Errorf("unexpected read err: %w", err)
+			}
+			logger.Warn("read err", zap.Error(err))
+			continue
+		}
+
+		b := pool.GetBuf(n)
+		copy(*b, (*rb)[:n])
+		go func() {
+			defer pool.ReleaseBuf(b)
+			payload := handle(listenerCtx, h, s, *b, addrOf(remoteAddr), true, logger)
+			if payload == nil {
+				return
+			}
+			defer pool.ReleaseBuf(payload)
+			if _, err := c.WriteTo(*payload, remoteAddr); err != nil {
+				logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// ServeTCP starts a DNSCrypt server at l. It returns if l had an Accept() error.
+// It always returns a non-nil error.
+func ServeTCP(l net.Listener, h server.Handler, s *Server, opts ServeOpts) error {
+	logger := opts.Logger
+	if logger == nil {
+		logger = mlog.Nop()
+	}
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultTCPIdleTimeout
+	}
+	firstReadTimeout := min(tcpFirstReadTimeout, idleTimeout)
+
+	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(errListenerCtxCanceled)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("unexpected listener err: %w", err)
+		}
+
+		connCtx, cancelConn := context.WithCancelCause(listenerCtx)
+		go func() {
+			defer c.Close()
+			defer cancelConn(errConnectionCtxCanceled)
+
+			clientAddr := addrOf(c.RemoteAddr())
+			firstRead := true
+			for {
+				if firstRead {
+					firstRead = false
+					c.SetReadDeadline(time.Now().Add(firstReadTimeout))
+				} else {
+					c.SetReadDeadline(time.Now().Add(idleTimeout))
+				}
+				b, err := dnsutils.ReadRawMsgFromTCP(c)
+				if err != nil {
+					return // read err, close the connection
+				}
+
+				go func() {
+					defer pool.ReleaseBuf(b)
+					payload := handle(connCtx, h, s, *b, clientAddr, false, logger)
+					if payload == nil {
+						c.Close() // abort the connection
+						return
+					}
+					defer pool.ReleaseBuf(payload)
+					if _, err := c.Write(*payload); err != nil {
+						logger.Warn("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// handle handles a query packet b. It returns the response payload, which
+// has a length header if udp is false. It returns nil if there is no response.
+func handle(ctx context.Context, h server.Handler, s *Server, b []byte, clientAddr netip.Addr, udp bool, logger *zap.Logger) *[]byte {
+	qs, m, err := s.DecryptQuery(b)
+	if err != nil {
+		if errors.Is(err, errUnknownClientMagic) {
+			// Maybe an unencrypted cert query.
+			return handleCertQuery(s, b, udp)
+		}
+		logger.Debug("invalid dnscrypt query", zap.Stringer("from", clientAddr), zap.Error(err))
+		return nil
+	}
+
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		logger.Debug("invalid msg", zap.Stringer("from", clientAddr), zap.Error(err))
+		return nil
+	}
+
+	packMsgPayload := func(r *dns.Msg) (*[]byte, error) {
+		if udp {
+			// Don't use r.Truncate here. It never truncates a msg below 512
+			// bytes, but a response must not be larger than its query.
+			if limit := ResponseSizeLimit(len(b)); r.Len() > limit {
+				tc := new(dns.Msg)
+				tc.MsgHdr = r.MsgHdr
+				tc.Truncated = true
+				tc.Question = r.Question
+				r = tc
+			}
+		}
+		wire, err := pool.PackBuffer(r)
+		if err != nil {
+			return nil, err
+		}
+		defer pool.ReleaseBuf(wire)
+
+		headerLen := 0
+		if !udp {
+			headerLen = 2
+		}
+		out := make([]byte, headerLen, headerLen+responseOverhead+len(*wire)+padBlockSize)
+		out, err = qs.EncryptResponse(out, *wire)
+		if err != nil {
+			return nil, err
+		}
+		if !udp {
+			if len(out)-2 > dns.MaxMsgSize {
+				return nil, fmt.Errorf("payload size %d is too large", len(out)-2)
+			}
+			binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+		}
+		payload := pool.GetBuf(len(out))
+		copy(*payload, out)
+		return payload, nil
+	}
+	return h.Handle(ctx, q, server.QueryMeta{ClientAddr: clientAddr, FromUDP: udp}, packMsgPayload)
+}
+
+func handleCertQuery(s *Server, b []byte, udp bool) *[]byte {
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil || q.Response {
+		return nil
+	}
+	r := s.CertResponse(q)
+	if r == nil {
+		return nil
+	}
+	var payload *[]byte
+	var err error
+	if udp {
+		payload, err = pool.PackBuffer(r)
+	} else {
+		payload, err = pool.PackTCPBuffer(r)
+	}
+	if err != nil {
+		return nil
+	}
+	return payload
+}
+
+func addrOf(a net.Addr) netip.Addr {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr()
+	}
+	return netip.Addr{}
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCertTTL = time.Hour * 24
+
+	// responseOverhead is the size of resolver magic, nonce and tag.
+	responseOverhead = len(resolverMagic) + nonceSize + tagSize
+	// queryOverhead is the size of client magic, client pk, client nonce and tag.
+	queryOverhead = clientMagicLen + keySize + halfNonceSize + tagSize
+)
+
+var errUnknownClientMagic = errors.New("unknown client magic")
+
+type ServerOpts struct {
+	// ProviderName is the provider name, e.g. "2.dnscrypt-cert.example.com".
+	// Required.
+	ProviderName string
+
+	// ProviderSk is the provider secret key that signs certs.
+	// If it is nil, StaticCerts must not be empty, and the server will
+	// not generate and rotate certs.
+	ProviderSk ed25519.PrivateKey
+
+	// ESVersions specifies the encryption systems that the server supports.
+	// Default is both XSalsa20Poly1305 and XChaCha20Poly1305.
+	ESVersions []ESVersion
+
+	// CertTTL is the validity period of generated certs. Default is 24h.
+	CertTTL time.Duration
+
+	// RotateInterval is the interval of short-term key rotation.
+	// Default is CertTTL / 2. It must be shorter than CertTTL, so that there
+	// is always a valid cert while clients are refreshing their certs.
+	RotateInterval time.Duration
+
+	// StaticCerts are pre-signed certs. Optional.
+	StaticCerts []StaticCert
+
+	// Logger is used for logging. Default is a noop logger.
+	Logger *zap.Logger
+}
+
+// StaticCert is a pre-signed cert and its resolver secret key.
+type StaticCert struct {
+	Cert *Cert
+	Sk   [keySize]byte
+}
+
+type resolverCert struct {
+	cert *Cert
+	sk   [keySize]byte
+	txt  string // escaped cert for TXT record
+}
+
+// Server keeps the certs and short-term keys of a DNSCrypt server.
+// It encrypts and decrypts messages. See ServeUDP and ServeTCP
+// for the DNSCrypt server implementation.
+type Server struct {
+	opts        ServerOpts
+	providerTxt string // fqdn of the provider name
+
+	m      sync.RWMutex
+	certs  []*resolverCert
+	serial uint32
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewServer creates a Server. If opts.ProviderSk is set, it generates the
+// first cert and rotates short-term keys every opts.RotateInterval.
+// Callers must call Server.Close to stop the rotation.
+func NewServer(opts ServerOpts) (*Server, error) {
+	if len(opts.ProviderName) == 0 {
+		return nil, errors.New("missing provider name")
+	}
+	if opts.ProviderSk == nil && len(opts.StaticCerts) == 0 {
+		return nil, errors.New("either provider key or static certs is required")
+	}
+	if opts.Logger == nil {
+		opts.Logger = mlog.Nop()
+	}
+	if len(opts.ESVersions) == 0 {
+		opts.ESVersions = []ESVersion{XSalsa20Poly1305, XChaCha20Poly1305}
+	}
+	for _, es := range opts.ESVersions {
+		if !es.valid() {
+			return nil, fmt.Errorf("unsupported es version %d", es)
+		}
+	}
+	if opts.CertTTL <= 0 {
+		opts.CertTTL = defaultCertTTL
+	}
+	if opts.RotateInterval <= 0 {
+		opts.RotateInterval = opts.CertTTL / 2
+	}
+	if opts.RotateInterval >= opts.CertTTL {
+		return nil, errors.New("rotate interval must be shorter than cert ttl")
+	}
+
+	s := &Server{
+		opts:        opts,
+		providerTxt: dns.Fqdn(opts.ProviderName),
+		closeNotify: make(chan struct{}),
+	}
+	for _, sc := range opts.StaticCerts {
+		s.certs = append(s.certs, &resolverCert{cert: sc.Cert, sk: sc.Sk, txt: escapeTXT(sc.Cert.Marshal())})
+		s.serial = max(s.serial, sc.Cert.Serial)
+	}
+	if opts.ProviderSk != nil {
+		if err := s.Rotate(); err != nil {
+			return nil, err
+		}
+		go s.rotateLoop()
+	}
+	return s, nil
+}
+
+func (s *Server) rotateLoop() {
+	ticker := time.NewTicker(s.opts.RotateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Rotate(); err != nil {
+				s.opts.Logger.Error("failed to rotate dnscrypt keys", zap.Error(err))
+			}
+		case <-s.closeNotify:
+			return
+		}
+	}
+}
+
+// Rotate generates new short-term keys and certs, and removes expired certs.
+func (s *Server) Rotate() error {
+	if s.opts.ProviderSk == nil {
+		return errors.New("cannot rotate without provider key")
+	}
+	now := time.Now()
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.serial = max(s.serial+1, uint32(now.Unix()))
+	var newCerts []*resolverCert
+	for _, es := range s.opts.ESVersions {
+		pk, sk, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		c := &Cert{
+			ESVersion:  es,
+			ResolverPk: pk,
+			Serial:     s.serial,
+			NotBefore:  now.Add(-time.Minute), // tolerate small clock skew
+			NotAfter:   now.Add(s.opts.CertTTL),
+		}
+		if _, err := rand.Read(c.ClientMagic[:]); err != nil {
+			return err
+		}
+		c.Sign(s.opts.ProviderSk)
+		newCerts = append(newCerts, &resolverCert{cert: c, sk: sk, txt: escapeTXT(c.Marshal())})
+	}
+
+	for _, rc := range s.certs {
+		if now.Before(rc.cert.NotAfter) {
+			newCerts = append(newCerts, rc)
+		}
+	}
+	s.certs = newCerts
+	return nil
+}
+
+// Close stops the key rotation.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeNotify)
+	})
+	return nil
+}
+
+// CertResponse returns the response of a cert query. It returns nil if
+// q is not a cert query.
+func (s *Server) CertResponse(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypeTXT || question.Qclass != dns.ClassINET || !strings.EqualFold(question.Name, s.providerTxt) {
+		return nil
+	}
+
+	now := time.Now()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for _, rc := range s.certs {
+		if !rc.cert.Valid(now) {
+			continue
+		}
+		ttl := uint32(time.Until(rc.cert.NotAfter) / time.Second)
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: min(ttl, 3600)},
+			Txt: []string{rc.txt},
+		})
+	}
+	return r
+}
+
+// QuerySession is the crypto context of a decrypted query. It is used to
+// encrypt the response.
+type QuerySession struct {
+	es    ESVersion
+	key   [keySize]byte
+	nonce [nonceSize]byte
+}
+
+// DecryptQuery decrypts query packet b. It returns the plain query msg.
+func (s *Server) DecryptQuery(b []byte) (*QuerySession, []byte, error) {
+	if len(b) < clientMagicLen {
+		return nil, nil, errMsgTooShort
+	}
+	rc := s.lookupCert(b[:clientMagicLen])
+	if rc == nil {
+		return nil, nil, errUnknownClientMagic
+	}
+	if len(b) < queryOverhead+dnsutils.DnsHeaderLen {
+		return nil, nil, errMsgTooShort
+	}
+	b = b[clientMagicLen:]
+	clientPk := [keySize]byte(b[:keySize])
+	b = b[keySize:]
+
+	qs := &QuerySession{es: rc.cert.ESVersion}
+	copy(qs.nonce[:], b[:halfNonceSize])
+	b = b[halfNonceSize:]
+
+	var err error
+	qs.key, err = sharedKey(qs.es, &rc.sk, &clientPk)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := open(qs.es, nil, b, &qs.nonce, &qs.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err = unpad(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return qs, m, nil
+}
+
+func (s *Server) lookupCert(magic []byte) *resolverCert {
+	now := time.Now()
+	s.m.RLock()
+	defer s.m.RUnlock()
+	for _, rc := range s.certs {
+		if bytes.Equal(rc.cert.ClientMagic[:], magic) && rc.cert.Valid(now) {
+			return rc
+		}
+	}
+	return nil
+}
+
+// EncryptResponse encrypts response r and appends the packet to out.
+func (qs *QuerySession) EncryptResponse(out, r []byte) ([]byte, error) {
+	nonce := qs.nonce
+	if _, err := rand.Read(nonce[halfNonceSize:]); err != nil {
+		return nil, err
+	}
+	out = append(out, resolverMagic[:]...)
+	out = append(out, nonce[:]...)
+	return seal(qs.es, out, pad(r, 0), &nonce, &qs.key), nil
+}
+
+// ResponseSizeLimit returns the maximum size of a plain response that can
+// be sent over UDP for a query packet of queryLen bytes. DNSCrypt requires
+// UDP responses to be no larger than queries.
+func ResponseSizeLimit(queryLen int) int {
+	return (queryLen-responseOverhead)/padBlockSize*padBlockSize - 1
+}
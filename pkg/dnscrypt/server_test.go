@@ -0,0 +1,274 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+)
+
+// testHandler answers every query with an A record 127.0.0.1. UDP responses
+// of qname "tc." are truncated. Queries of qname "large." get 64 A records.
+type testHandler struct{}
+
+func (testHandler) Handle(_ context.Context, q *dns.Msg, meta server.QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	n := 1
+	switch q.Question[0].Name {
+	case "tc.":
+		if meta.FromUDP {
+			r.Truncated = true
+			n = 0
+		}
+	case "large.":
+		n = 64
+	}
+	for i := 0; i < n; i++ {
+		rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 127.0.0.1")
+		r.Answer = append(r.Answer, rr)
+	}
+	b, _ := pack(r)
+	return b
+}
+
+func startTestServer(t *testing.T, es ESVersion) (*Server, *Stamp) {
+	providerPk, providerSk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(ServerOpts{
+		ProviderName: testProviderName,
+		ProviderSk:   providerSk,
+		ESVersions:   []ESVersion{es},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen("tcp", uc.LocalAddr().String())
+	if err != nil {
+		uc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		uc.Close()
+		tl.Close()
+		s.Close()
+	})
+	go ServeUDP(uc, testHandler{}, s, ServeOpts{})
+	go ServeTCP(tl, testHandler{}, s, ServeOpts{})
+
+	stamp := &Stamp{
+		ServerAddr:   netip.MustParseAddrPort(uc.LocalAddr().String()),
+		ProviderPk:   providerPk,
+		ProviderName: testProviderName,
+	}
+	return s, stamp
+}
+
+func newTestClient(stamp *Stamp) *Client {
+	addr := stamp.ServerAddr.String()
+	return NewClient(ClientOpts{
+		Stamp: stamp,
+		DialUDP: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+		DialTCP: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		},
+	})
+}
+
+func exchange(t *testing.T, c *Client, qName string) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(qName, dns.TypeA)
+	qb, _ := q.Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	rb, err := c.ExchangeContext(ctx, qb)
+	if err != nil {
+		t.Fatalf("%s: %v", qName, err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id {
+		t.Fatalf("%s: response id mismatched", qName)
+	}
+	return r
+}
+
+func TestServe(t *testing.T) {
+	for _, es := range []ESVersion{XSalsa20Poly1305, XChaCha20Poly1305} {
+		t.Run(es.String(), func(t *testing.T) {
+			_, stamp := startTestServer(t, es)
+			c := newTestClient(stamp)
+			defer c.Close()
+
+			if r := exchange(t, c, "example.com."); len(r.Answer) != 1 {
+				t.Fatalf("unexpected response %s", r)
+			}
+			// Truncated over UDP, should fall back to TCP.
+			if r := exchange(t, c, "tc."); r.Truncated || len(r.Answer) != 1 {
+				t.Fatalf("unexpected response %s", r)
+			}
+			// Too large for UDP, should be truncated by the server,
+			// then fall back to TCP.
+			if r := exchange(t, c, "large."); r.Truncated || len(r.Answer) != 64 {
+				t.Fatalf("unexpected response %s", r)
+			}
+		})
+	}
+}
+
+func TestServer_Rotate(t *testing.T) {
+	s, stamp := startTestServer(t, XChaCha20Poly1305)
+	c := newTestClient(stamp)
+	exchange(t, c, "example.com.")
+
+	// Old certs are still valid after rotation.
+	if err := s.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, c, "example.com.")
+
+	q := new(dns.Msg)
+	q.SetQuestion(testProviderName, dns.TypeTXT)
+	if r := s.CertResponse(q); len(r.Answer) != 2 {
+		t.Fatalf("want 2 certs, got %d", len(r.Answer))
+	}
+
+	// Client should pick up the newest cert. The old cert is still valid,
+	// so it is refreshed in the background.
+	c.m.Lock()
+	expired := *c.s
+	expired.refreshAt = time.Now()
+	c.s = &expired
+	c.m.Unlock()
+	exchange(t, c, "example.com.")
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.m.Lock()
+		serial := c.s.cert.Serial
+		c.m.Unlock()
+		if serial == s.serial {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client is using cert %d, want %d", serial, s.serial)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	q.SetQuestion("other.example.com.", dns.TypeTXT)
+	if s.CertResponse(q) != nil {
+		t.Fatal("non-cert query should not be answered")
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	if _, err := NewServer(ServerOpts{ProviderName: testProviderName}); err == nil {
+		t.Fatal("server without keys should be rejected")
+	}
+	_, sk, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := NewServer(ServerOpts{ProviderName: testProviderName, ProviderSk: sk, ESVersions: []ESVersion{3}}); err == nil {
+		t.Fatal("invalid es version should be rejected")
+	}
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	for _, queryLen := range []int{256 + queryOverhead, 512 + queryOverhead, 1000} {
+		limit := ResponseSizeLimit(queryLen)
+		if got := responseOverhead + len(pad(make([]byte, limit), 0)); got > queryLen {
+			t.Fatalf("response length %d is larger than query length %d", got, queryLen)
+		}
+	}
+}
+
+func TestServe_udpResponseSize(t *testing.T) {
+	_, stamp := startTestServer(t, XChaCha20Poly1305)
+	c := newTestClient(stamp)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	s, err := c.getSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("large.", dns.TypeA)
+	m, _ := q.Pack()
+	var clientNonce [halfNonceSize]byte
+	_, _ = rand.Read(clientNonce[:])
+	var nonce [nonceSize]byte
+	copy(nonce[:], clientNonce[:])
+	packet := append([]byte(nil), s.cert.ClientMagic[:]...)
+	packet = append(packet, s.pk[:]...)
+	packet = append(packet, clientNonce[:]...)
+	packet = seal(s.cert.ESVersion, packet, pad(m, minUDPQuerySize), &nonce, &s.key)
+
+	conn, err := c.dial(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, maxUDPMsgSize)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > len(packet) {
+		t.Fatalf("response length %d is larger than query length %d", n, len(packet))
+	}
+	rb, err := openResponse(s, b[:n], &clientNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated || len(r.Question) != 1 || len(r.Answer) != 0 {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
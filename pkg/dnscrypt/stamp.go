@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	stampScheme        = "sdns://"
+	stampProtoDNSCrypt = 0x01
+	defaultPort        = 443
+)
+
+// Stamp properties. See https://dnscrypt.info/stamps-specifications.
+const (
+	StampPropDNSSEC uint64 = 1 << iota
+	StampPropNoLog
+	StampPropNoFilter
+)
+
+// Stamp is a DNSCrypt server stamp.
+type Stamp struct {
+	Props        uint64
+	ServerAddr   netip.AddrPort
+	ProviderPk   []byte // ed25519 public key of the provider.
+	ProviderName string // e.g. "2.dnscrypt-cert.example.com"
+}
+
+// ParseStamp parses a DNSCrypt server stamp "sdns://...".
+func ParseStamp(s string) (*Stamp, error) {
+	if !strings.HasPrefix(s, stampScheme) {
+		return nil, errors.New("stamp must start with " + stampScheme)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, stampScheme))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp encoding, %w", err)
+	}
+	if len(b) < 9 {
+		return nil, errors.New("stamp is too short")
+	}
+	if b[0] != stampProtoDNSCrypt {
+		return nil, fmt.Errorf("unsupported stamp protocol 0x%02x", b[0])
+	}
+
+	st := new(Stamp)
+	st.Props = binary.LittleEndian.Uint64(b[1:9])
+	b = b[9:]
+
+	addr, b, err := readLP(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server addr, %w", err)
+	}
+	st.ServerAddr, err = parseStampAddr(string(addr))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server addr, %w", err)
+	}
+
+	st.ProviderPk, b, err = readLP(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provider public key, %w", err)
+	}
+	if len(st.ProviderPk) != 32 {
+		return nil, fmt.Errorf("invalid provider public key length %d", len(st.ProviderPk))
+	}
+
+	name, b, err := readLP(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provider name, %w", err)
+	}
+	if len(name) == 0 {
+		return nil, errors.New("empty provider name")
+	}
+	st.ProviderName = string(name)
+	if len(b) > 0 {
+		return nil, errors.New("stamp has trailing data")
+	}
+	return st, nil
+}
+
+// String returns the "sdns://..." format of the stamp.
+func (st *Stamp) String() string {
+	b := make([]byte, 9, 64)
+	b[0] = stampProtoDNSCrypt
+	binary.LittleEndian.PutUint64(b[1:], st.Props)
+
+	addr := st.ServerAddr.Addr().String()
+	if st.ServerAddr.Addr().Is6() {
+		addr = "[" + addr + "]"
+	}
+	if st.ServerAddr.Port() != defaultPort {
+		addr = addr + ":" + strconv.Itoa(int(st.ServerAddr.Port()))
+	}
+	b = appendLP(b, []byte(addr))
+	b = appendLP(b, st.ProviderPk)
+	b = appendLP(b, []byte(st.ProviderName))
+	return stampScheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseStampAddr parses "ip[:port]". IPv6 addresses must be in brackets
+// if the port is present.
+func parseStampAddr(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return netip.AddrPortFrom(addr, defaultPort), nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port, %w", err)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// readLP reads a length-prefixed field.
+func readLP(b []byte) (v, remain []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, errors.New("unexpected end of stamp")
+	}
+	l := int(b[0])
+	if len(b) < 1+l {
+		return nil, nil, errors.New("unexpected end of stamp")
+	}
+	return b[1 : 1+l], b[1+l:], nil
+}
+
+func appendLP(b, v []byte) []byte {
+	b = append(b, byte(len(v)))
+	return append(b, v...)
+}
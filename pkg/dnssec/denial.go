@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const nsec3OptOut = 1
+
+// insecureDelegation reports whether recs prove that name is a
+// delegation without DS (RFC 4035 5.2, RFC 5155 8.9).
+func insecureDelegation(name string, recs []dns.RR) bool {
+	for _, rr := range recs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if equalName(rr.Hdr.Name, name) {
+				return isUnsignedDelegation(rr.TypeBitMap)
+			}
+		case *dns.NSEC3:
+			if rr.Iterations > maxNSEC3Iterations {
+				return true
+			}
+			if rr.Match(name) {
+				return isUnsignedDelegation(rr.TypeBitMap)
+			}
+		}
+	}
+	// Opt-out NSEC3 may cover insecure delegations.
+	for _, rr := range recs {
+		if rr, ok := rr.(*dns.NSEC3); ok && rr.Flags&nsec3OptOut != 0 && rr.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnsignedDelegation(types []uint16) bool {
+	return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeDS) && !hasType(types, dns.TypeSOA)
+}
+
+// proveDenial checks that recs prove the NXDOMAIN or NODATA response of
+// name and qtype in zone. The result is Insecure if the proof relies on
+// an opt-out NSEC3 or NSEC3 with too many iterations.
+func proveDenial(name string, qtype uint16, nxdomain bool, zone string, recs []dns.RR) (Result, bool) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range recs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			if rr.Iterations > maxNSEC3Iterations {
+				return Insecure, true
+			}
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	if len(nsecs) > 0 {
+		return Secure, proveDenialNSEC(name, qtype, nxdomain, nsecs)
+	}
+	if len(nsec3s) > 0 {
+		return proveDenialNSEC3(name, qtype, nxdomain, zone, nsec3s)
+	}
+	return Bogus, false
+}
+
+// noData reports whether the type bitmap proves qtype does not exist.
+func noData(types []uint16, qtype uint16) bool {
+	return !hasType(types, qtype) && !hasType(types, dns.TypeCNAME)
+}
+
+// RFC 4035 5.4.
+func proveDenialNSEC(name string, qtype uint16, nxdomain bool, nsecs []*dns.NSEC) bool {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if equalName(n.Hdr.Name, name) {
+				return noData(n.TypeBitMap, qtype)
+			}
+		}
+	}
+
+	var cover *dns.NSEC
+	for _, n := range nsecs {
+		if nsecCover(n, name) {
+			cover = n
+			break
+		}
+	}
+	if cover == nil {
+		return false
+	}
+	if !nxdomain && dns.IsSubDomain(name, cover.NextDomain) {
+		return true // name is an empty non-terminal.
+	}
+
+	// The wildcard at the closest encloser.
+	ce := trimLabels(name, max(dns.CompareDomainName(name, cover.Hdr.Name), dns.CompareDomainName(name, cover.NextDomain)))
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, n := range nsecs {
+		if !nxdomain && equalName(n.Hdr.Name, wildcard) {
+			return noData(n.TypeBitMap, qtype)
+		}
+		if nxdomain && nsecCover(n, wildcard) {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 5155 8.4 - 8.7.
+func proveDenialNSEC3(name string, qtype uint16, nxdomain bool, zone string, nsec3s []*dns.NSEC3) (Result, bool) {
+	if !nxdomain {
+		for _, n := range nsec3s {
+			if n.Match(name) {
+				return Secure, noData(n.TypeBitMap, qtype)
+			}
+		}
+	}
+
+	ce, nextCloser, ok := nsec3ClosestEncloser(name, zone, nsec3s)
+	if !ok {
+		return Bogus, false
+	}
+	var ncCover *dns.NSEC3
+	for _, n := range nsec3s {
+		if n.Cover(nextCloser) {
+			ncCover = n
+			break
+		}
+	}
+	if ncCover == nil {
+		return Bogus, false
+	}
+	if ncCover.Flags&nsec3OptOut != 0 {
+		// RFC 5155 9.2. Opt-out only proves the response is insecure.
+		return Insecure, true
+	}
+
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, n := range nsec3s {
+		if !nxdomain && n.Match(wildcard) {
+			return Secure, noData(n.TypeBitMap, qtype)
+		}
+		if nxdomain && n.Cover(wildcard) {
+			return Secure, true
+		}
+	}
+	return Bogus, false
+}
+
+// nsec3ClosestEncloser finds the closest encloser of name and the next
+// closer name (RFC 5155 8.3).
+func nsec3ClosestEncloser(name, zone string, nsec3s []*dns.NSEC3) (ce, nextCloser string, ok bool) {
+	match := func(s string) bool {
+		for _, n := range nsec3s {
+			if n.Match(s) {
+				return true
+			}
+		}
+		return false
+	}
+	nextCloser = name
+	for c := parentName(name); dns.IsSubDomain(zone, c); c = parentName(c) {
+		if match(c) {
+			return c, nextCloser, true
+		}
+		if c == "." {
+			break
+		}
+		nextCloser = c
+	}
+	return "", "", false
+}
+
+// provesNoName reports whether recs prove that name does not exist.
+// nextCloser is used by NSEC3.
+func provesNoName(name, nextCloser string, recs []dns.RR) bool {
+	for _, rr := range recs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCover(rr, name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Cover(nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecCover reports whether name is between the owner and the next
+// name of n in the canonical order.
+func nsecCover(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, name) >= 0 {
+		return false
+	}
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(name, next) < 0
+	}
+	// The last NSEC in the zone. Its next name is the apex.
+	return dns.IsSubDomain(next, name)
+}
+
+// canonicalCompare compares a and b in the canonical order (RFC 4034 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(unescapeLabel(la[len(la)-i]), unescapeLabel(lb[len(lb)-i])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// unescapeLabel decodes "\X" and "\DDD" escapes in the presentation
+// format label s.
+func unescapeLabel(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i+1])
+		i++
+	}
+	return string(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func hasType(types []uint16, t uint16) bool {
+	return slices.Contains(types, t)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newNSEC3Chain builds an NSEC3 chain for names in zone.
+func newNSEC3Chain(zone string, names map[string][]uint16, flags uint8) []dns.RR {
+	type node struct {
+		hash  string
+		types []uint16
+	}
+	var nodes []node
+	for name, types := range names {
+		nodes = append(nodes, node{hash: dns.HashName(name, dns.SHA1, 0, ""), types: types})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+	var rrs []dns.RR
+	for i, n := range nodes {
+		rrs = append(rrs, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: n.hash + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 60},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			NextDomain: nodes[(i+1)%len(nodes)].hash,
+			TypeBitMap: n.types,
+		})
+	}
+	return rrs
+}
+
+func Test_proveDenialNSEC3(t *testing.T) {
+	names := map[string][]uint16{
+		"example.":   {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"a.example.": {dns.TypeA, dns.TypeRRSIG},
+	}
+	chain := newNSEC3Chain("example.", names, 0)
+	optOutChain := newNSEC3Chain("example.", names, nsec3OptOut)
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		nxdomain bool
+		recs     []dns.RR
+		want     Result
+		wantOk   bool
+	}{
+		{name: "nodata", qname: "a.example.", qtype: dns.TypeAAAA, recs: chain, want: Secure, wantOk: true},
+		{name: "type exists", qname: "a.example.", qtype: dns.TypeA, recs: chain, want: Secure, wantOk: false},
+		{name: "nxdomain", qname: "nx.example.", qtype: dns.TypeA, nxdomain: true, recs: chain, want: Secure, wantOk: true},
+		{name: "name exists", qname: "a.example.", qtype: dns.TypeA, nxdomain: true, recs: chain, want: Bogus, wantOk: false},
+		{name: "opt-out", qname: "nx.example.", qtype: dns.TypeDS, nxdomain: true, recs: optOutChain, want: Insecure, wantOk: true},
+		{name: "no records", qname: "nx.example.", qtype: dns.TypeA, nxdomain: true, want: Bogus, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := proveDenial(tt.qname, tt.qtype, tt.nxdomain, "example.", tt.recs)
+			if ok != tt.wantOk || (ok && got != tt.want) {
+				t.Fatalf("proveDenial() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+const (
+	minCacheTTL = time.Second * 10
+	maxCacheTTL = time.Hour
+
+	// RFC 9276 3.2. Validators may treat responses with higher NSEC3
+	// iterations as insecure.
+	maxNSEC3Iterations = 150
+)
+
+// rootAnchors are the IANA root zone trust anchors (KSK-2017, KSK-2024).
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Result is the security status of a response. See RFC 4035 4.3.
+type Result int
+
+const (
+	Insecure Result = iota
+	Secure
+	Bogus
+)
+
+func (r Result) String() string {
+	switch r {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return fmt.Sprintf("result(%d)", int(r))
+	}
+}
+
+// Error is a validation failure. Code is the Extended DNS Error
+// (RFC 8914) info code that describes it.
+type Error struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+// ExchangeFunc sends q and returns its response.
+type ExchangeFunc func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+type Opts struct {
+	// TrustAnchors are DS records of the root zone.
+	// Default is the IANA root trust anchors.
+	TrustAnchors []*dns.DS
+
+	// CacheSize is the size of the validated zone key cache.
+	CacheSize int
+}
+
+// Validator is a DNSSEC validator. It builds the chain of trust from
+// the root trust anchors and caches validated zone keys.
+// It is safe for concurrent use.
+type Validator struct {
+	anchors []*dns.DS
+	zones   *cache.Cache[key, *zone]
+}
+
+// validation is a single Validate call.
+type validation struct {
+	*Validator
+	exchange ExchangeFunc
+}
+
+type key string
+
+var seed = maphash.MakeSeed()
+
+func (k key) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
+
+// zone is a validated zone and its keys.
+type zone struct {
+	name   string
+	keys   []*dns.DNSKEY // nil if the zone is insecure.
+	expire time.Time
+}
+
+func (z *zone) secure() bool {
+	return len(z.keys) > 0
+}
+
+func NewValidator(opts Opts) (*Validator, error) {
+	anchors := opts.TrustAnchors
+	if len(anchors) == 0 {
+		for _, s := range rootAnchors {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				panic(fmt.Sprintf("invalid root anchor %s, %s", s, err))
+			}
+			anchors = append(anchors, rr.(*dns.DS))
+		}
+	}
+	for _, ds := range anchors {
+		if ds.Hdr.Name != "." {
+			return nil, fmt.Errorf("trust anchor %s is not for the root zone", ds.Hdr.Name)
+		}
+	}
+	return &Validator{
+		anchors: anchors,
+		zones:   cache.New[key, *zone](cache.Opts{Size: opts.CacheSize}),
+	}, nil
+}
+
+func (v *Validator) Close() error {
+	return v.zones.Close()
+}
+
+// Validate validates r, the response of question q. r should be queried
+// with DO and CD bits set. Missing DNSKEY and DS records are fetched by
+// exchange.
+// If the result is Bogus, the returned error describes the reason. It
+// is an *Error if the response is provably bogus.
+func (v *Validator) Validate(ctx context.Context, q dns.Question, r *dns.Msg, exchange ExchangeFunc) (Result, error) {
+	return (&validation{Validator: v, exchange: exchange}).validate(ctx, q, r)
+}
+
+func (v *validation) validate(ctx context.Context, q dns.Question, r *dns.Msg) (Result, error) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return Insecure, nil
+	}
+
+	result := Secure
+	sets := groupRRsets(r.Answer)
+	for _, set := range sets {
+		res, err := v.validateRRset(ctx, set, sets, r.Ns)
+		if err != nil {
+			return Bogus, err
+		}
+		if res == Insecure {
+			result = Insecure
+		}
+	}
+
+	// Follow the CNAME chain to find out whether the answer is negative.
+	target := dns.CanonicalName(q.Name)
+	for i := 0; i < len(sets); i++ {
+		for _, set := range sets {
+			if set.t == dns.TypeCNAME && set.name == target && q.Qtype != dns.TypeCNAME {
+				target = dns.CanonicalName(set.rrs[0].(*dns.CNAME).Target)
+				break
+			}
+		}
+	}
+	negative := r.Rcode == dns.RcodeNameError
+	if !negative && q.Qtype != dns.TypeANY {
+		negative = true
+		for _, set := range sets {
+			if set.name == target && set.t == q.Qtype {
+				negative = false
+				break
+			}
+		}
+	}
+	if negative {
+		res, err := v.validateDenial(ctx, target, q.Qtype, r.Rcode == dns.RcodeNameError, r.Ns)
+		if err != nil {
+			return Bogus, err
+		}
+		if res == Insecure {
+			result = Insecure
+		}
+	}
+	return result, nil
+}
+
+// validateRRset validates set from the answer section. answer is
+// needed to accept CNAMEs synthesized from DNAMEs. ns is needed to
+// prove wildcard expansions.
+func (v *validation) validateRRset(ctx context.Context, set *rrset, answer []*rrset, ns []dns.RR) (Result, error) {
+	zoneName := set.name
+	if set.t == dns.TypeDS { // DS is signed by the parent zone.
+		zoneName = parentName(set.name)
+	}
+	z, err := v.zoneOf(ctx, zoneName)
+	if err != nil {
+		return Bogus, err
+	}
+	if !z.secure() {
+		return Insecure, nil
+	}
+
+	if set.t == dns.TypeCNAME && len(set.sigs) == 0 && synthesizedFromDNAME(set, answer) {
+		return Secure, nil // The DNAME is validated separately.
+	}
+
+	sig, err := verifyRRset(set.rrs, set.sigs, z.name, z.keys)
+	if err != nil {
+		return Bogus, err
+	}
+	if int(sig.Labels) < dns.CountLabel(set.name) {
+		// RFC 4035 5.3.4. Wildcard expansion, the next closer name must be
+		// proved not to exist.
+		recs, err := verifiedDenialRecords(ns, z)
+		if err != nil {
+			return Bogus, err
+		}
+		nextCloser := trimLabels(set.name, int(sig.Labels)+1)
+		if !provesNoName(set.name, nextCloser, recs) {
+			return Bogus, &Error{
+				Code:   dns.ExtendedErrorCodeNSECMissing,
+				Reason: fmt.Sprintf("missing proof for wildcard expansion of %s", set.name),
+			}
+		}
+	}
+	return Secure, nil
+}
+
+// validateDenial validates the NXDOMAIN or NODATA response for name and qtype.
+func (v *validation) validateDenial(ctx context.Context, name string, qtype uint16, nxdomain bool, ns []dns.RR) (Result, error) {
+	zoneName := name
+	if qtype == dns.TypeDS {
+		zoneName = parentName(name)
+	}
+	z, err := v.zoneOf(ctx, zoneName)
+	if err != nil {
+		return Bogus, err
+	}
+	if !z.secure() {
+		return Insecure, nil
+	}
+
+	recs, err := verifiedDenialRecords(ns, z)
+	if err != nil {
+		return Bogus, err
+	}
+	res, ok := proveDenial(name, qtype, nxdomain, z.name, recs)
+	if !ok {
+		return Bogus, &Error{
+			Code:   dns.ExtendedErrorCodeNSECMissing,
+			Reason: fmt.Sprintf("missing denial of existence proof for %s %s", name, dns.TypeToString[qtype]),
+		}
+	}
+	return res, nil
+}
+
+// zoneOf returns the closest zone that encloses name. Keys of the
+// zone are validated through the chain of trust.
+func (v *validation) zoneOf(ctx context.Context, name string) (*zone, error) {
+	name = dns.CanonicalName(name)
+	if z, _, ok := v.zones.Get(key(name)); ok {
+		return z, nil
+	}
+
+	var z *zone
+	var err error
+	if name == "." {
+		z, err = v.fetchKeys(ctx, ".", v.anchors)
+	} else {
+		var parent *zone
+		parent, err = v.zoneOf(ctx, parentName(name))
+		if err != nil {
+			return nil, err
+		}
+		if parent.secure() {
+			z, err = v.childZone(ctx, parent, name)
+		} else {
+			z = parent
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.zones.Store(key(name), z, z.expire)
+	return z, nil
+}
+
+// childZone checks whether name is a delegation from the secure zone
+// parent. It returns parent if name is not a zone cut.
+func (v *validation) childZone(ctx context.Context, parent *zone, name string) (*zone, error) {
+	r, err := v.query(ctx, name, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return parent, nil
+	}
+
+	var dsRRs []dns.RR
+	var ds []*dns.DS
+	for _, rr := range r.Answer {
+		if d, ok := rr.(*dns.DS); ok && equalName(d.Hdr.Name, name) {
+			dsRRs = append(dsRRs, d)
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) > 0 {
+		sig, err := verifyRRset(dsRRs, sigsOf(r.Answer, name, dns.TypeDS), parent.name, parent.keys)
+		if err != nil {
+			return nil, err
+		}
+		z, err := v.fetchKeys(ctx, name, ds)
+		if err != nil {
+			return nil, err
+		}
+		if e := expireOf(dsRRs, sig); e.Before(z.expire) {
+			z.expire = e
+		}
+		return z, nil
+	}
+
+	// No DS. Look for the proof of an insecure delegation.
+	recs, err := verifiedDenialRecords(r.Ns, parent)
+	if err != nil {
+		return nil, err
+	}
+	if insecureDelegation(name, recs) {
+		return &zone{name: name, expire: expireOf(recs, nil)}, nil
+	}
+	return parent, nil
+}
+
+// fetchKeys fetches and validates the DNSKEY RRset of zone name with its ds.
+func (v *validation) fetchKeys(ctx context.Context, name string, ds []*dns.DS) (*zone, error) {
+	supported := supportedDS(ds)
+	if len(supported) == 0 {
+		// RFC 4035 5.2. The zone is treated as unsigned.
+		return &zone{name: name, expire: expireOf(dsToRRs(ds), nil)}, nil
+	}
+
+	r, err := v.query(ctx, name, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var keyRRs []dns.RR
+	var keys, sep []*dns.DNSKEY
+	for _, rr := range r.Answer {
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok || !equalName(k.Hdr.Name, name) {
+			continue
+		}
+		keyRRs = append(keyRRs, k)
+		if k.Flags&dns.ZONE != 0 && k.Flags&dns.REVOKE == 0 {
+			keys = append(keys, k)
+		}
+		for _, d := range supported {
+			if dsMatch(d, k) {
+				sep = append(sep, k)
+				break
+			}
+		}
+	}
+	if len(sep) == 0 {
+		return nil, &Error{
+			Code:   dns.ExtendedErrorCodeDNSKEYMissing,
+			Reason: fmt.Sprintf("no DNSKEY of %s matches its DS", name),
+		}
+	}
+	sig, err := verifyRRset(keyRRs, sigsOf(r.Answer, name, dns.TypeDNSKEY), name, sep)
+	if err != nil {
+		return nil, err
+	}
+	return &zone{name: name, keys: keys, expire: expireOf(keyRRs, sig)}, nil
+}
+
+func (v *validation) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(1232, true)
+	q.CheckingDisabled = true
+	r, err := v.exchange(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s %s, %w", name, dns.TypeToString[qtype], err)
+	}
+	if r == nil {
+		return nil, fmt.Errorf("no response for %s %s", name, dns.TypeToString[qtype])
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, &Error{
+			Code:   dns.ExtendedErrorCodeDNSSECIndeterminate,
+			Reason: fmt.Sprintf("%s %s query returned %s", name, dns.TypeToString[qtype], dns.RcodeToString[r.Rcode]),
+		}
+	}
+	return r, nil
+}
+
+// parentName returns the parent of name. Parent of the root is the root.
+func parentName(name string) string {
+	idx := dns.Split(name)
+	if len(idx) < 2 {
+		return "."
+	}
+	return name[idx[1]:]
+}
+
+// trimLabels returns the last n labels of name.
+func trimLabels(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+	if n <= 0 {
+		return "."
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+func equalName(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+// expireOf returns the time when rrs should be expired from the cache.
+// sig can be nil.
+func expireOf(rrs []dns.RR, sig *dns.RRSIG) time.Time {
+	ttl := maxCacheTTL
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	ttl = max(ttl, minCacheTTL)
+	e := time.Now().Add(ttl)
+	if sig != nil {
+		if se := time.Unix(int64(sig.Expiration), 0); se.Before(e) {
+			e = se
+		}
+	}
+	return e
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	name   string
+	key    *dns.DNSKEY // nil if the zone is unsigned.
+	signer crypto.Signer
+	rrs    []dns.RR // including RRSIGs
+}
+
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{name: name}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.signer = priv.(crypto.Signer)
+		records = append(records, z.key.String())
+	}
+
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	z.rrs = append(z.rrs, rrs...)
+	if signed {
+		for _, set := range groupRRsets(rrs) {
+			expiration := time.Now().Add(time.Hour)
+			if set.name == "exp."+name {
+				expiration = time.Now().Add(-time.Hour)
+			}
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Name: set.name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+				KeyTag:     z.key.KeyTag(),
+				SignerName: name,
+				Algorithm:  z.key.Algorithm,
+				Inception:  uint32(time.Now().Add(-2 * time.Hour).Unix()),
+				Expiration: uint32(expiration.Unix()),
+			}
+			if err := sig.Sign(z.signer, set.rrs); err != nil {
+				t.Fatal(err)
+			}
+			z.rrs = append(z.rrs, sig)
+		}
+	}
+	return z
+}
+
+func (z *testZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+// find returns the rrset and its RRSIGs.
+func (z *testZone) find(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		h := rr.Header()
+		if !equalName(h.Name, name) {
+			continue
+		}
+		if h.Rrtype == qtype || h.Rrtype == dns.TypeRRSIG && rr.(*dns.RRSIG).TypeCovered == qtype {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+	return rrs
+}
+
+func (z *testZone) exists(name string) bool {
+	for _, rr := range z.rrs {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// covering returns NSECs that cover one of names, and their RRSIGs.
+func (z *testZone) covering(names ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if n, ok := rr.(*dns.NSEC); ok {
+			for _, name := range names {
+				if nsecCover(n, name) {
+					rrs = append(rrs, z.find(n.Hdr.Name, dns.TypeNSEC)...)
+					break
+				}
+			}
+		}
+	}
+	return rrs
+}
+
+type testServer struct {
+	zones []*testZone
+}
+
+// zoneFor returns the zone that is authoritative for name and qtype.
+func (s *testServer) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range s.zones {
+		if !dns.IsSubDomain(z.name, name) || qtype == dns.TypeDS && z.name == name && name != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.name) > dns.CountLabel(best.name) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (s *testServer) exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	qq := q.Question[0]
+	name := dns.CanonicalName(qq.Name)
+	z := s.zoneFor(name, qq.Qtype)
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	if rrs := z.find(name, qq.Qtype); len(rrs) > 0 {
+		r.Answer = rrs
+		return r, nil
+	}
+	soa := z.find(z.name, dns.TypeSOA)
+	if z.exists(name) {
+		r.Ns = append(soa, z.find(name, dns.TypeNSEC)...)
+		if len(r.Ns) == len(soa) {
+			r.Ns = append(r.Ns, z.covering(name)...)
+		}
+		return r, nil
+	}
+	if rrs := z.find("*."+parentName(name), qq.Qtype); len(rrs) > 0 {
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+		r.Answer = rrs
+		r.Ns = z.covering(name)
+		return r, nil
+	}
+	r.Rcode = dns.RcodeNameError
+	r.Ns = append(soa, z.covering(name, "*."+z.name)...)
+	return r, nil
+}
+
+func Test_Validator(t *testing.T) {
+	tz := newTestZone(t, "test.", true,
+		"test. 3600 IN SOA ns.test. admin.test. 1 3600 600 86400 60",
+		"test. 3600 IN NS ns.test.",
+		"a.test. 3600 IN A 192.0.2.1",
+		"exp.test. 3600 IN A 192.0.2.2",
+		"insecure.test. 3600 IN NS ns.insecure.test.",
+		"*.w.test. 3600 IN A 192.0.2.3",
+		"test. 60 IN NSEC a.test. NS SOA RRSIG NSEC DNSKEY",
+		"a.test. 60 IN NSEC exp.test. A RRSIG NSEC",
+		"exp.test. 60 IN NSEC insecure.test. A RRSIG NSEC",
+		"insecure.test. 60 IN NSEC *.w.test. NS RRSIG NSEC",
+		"*.w.test. 60 IN NSEC test. A RRSIG NSEC",
+	)
+	rootZone := newTestZone(t, ".", true,
+		". 3600 IN SOA ns.root. admin.root. 1 3600 600 86400 60",
+		tz.ds(),
+		". 60 IN NSEC test. NS SOA RRSIG NSEC DNSKEY",
+		"test. 60 IN NSEC . NS DS RRSIG NSEC",
+	)
+	insecureZone := newTestZone(t, "insecure.test.", false,
+		"insecure.test. 3600 IN SOA ns.insecure.test. admin.insecure.test. 1 3600 600 86400 60",
+		"x.insecure.test. 3600 IN A 192.0.2.4",
+	)
+	s := &testServer{zones: []*testZone{rootZone, tz, insecureZone}}
+	anchor, err := dns.NewRR(rootZone.ds())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(r *dns.Msg) {
+		for _, rr := range r.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				a.A[3]++
+			}
+		}
+	}
+	stripSigs := func(r *dns.Msg) {
+		var rrs []dns.RR
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype != dns.TypeRRSIG {
+				rrs = append(rrs, rr)
+			}
+		}
+		r.Answer = rrs
+	}
+	stripNs := func(r *dns.Msg) {
+		r.Ns = nil
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		modify   func(r *dns.Msg)
+		want     Result
+		wantCode uint16
+	}{
+		{name: "secure", qname: "a.test.", qtype: dns.TypeA, want: Secure},
+		{name: "nodata", qname: "a.test.", qtype: dns.TypeAAAA, want: Secure},
+		{name: "nxdomain", qname: "nx.test.", qtype: dns.TypeA, want: Secure},
+		{name: "wildcard", qname: "x.w.test.", qtype: dns.TypeA, want: Secure},
+		{name: "insecure delegation", qname: "x.insecure.test.", qtype: dns.TypeA, want: Insecure},
+		{name: "tampered", qname: "a.test.", qtype: dns.TypeA, modify: tamper, want: Bogus, wantCode: dns.ExtendedErrorCodeDNSBogus},
+		{name: "rrsig missing", qname: "a.test.", qtype: dns.TypeA, modify: stripSigs, want: Bogus, wantCode: dns.ExtendedErrorCodeRRSIGsMissing},
+		{name: "nsec missing", qname: "nx.test.", qtype: dns.TypeA, modify: stripNs, want: Bogus, wantCode: dns.ExtendedErrorCodeNSECMissing},
+		{name: "wildcard proof missing", qname: "x.w.test.", qtype: dns.TypeA, modify: stripNs, want: Bogus, wantCode: dns.ExtendedErrorCodeNSECMissing},
+		{name: "expired", qname: "exp.test.", qtype: dns.TypeA, want: Bogus, wantCode: dns.ExtendedErrorCodeSignatureExpired},
+	}
+
+	v, err := NewValidator(Opts{TrustAnchors: []*dns.DS{anchor.(*dns.DS)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			r, _ := s.exchange(context.Background(), q)
+			if tt.modify != nil {
+				tt.modify(r)
+			}
+			got, err := v.Validate(context.Background(), q.Question[0], r, s.exchange)
+			if got != tt.want {
+				t.Fatalf("Validate() = %s, want %s, err = %v", got, tt.want, err)
+			}
+			if tt.wantCode != 0 {
+				var ve *Error
+				if !errors.As(err, &ve) || ve.Code != tt.wantCode {
+					t.Fatalf("Validate() err = %v, want code %d", err, tt.wantCode)
+				}
+			}
+		})
+	}
+
+	t.Run("wrong anchor", func(t *testing.T) {
+		wrong := dns.Copy(anchor).(*dns.DS)
+		wrong.Digest = tz.key.ToDS(dns.SHA256).Digest
+		v, err := NewValidator(Opts{TrustAnchors: []*dns.DS{wrong}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer v.Close()
+		q := new(dns.Msg)
+		q.SetQuestion("a.test.", dns.TypeA)
+		r, _ := s.exchange(context.Background(), q)
+		got, err := v.Validate(context.Background(), q.Question[0], r, s.exchange)
+		var ve *Error
+		if got != Bogus || !errors.As(err, &ve) || ve.Code != dns.ExtendedErrorCodeDNSKEYMissing {
+			t.Fatalf("Validate() = %s, %v", got, err)
+		}
+	})
+}
+
+func Test_canonicalCompare(t *testing.T) {
+	// RFC 4034 6.1 example.
+	names := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example.",
+	}
+	for i := 0; i < len(names)-1; i++ {
+		if canonicalCompare(names[i], names[i+1]) >= 0 {
+			t.Errorf("%s should be before %s", names[i], names[i+1])
+		}
+	}
+}
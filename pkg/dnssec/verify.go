@@ -0,0 +1,193 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// supportedAlgorithms are algorithms that dns.RRSIG.Verify supports.
+var supportedAlgorithms = map[uint8]struct{}{
+	dns.RSASHA1:          {},
+	dns.RSASHA1NSEC3SHA1: {},
+	dns.RSASHA256:        {},
+	dns.RSASHA512:        {},
+	dns.ECDSAP256SHA256:  {},
+	dns.ECDSAP384SHA384:  {},
+	dns.ED25519:          {},
+}
+
+func supportedDS(ds []*dns.DS) []*dns.DS {
+	var s []*dns.DS
+	for _, d := range ds {
+		if _, ok := supportedAlgorithms[d.Algorithm]; !ok {
+			continue
+		}
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			s = append(s, d)
+		}
+	}
+	return s
+}
+
+func dsMatch(d *dns.DS, k *dns.DNSKEY) bool {
+	if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+		return false
+	}
+	kd := k.ToDS(d.DigestType)
+	return kd != nil && strings.EqualFold(kd.Digest, d.Digest)
+}
+
+func dsToRRs(ds []*dns.DS) []dns.RR {
+	rrs := make([]dns.RR, 0, len(ds))
+	for _, d := range ds {
+		rrs = append(rrs, d)
+	}
+	return rrs
+}
+
+// verifyRRset verifies rrset with sigs made by keys of zone signer.
+// It returns the first valid signature.
+func verifyRRset(rrs []dns.RR, sigs []*dns.RRSIG, signer string, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	h := rrs[0].Header()
+	desc := h.Name + " " + dns.TypeToString[h.Rrtype]
+	if len(sigs) == 0 {
+		return nil, &Error{Code: dns.ExtendedErrorCodeRRSIGsMissing, Reason: "no RRSIG for " + desc}
+	}
+
+	now := time.Now()
+	var err error = &Error{Code: dns.ExtendedErrorCodeDNSBogus, Reason: "no valid RRSIG for " + desc}
+	for _, sig := range sigs {
+		if !equalName(sig.SignerName, signer) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			if int64(sig.Expiration) < now.Unix() {
+				err = &Error{Code: dns.ExtendedErrorCodeSignatureExpired, Reason: "RRSIG expired for " + desc}
+			} else {
+				err = &Error{Code: dns.ExtendedErrorCodeSignatureNotYetValid, Reason: "RRSIG not yet valid for " + desc}
+			}
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(k, rrs) == nil {
+				return sig, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// rrset is a group of records with the same name, type and class, and
+// their signatures.
+type rrset struct {
+	name string // canonical
+	t    uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// groupRRsets groups records in section into rrsets.
+func groupRRsets(section []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, t uint16) *rrset {
+		for _, s := range sets {
+			if s.name == name && s.t == t {
+				return s
+			}
+		}
+		return nil
+	}
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := dns.CanonicalName(h.Name)
+		s := find(name, h.Rrtype)
+		if s == nil {
+			s = &rrset{name: name, t: h.Rrtype}
+			sets = append(sets, s)
+		}
+		s.rrs = append(s.rrs, rr)
+	}
+	for _, s := range sets {
+		s.sigs = sigsOf(section, s.name, s.t)
+	}
+	return sets
+}
+
+// sigsOf returns RRSIGs in section that cover name and type t.
+func sigsOf(section []dns.RR, name string, t uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t && equalName(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// synthesizedFromDNAME reports whether the CNAME set is synthesized
+// from a DNAME in answer (RFC 6672 5.3.1).
+func synthesizedFromDNAME(set *rrset, answer []*rrset) bool {
+	cname := set.rrs[0].(*dns.CNAME)
+	for _, s := range answer {
+		if s.t != dns.TypeDNAME || !dns.IsSubDomain(s.name, set.name) || s.name == set.name {
+			continue
+		}
+		dname := s.rrs[0].(*dns.DNAME)
+		prefix := set.name[:len(set.name)-len(s.name)]
+		if equalName(cname.Target, prefix+dname.Target) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedDenialRecords returns NSEC and NSEC3 records in section that
+// are signed by z. Any record that fails the verification is an error.
+func verifiedDenialRecords(section []dns.RR, z *zone) ([]dns.RR, error) {
+	var recs []dns.RR
+	for _, set := range groupRRsets(section) {
+		if set.t != dns.TypeNSEC && set.t != dns.TypeNSEC3 {
+			continue
+		}
+		if !dns.IsSubDomain(z.name, set.name) {
+			return nil, &Error{
+				Code:   dns.ExtendedErrorCodeDNSBogus,
+				Reason: fmt.Sprintf("%s %s is out of zone %s", set.name, dns.TypeToString[set.t], z.name),
+			}
+		}
+		if _, err := verifyRRset(set.rrs, set.sigs, z.name, z.keys); err != nil {
+			return nil, err
+		}
+		recs = append(recs, set.rrs...)
+	}
+	return recs, nil
+}
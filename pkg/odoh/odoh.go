@@ -0,0 +1,381 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package odoh implements Oblivious DNS over HTTPS (RFC 9230) messages.
+package odoh
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	// ContentType is the media type of ODoH messages.
+	ContentType = "application/oblivious-dns-message"
+	// ConfigsPath is the well-known path of ODoH configs.
+	ConfigsPath = "/.well-known/odohconfigs"
+
+	configVersion = 0x0001
+
+	msgTypeQuery    = 0x01
+	msgTypeResponse = 0x02
+
+	respNonceSize = max(hpkeNk, hpkeNn)
+
+	queryPadBlockSize    = 128
+	responsePadBlockSize = 468
+)
+
+var (
+	errMsgTooShort   = errors.New("message is too short")
+	errInvalidMsg    = errors.New("invalid odoh message")
+	errKeyIDMismatch = errors.New("key id mismatched")
+	errNoValidConfig = errors.New("no supported odoh config")
+)
+
+// Config is an ObliviousDoHConfigContents.
+type Config struct {
+	KemID     uint16
+	KdfID     uint16
+	AeadID    uint16
+	PublicKey []byte
+}
+
+func (c *Config) supported() bool {
+	return c.KemID == kemX25519HKDFSHA256 && c.KdfID == kdfHKDFSHA256 && c.AeadID == aeadAES128GCM
+}
+
+func (c *Config) marshal() []byte {
+	b := make([]byte, 0, 8+len(c.PublicKey))
+	b = binary.BigEndian.AppendUint16(b, c.KemID)
+	b = binary.BigEndian.AppendUint16(b, c.KdfID)
+	b = binary.BigEndian.AppendUint16(b, c.AeadID)
+	return appendLP16(b, c.PublicKey)
+}
+
+// KeyID returns the key id of c.
+func (c *Config) KeyID() []byte {
+	prk, _ := hkdf.Extract(sha256.New, c.marshal(), nil)
+	id, _ := hkdf.Expand(sha256.New, prk, "odoh key id", hpkeNh)
+	return id
+}
+
+// MarshalConfigs returns the wire format of ObliviousDoHConfigs.
+func MarshalConfigs(cs []Config) []byte {
+	var body []byte
+	for _, c := range cs {
+		body = binary.BigEndian.AppendUint16(body, configVersion)
+		body = appendLP16(body, c.marshal())
+	}
+	return appendLP16(nil, body)
+}
+
+// ParseConfigs parses ObliviousDoHConfigs. Configs that have unknown
+// versions or unsupported cipher suites are ignored. It returns an error
+// if there is no supported config.
+func ParseConfigs(b []byte) ([]Config, error) {
+	body, remain, err := readLP16(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(remain) > 0 {
+		return nil, errInvalidMsg
+	}
+
+	var cs []Config
+	for len(body) > 0 {
+		if len(body) < 2 {
+			return nil, errMsgTooShort
+		}
+		version := binary.BigEndian.Uint16(body)
+		var contents []byte
+		contents, body, err = readLP16(body[2:])
+		if err != nil {
+			return nil, err
+		}
+		if version != configVersion {
+			continue
+		}
+		if len(contents) < 6 {
+			return nil, errMsgTooShort
+		}
+		c := Config{
+			KemID:  binary.BigEndian.Uint16(contents),
+			KdfID:  binary.BigEndian.Uint16(contents[2:]),
+			AeadID: binary.BigEndian.Uint16(contents[4:]),
+		}
+		c.PublicKey, _, err = readLP16(contents[6:])
+		if err != nil {
+			return nil, err
+		}
+		if c.supported() {
+			cs = append(cs, c)
+		}
+	}
+	if len(cs) == 0 {
+		return nil, errNoValidConfig
+	}
+	return cs, nil
+}
+
+// KeyPair is the key pair of an ODoH target.
+type KeyPair struct {
+	Config Config
+	sk     *ecdh.PrivateKey
+	keyID  []byte
+}
+
+// GenerateKeyPair generates a new key pair.
+func GenerateKeyPair() (*KeyPair, error) {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyPair(sk), nil
+}
+
+// NewKeyPair creates a key pair from a X25519 secret key.
+func NewKeyPair(sk []byte) (*KeyPair, error) {
+	k, err := ecdh.X25519().NewPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyPair(k), nil
+}
+
+func newKeyPair(sk *ecdh.PrivateKey) *KeyPair {
+	kp := &KeyPair{
+		Config: Config{
+			KemID:     kemX25519HKDFSHA256,
+			KdfID:     kdfHKDFSHA256,
+			AeadID:    aeadAES128GCM,
+			PublicKey: sk.PublicKey().Bytes(),
+		},
+		sk: sk,
+	}
+	kp.keyID = kp.Config.KeyID()
+	return kp
+}
+
+// SecretKey returns the X25519 secret key.
+func (kp *KeyPair) SecretKey() []byte {
+	return kp.sk.Bytes()
+}
+
+// QueryContext is used by clients to decrypt the response of a query.
+type QueryContext struct {
+	hc     *hpkeContext
+	qPlain []byte
+}
+
+// EncryptQuery encrypts the dns msg q to the target of config c.
+func EncryptQuery(c Config, q []byte) ([]byte, *QueryContext, error) {
+	if !c.supported() {
+		return nil, nil, errNoValidConfig
+	}
+	pkR, err := ecdh.X25519().NewPublicKey(c.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, hc, err := setupBaseS(pkR, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID := c.KeyID()
+	qPlain := marshalPlaintext(q, queryPadBlockSize)
+	ct := hc.seal(msgAAD(msgTypeQuery, keyID), qPlain)
+	encrypted := append(enc, ct...)
+	return marshalMsg(msgTypeQuery, keyID, encrypted), &QueryContext{hc: hc, qPlain: qPlain}, nil
+}
+
+// DecryptResponse decrypts the response msg b and returns the dns msg.
+func (qc *QueryContext) DecryptResponse(b []byte) ([]byte, error) {
+	respNonce, ct, err := parseMsg(b, msgTypeResponse)
+	if err != nil {
+		return nil, err
+	}
+	key, nonce, err := deriveResponseSecrets(qc.hc, qc.qPlain, respNonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, nonce, ct, msgAAD(msgTypeResponse, respNonce))
+	if err != nil {
+		return nil, errOpenFailed
+	}
+	return parsePlaintext(pt)
+}
+
+// ResponseContext is used by targets to encrypt the response of a query.
+type ResponseContext struct {
+	hc     *hpkeContext
+	qPlain []byte
+}
+
+// DecryptQuery decrypts the query msg b and returns the dns msg.
+func (kp *KeyPair) DecryptQuery(b []byte) ([]byte, *ResponseContext, error) {
+	keyID, encrypted, err := parseMsg(b, msgTypeQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !slices.Equal(keyID, kp.keyID) {
+		return nil, nil, errKeyIDMismatch
+	}
+	const encSize = 32 // X25519 public key size
+	if len(encrypted) < encSize {
+		return nil, nil, errMsgTooShort
+	}
+	hc, err := setupBaseR(encrypted[:encSize], kp.sk, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	qPlain, err := hc.open(msgAAD(msgTypeQuery, keyID), encrypted[encSize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := parsePlaintext(qPlain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return q, &ResponseContext{hc: hc, qPlain: qPlain}, nil
+}
+
+// EncryptResponse encrypts the dns msg r.
+func (rc *ResponseContext) EncryptResponse(r []byte) ([]byte, error) {
+	respNonce := make([]byte, respNonceSize)
+	if _, err := rand.Read(respNonce); err != nil {
+		return nil, err
+	}
+	key, nonce, err := deriveResponseSecrets(rc.hc, rc.qPlain, respNonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, nonce, marshalPlaintext(r, responsePadBlockSize), msgAAD(msgTypeResponse, respNonce))
+	return marshalMsg(msgTypeResponse, respNonce, ct), nil
+}
+
+func deriveResponseSecrets(hc *hpkeContext, qPlain, respNonce []byte) (key, nonce []byte, err error) {
+	secret := hc.export([]byte("odoh response"), hpkeNk)
+	salt := make([]byte, 0, len(qPlain)+2+len(respNonce))
+	salt = append(salt, qPlain...)
+	salt = appendLP16(salt, respNonce)
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err = hkdf.Expand(sha256.New, prk, "odoh key", hpkeNk)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err = hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, nonce, nil
+}
+
+func msgAAD(typ byte, keyID []byte) []byte {
+	return appendLP16([]byte{typ}, keyID)
+}
+
+func marshalMsg(typ byte, keyID, encrypted []byte) []byte {
+	b := make([]byte, 0, 5+len(keyID)+len(encrypted))
+	b = append(b, typ)
+	b = appendLP16(b, keyID)
+	return appendLP16(b, encrypted)
+}
+
+func parseMsg(b []byte, wantType byte) (keyID, encrypted []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, errMsgTooShort
+	}
+	if b[0] != wantType {
+		return nil, nil, fmt.Errorf("unexpected message type %d", b[0])
+	}
+	keyID, b, err = readLP16(b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted, b, err = readLP16(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) > 0 {
+		return nil, nil, errInvalidMsg
+	}
+	return keyID, encrypted, nil
+}
+
+// marshalPlaintext returns an ObliviousDoHMessagePlaintext. The dns msg
+// and padding will be padded to a multiple of blockSize.
+func marshalPlaintext(m []byte, blockSize int) []byte {
+	padLen := (blockSize - len(m)%blockSize) % blockSize
+	b := make([]byte, 0, 4+len(m)+padLen)
+	b = appendLP16(b, m)
+	return appendLP16(b, make([]byte, padLen))
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	m, b, err := readLP16(b)
+	if err != nil {
+		return nil, err
+	}
+	padding, b, err := readLP16(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 {
+		return nil, errInvalidMsg
+	}
+	for _, c := range padding {
+		if c != 0 {
+			return nil, errInvalidMsg
+		}
+	}
+	return m, nil
+}
+
+func appendLP16(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func readLP16(b []byte) (v, remain []byte, err error) {
+	if len(b) < 2 {
+		return nil, nil, errMsgTooShort
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, errMsgTooShort
+	}
+	return b[2 : 2+l], b[2+l:], nil
+}
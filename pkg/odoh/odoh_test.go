@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestODoH(t *testing.T) {
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp2, err := NewKeyPair(kp.SecretKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kp.Config.KeyID(), kp2.Config.KeyID()) {
+		t.Fatal("key pair from the same secret key should have the same key id")
+	}
+
+	cs, err := ParseConfigs(MarshalConfigs([]Config{kp.Config}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || !bytes.Equal(cs[0].PublicKey, kp.Config.PublicKey) {
+		t.Fatal("configs round trip failed")
+	}
+	unsupported := Config{KemID: 0x0010, KdfID: kdfHKDFSHA256, AeadID: aeadAES128GCM, PublicKey: []byte{1}}
+	if _, err := ParseConfigs(MarshalConfigs([]Config{unsupported})); err == nil {
+		t.Fatal("unsupported config should be ignored")
+	}
+
+	q := []byte("dns query")
+	encQ, qCtx, err := EncryptQuery(cs[0], q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotQ, rCtx, err := kp.DecryptQuery(encQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotQ, q) {
+		t.Fatal("query mismatched")
+	}
+
+	r := []byte("dns response")
+	encR, err := rCtx.EncryptResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotR, err := qCtx.DecryptResponse(encR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotR, r) {
+		t.Fatal("response mismatched")
+	}
+
+	// Tampered response.
+	encR[len(encR)-1] ^= 1
+	if _, err := qCtx.DecryptResponse(encR); err == nil {
+		t.Fatal("tampered response should be rejected")
+	}
+
+	// Query to another target.
+	other, _ := GenerateKeyPair()
+	if _, _, err := other.DecryptQuery(encQ); err == nil {
+		t.Fatal("query with a mismatched key id should be rejected")
+	}
+}
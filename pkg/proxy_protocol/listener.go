@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxy_protocol
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const defaultHeaderTimeout = time.Second * 5
+
+// TrustedFunc reports whether the peer addr is a trusted proxy.
+type TrustedFunc func(addr netip.Addr) bool
+
+// PrefixesTrusted returns a TrustedFunc that trusts addresses in p.
+// If p is empty, no address is trusted.
+func PrefixesTrusted(p []netip.Prefix) TrustedFunc {
+	return func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, prefix := range p {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type ListenerOpts struct {
+	// Trusted reports whether the connection is from a trusted proxy.
+	// Connections from untrusted peers are passed through as is.
+	// Nil means all peers are trusted.
+	Trusted TrustedFunc
+
+	// HeaderTimeout is the max time to wait for the header when the
+	// header is read by RemoteAddr/LocalAddr. Default is 5s.
+	HeaderTimeout time.Duration
+}
+
+// Listener is a net.Listener that reads PROXY protocol headers from
+// connections from trusted proxies. The header is read lazily on the first
+// Read, RemoteAddr or LocalAddr call, so Accept won't block.
+// Connections from trusted proxies must send a valid header, or they will
+// be closed.
+type Listener struct {
+	net.Listener
+	opts ListenerOpts
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+func NewListener(l net.Listener, opts ListenerOpts) *Listener {
+	if opts.HeaderTimeout <= 0 {
+		opts.HeaderTimeout = defaultHeaderTimeout
+	}
+	return &Listener{Listener: l, opts: opts}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.opts.Trusted != nil {
+		ap, _ := netip.ParseAddrPort(c.RemoteAddr().String())
+		if !l.opts.Trusted(ap.Addr()) {
+			return c, nil
+		}
+	}
+	return &Conn{Conn: c, br: bufio.NewReaderSize(c, 256), headerTimeout: l.opts.HeaderTimeout}, nil
+}
+
+// Conn is a net.Conn from a trusted proxy.
+type Conn struct {
+	net.Conn
+	br            *bufio.Reader
+	headerTimeout time.Duration
+
+	once       sync.Once
+	header     *Header
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	err        error
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func (c *Conn) readHeader() {
+	c.remoteAddr = c.Conn.RemoteAddr()
+	c.localAddr = c.Conn.LocalAddr()
+	h, err := ReadHeader(c.br)
+	if err != nil {
+		c.err = err
+		c.Conn.Close()
+		return
+	}
+	c.header = h
+	if h.Local {
+		return
+	}
+	c.remoteAddr = net.TCPAddrFromAddrPort(h.Src)
+	c.localAddr = net.TCPAddrFromAddrPort(h.Dst)
+}
+
+// readHeaderWithTimeout reads the header with a deadline. It is used by
+// calls that don't have a deadline set by the caller.
+func (c *Conn) readHeaderWithTimeout() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		c.readHeader()
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Header returns the PROXY protocol header. It reads the header if it
+// was not read yet.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeaderWithTimeout()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the source address in the header.
+// If the header is invalid or it is a LOCAL header, the real remote
+// address will be returned.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeaderWithTimeout()
+	return c.remoteAddr
+}
+
+// LocalAddr returns the destination address in the header.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeaderWithTimeout()
+	return c.localAddr
+}
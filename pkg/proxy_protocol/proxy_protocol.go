@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package proxy_protocol implements the server side of the HAProxy PROXY
+// protocol version 1 and 2.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	v1Prefix = []byte("PROXY ")
+	v2Sig    = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+const (
+	v1MaxLen      = 107
+	v2HeaderLen   = 16
+	v2MaxAddrsLen = 2048 // Addresses and TLVs. We don't need that much.
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamUnspec = 0x0
+	v2FamInet   = 0x1
+	v2FamInet6  = 0x2
+)
+
+var (
+	ErrNoHeader      = errors.New("no proxy protocol header")
+	ErrInvalidHeader = errors.New("invalid proxy protocol header")
+)
+
+// Header is a parsed PROXY protocol header.
+type Header struct {
+	Version int
+
+	// Local is true if the connection was established by the proxy itself
+	// (e.g. health checks), or the protocol is unknown. In this case, Src
+	// and Dst are invalid and the real connection addresses should be used.
+	Local bool
+
+	Src netip.AddrPort
+	Dst netip.AddrPort
+}
+
+// ReadHeader reads a v1 or v2 header from r.
+// If r does not start with a header, ErrNoHeader will be returned.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v1Prefix) {
+		return readV1(r)
+	}
+
+	b, err = r.Peek(v2HeaderLen)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrNoHeader
+		}
+		return nil, err
+	}
+	if !bytes.Equal(b[:len(v2Sig)], v2Sig) {
+		return nil, ErrNoHeader
+	}
+	l := v2HeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if l-v2HeaderLen > v2MaxAddrsLen {
+		return nil, fmt.Errorf("%w, v2 header too long", ErrInvalidHeader)
+	}
+	b, err = r.Peek(l)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := ParseV2(b)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = r.Discard(l)
+	return h, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, fmt.Errorf("%w, v1 header is not terminated", ErrInvalidHeader)
+	}
+	return parseV1(s)
+}
+
+// parseV1 parses a v1 header line without the trailing CRLF.
+func parseV1(s string) (*Header, error) {
+	f := strings.Split(s, " ")
+	if len(f) < 2 || f[0] != "PROXY" {
+		return nil, ErrInvalidHeader
+	}
+	h := &Header{Version: 1}
+	switch f[1] {
+	case "UNKNOWN":
+		h.Local = true
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w, unknown v1 protocol %s", ErrInvalidHeader, f[1])
+	}
+	if len(f) != 6 {
+		return nil, ErrInvalidHeader
+	}
+	src, err := parseV1Addr(f[2], f[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(f[3], f[5])
+	if err != nil {
+		return nil, err
+	}
+	if src.Addr().Is4() != (f[1] == "TCP4") || dst.Addr().Is4() != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("%w, address family mismatch", ErrInvalidHeader)
+	}
+	h.Src, h.Dst = src, dst
+	return h, nil
+}
+
+func parseV1Addr(ip, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w, %w", ErrInvalidHeader, err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w, %w", ErrInvalidHeader, err)
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// ParseV2 parses a v2 header at the beginning of b. n is the length of
+// the header. This is useful for datagrams, which only support v2.
+// If b does not start with a v2 signature, ErrNoHeader will be returned.
+func ParseV2(b []byte) (h *Header, n int, err error) {
+	if len(b) < v2HeaderLen || !bytes.Equal(b[:len(v2Sig)], v2Sig) {
+		return nil, 0, ErrNoHeader
+	}
+	verCmd, fam := b[12], b[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, fmt.Errorf("%w, unsupported version %d", ErrInvalidHeader, verCmd>>4)
+	}
+	n = v2HeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return nil, 0, fmt.Errorf("%w, header is truncated", ErrInvalidHeader)
+	}
+	addrs := b[v2HeaderLen:n]
+
+	h = &Header{Version: 2}
+	switch verCmd & 0xf {
+	case v2CmdLocal:
+		h.Local = true
+		return h, n, nil
+	case v2CmdProxy:
+	default:
+		return nil, 0, fmt.Errorf("%w, unknown command %d", ErrInvalidHeader, verCmd&0xf)
+	}
+
+	// The transport protocol (fam & 0xf) does not matter here.
+	switch fam >> 4 {
+	case v2FamInet:
+		if len(addrs) < 12 {
+			return nil, 0, fmt.Errorf("%w, short ipv4 addresses", ErrInvalidHeader)
+		}
+		h.Src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[0:4])), binary.BigEndian.Uint16(addrs[8:10]))
+		h.Dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addrs[4:8])), binary.BigEndian.Uint16(addrs[10:12]))
+	case v2FamInet6:
+		if len(addrs) < 36 {
+			return nil, 0, fmt.Errorf("%w, short ipv6 addresses", ErrInvalidHeader)
+		}
+		h.Src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[0:16])).Unmap(), binary.BigEndian.Uint16(addrs[32:34]))
+		h.Dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addrs[16:32])).Unmap(), binary.BigEndian.Uint16(addrs[34:36]))
+	default:
+		// AF_UNSPEC and AF_UNIX. Treat them as local.
+		h.Local = true
+	}
+	return h, n, nil
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func v2Header(cmd, fam byte, src, dst netip.AddrPort, tlv []byte) []byte {
+	b := append([]byte{}, v2Sig...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	if src.IsValid() {
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		b = binary.BigEndian.AppendUint16(b, dst.Port())
+	}
+	b = append(b, tlv...)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(b)-v2HeaderLen))
+	return b
+}
+
+func Test_ReadHeader(t *testing.T) {
+	src4 := netip.MustParseAddrPort("1.2.3.4:5678")
+	dst4 := netip.MustParseAddrPort("5.6.7.8:53")
+	src6 := netip.MustParseAddrPort("[2001:db8::1]:5678")
+	dst6 := netip.MustParseAddrPort("[2001:db8::2]:53")
+	payload := "payload"
+
+	tests := []struct {
+		name    string
+		in      []byte
+		want    *Header
+		wantErr error
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 5678 53\r\n"), &Header{Version: 1, Src: src4, Dst: dst4}, nil},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 5678 53\r\n"), &Header{Version: 1, Src: src6, Dst: dst6}, nil},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), &Header{Version: 1, Local: true}, nil},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 5678 53\r\n"), nil, ErrInvalidHeader},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 70000 53\r\n"), nil, ErrInvalidHeader},
+		{"v1 not terminated", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 5678 53\n"), nil, ErrInvalidHeader},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("A", 200)), nil, ErrInvalidHeader},
+		{"v2 tcp4", v2Header(v2CmdProxy, 0x11, src4, dst4, nil), &Header{Version: 2, Src: src4, Dst: dst4}, nil},
+		{"v2 tcp6 with tlv", v2Header(v2CmdProxy, 0x21, src6, dst6, []byte{0x04, 0, 1, 0}), &Header{Version: 2, Src: src6, Dst: dst6}, nil},
+		{"v2 local", v2Header(v2CmdLocal, 0x00, netip.AddrPort{}, netip.AddrPort{}, nil), &Header{Version: 2, Local: true}, nil},
+		{"v2 short addrs", v2Header(v2CmdProxy, 0x21, netip.AddrPort{}, netip.AddrPort{}, []byte{1, 2, 3}), nil, ErrInvalidHeader},
+		{"no header", []byte("\x00\x1dsome dns query....."), nil, ErrNoHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.in), strings.NewReader(payload)))
+			got, err := ReadHeader(r)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ReadHeader() err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Fatalf("ReadHeader() = %+v, want %+v", got, tt.want)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != payload {
+				t.Fatalf("remaining data = %q, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func Test_ParseV2(t *testing.T) {
+	src := netip.MustParseAddrPort("1.2.3.4:5678")
+	dst := netip.MustParseAddrPort("5.6.7.8:53")
+	h := v2Header(v2CmdProxy, 0x12, src, dst, nil)
+	b := append(h, "query"...)
+	got, n, err := ParseV2(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Src != src || got.Dst != dst || string(b[n:]) != "query" {
+		t.Fatalf("unexpected result %+v, %q", got, b[n:])
+	}
+
+	if _, _, err := ParseV2(h[:len(h)-1]); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("want ErrInvalidHeader for truncated header, got %v", err)
+	}
+	if _, _, err := ParseV2([]byte("query")); !errors.Is(err, ErrNoHeader) {
+		t.Fatalf("want ErrNoHeader, got %v", err)
+	}
+}
+
+func Test_Listener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	dial := func(header string) net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Write([]byte(header + "hello, this is a payload")); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	readAll := func(c net.Conn) string {
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// Trusted.
+	pl := NewListener(l, ListenerOpts{Trusted: PrefixesTrusted([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})})
+	cc := dial("PROXY TCP4 1.2.3.4 5.6.7.8 5678 53\r\n")
+	defer cc.Close()
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != "1.2.3.4:5678" {
+		t.Fatalf("RemoteAddr() = %s", got)
+	}
+	if got := readAll(c); got != "hello" {
+		t.Fatalf("read %q", got)
+	}
+	c.Close()
+
+	// Untrusted.
+	pl = NewListener(l, ListenerOpts{Trusted: PrefixesTrusted([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})})
+	cc = dial("")
+	defer cc.Close()
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RemoteAddr().String(); got != cc.LocalAddr().String() {
+		t.Fatalf("RemoteAddr() = %s, want %s", got, cc.LocalAddr())
+	}
+	if got := readAll(c); got != "hello" {
+		t.Fatalf("read %q", got)
+	}
+	c.Close()
+
+	// Trusted but no header.
+	pl = NewListener(l, ListenerOpts{})
+	cc = dial("")
+	defer cc.Close()
+	c, err = pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 5)); !errors.Is(err, ErrNoHeader) {
+		t.Fatalf("want ErrNoHeader, got %v", err)
+	}
+}
+
+func TestPrefixesTrusted(t *testing.T) {
+	addr := netip.MustParseAddr("::ffff:127.0.0.1")
+	if PrefixesTrusted(nil)(addr) {
+		t.Fatal("empty prefixes should trust no address")
+	}
+	if !PrefixesTrusted([]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")})(addr) {
+		t.Fatal("mapped address should be trusted by 0.0.0.0/0")
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import "github.com/miekg/dns"
+
+// SetEDE attaches an Extended DNS Error (RFC 8914) to RespOpt.
+// If RespOpt already has an EDE with the same info code, its extra text
+// will be replaced. It is a noop if the client does not support EDNS0.
+func (ctx *Context) SetEDE(code uint16, text string) {
+	opt := ctx.respOpt
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == code {
+			ede.ExtraText = text
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// HasEDE reports whether RespOpt has an Extended DNS Error.
+func (ctx *Context) HasEDE() bool {
+	if ctx.respOpt == nil {
+		return false
+	}
+	for _, o := range ctx.respOpt.Option {
+		if o.Option() == dns.EDNS0EDE {
+			return true
+		}
+	}
+	return false
+}
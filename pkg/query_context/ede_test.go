@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestContext_SetEDE(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	ctx := NewContext(q)
+	ctx.SetEDE(dns.ExtendedErrorCodeBlocked, "") // noop, client has no EDNS0.
+	if ctx.HasEDE() {
+		t.Fatal("EDE should not be set if client does not support EDNS0")
+	}
+
+	q = new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	ctx = NewContext(q)
+	ctx.SetEDE(dns.ExtendedErrorCodeBlocked, "a")
+	ctx.SetEDE(dns.ExtendedErrorCodeBlocked, "b")
+	ctx.SetEDE(dns.ExtendedErrorCodeStaleAnswer, "")
+	if !ctx.HasEDE() {
+		t.Fatal("EDE is not set")
+	}
+	opts := ctx.RespOpt().Option
+	if len(opts) != 2 {
+		t.Fatalf("want 2 EDEs, got %d", len(opts))
+	}
+	if ede := opts[0].(*dns.EDNS0_EDE); ede.InfoCode != dns.ExtendedErrorCodeBlocked || ede.ExtraText != "b" {
+		t.Fatalf("unexpected EDE %v", ede)
+	}
+}
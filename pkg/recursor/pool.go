@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"go.uber.org/zap"
+)
+
+const (
+	poolIdleTimeout     = time.Minute * 2
+	poolCleanerInterval = time.Minute
+)
+
+// nsPool keeps upstreams of name servers. Upstreams that are not used
+// for poolIdleTimeout will be closed.
+type nsPool struct {
+	logger *zap.Logger
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+
+	m  sync.Mutex
+	us map[netip.AddrPort]*pooledUpstream
+}
+
+type pooledUpstream struct {
+	u        upstream.Upstream
+	lastUsed time.Time
+}
+
+func newNsPool(logger *zap.Logger) *nsPool {
+	p := &nsPool{
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+		us:          make(map[netip.AddrPort]*pooledUpstream),
+	}
+	go p.cleanerLoop()
+	return p
+}
+
+func (p *nsPool) get(addr netip.AddrPort) (upstream.Upstream, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	pu := p.us[addr]
+	if pu == nil {
+		// udp upstream falls back to tcp if the response is truncated.
+		u, err := upstream.NewUpstream("udp://"+addr.String(), upstream.Opt{Logger: p.logger})
+		if err != nil {
+			return nil, err
+		}
+		pu = &pooledUpstream{u: u}
+		p.us[addr] = pu
+	}
+	pu.lastUsed = time.Now()
+	return pu.u, nil
+}
+
+func (p *nsPool) cleanerLoop() {
+	ticker := time.NewTicker(poolCleanerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeNotify:
+			return
+		case now := <-ticker.C:
+			p.m.Lock()
+			for addr, pu := range p.us {
+				if now.Sub(pu.lastUsed) > poolIdleTimeout {
+					_ = pu.u.Close()
+					delete(p.us, addr)
+				}
+			}
+			p.m.Unlock()
+		}
+	}
+}
+
+func (p *nsPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeNotify)
+		p.m.Lock()
+		defer p.m.Unlock()
+		for addr, pu := range p.us {
+			_ = pu.u.Close()
+			delete(p.us, addr)
+		}
+	})
+	return nil
+}
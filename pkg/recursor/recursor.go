@@ -0,0 +1,553 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultQueryTimeout = time.Second * 2
+
+	minCacheTTL = time.Second * 5
+	maxCacheTTL = time.Hour * 24
+
+	maxDepth      = 8  // Nesting of glueless name server resolution.
+	maxIterations = 32 // Referrals and minimised queries of one lookup.
+	maxCNAMEs     = 10
+	// RFC 9156 2.3 MAX_MINIMISE_COUNT.
+	maxMinimiseCount = 10
+	// Max name servers to be tried for one query.
+	maxServerAttempts = 8
+	// Max name servers without glue to be resolved for one delegation.
+	maxGluelessNS = 4
+	// Max queries to name servers of one Resolve call. Lookups of glueless
+	// name servers also count, so delegation loops can't fan out.
+	maxQueries = 64
+
+	edns0UdpSize = 1232
+)
+
+// rootHints are IPv4 addresses of the root servers.
+var rootHints = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+var (
+	errTooDeep           = errors.New("too many nested name server lookups")
+	errTooManyIterations = errors.New("too many referrals")
+	errTooManyQueries    = errors.New("too many queries")
+	errTooManyCNAMEs     = errors.New("cname chain is too long")
+	errCNAMELoop         = errors.New("cname loop")
+	errQuestionMismatch  = errors.New("response question mismatched")
+)
+
+type Opts struct {
+	// RootHints are addresses of the root servers. Default is the IANA
+	// root servers.
+	RootHints []netip.AddrPort
+
+	// Port is the port of name servers learnt from referrals.
+	// Default is 53.
+	Port uint16
+
+	// QueryTimeout is the timeout of a query to one name server.
+	// Default is 2s.
+	QueryTimeout time.Duration
+
+	// DisableQNAMEMinimisation disables QNAME minimisation (RFC 9156).
+	DisableQNAMEMinimisation bool
+
+	// Disable0x20 disables the random case of query names.
+	Disable0x20 bool
+
+	// CacheSize is the size of the delegation cache.
+	CacheSize int
+
+	Logger *zap.Logger
+}
+
+// Resolver is an iterative resolver. It resolves names from the root
+// servers and caches delegations.
+// It is safe for concurrent use.
+type Resolver struct {
+	opts        Opts
+	root        *delegation
+	delegations *cache.Cache[key, *delegation]
+	pool        *nsPool
+}
+
+type key string
+
+var seed = maphash.MakeSeed()
+
+func (k key) Sum() uint64 {
+	return maphash.String(seed, string(k))
+}
+
+// delegation is a zone and its name servers.
+type delegation struct {
+	zone   string
+	ns     []string
+	addrs  []netip.AddrPort // May be empty if there is no glue.
+	expire time.Time
+}
+
+func NewResolver(opts Opts) *Resolver {
+	if opts.Port == 0 {
+		opts.Port = 53
+	}
+	if opts.QueryTimeout <= 0 {
+		opts.QueryTimeout = defaultQueryTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	roots := opts.RootHints
+	if len(roots) == 0 {
+		for _, s := range rootHints {
+			roots = append(roots, netip.AddrPortFrom(netip.MustParseAddr(s), 53))
+		}
+	}
+	return &Resolver{
+		opts:        opts,
+		root:        &delegation{zone: ".", addrs: roots},
+		delegations: cache.New[key, *delegation](cache.Opts{Size: opts.CacheSize}),
+		pool:        newNsPool(opts.Logger),
+	}
+}
+
+func (r *Resolver) Close() error {
+	_ = r.delegations.Close()
+	return r.pool.Close()
+}
+
+// Resolve resolves name and qtype. The returned msg contains the rcode,
+// the answer (including the cname chain) and the authority section.
+func (r *Resolver) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	b := &budget{n: maxQueries}
+	return r.resolve(ctx, dns.CanonicalName(name), qtype, 0, b)
+}
+
+// budget is the number of queries that a Resolve call can still send.
+type budget struct {
+	n int
+}
+
+func (b *budget) take() error {
+	if b.n <= 0 {
+		return errTooManyQueries
+	}
+	b.n--
+	return nil
+}
+
+func (r *Resolver) resolve(ctx context.Context, name string, qtype uint16, depth int, b *budget) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	var chain []dns.RR
+	visited := make(map[string]struct{})
+	for i := 0; i <= maxCNAMEs; i++ {
+		if _, dup := visited[name]; dup {
+			return nil, errCNAMELoop
+		}
+		visited[name] = struct{}{}
+
+		resp, zone, err := r.lookup(ctx, name, qtype, depth, b)
+		if err != nil {
+			return nil, err
+		}
+		target, answer, done := followCNAME(inZone(resp.Answer, zone), name, qtype)
+		chain = append(chain, answer...)
+		if done || resp.Rcode != dns.RcodeSuccess {
+			m := new(dns.Msg)
+			m.SetQuestion(name, qtype)
+			m.Rcode = resp.Rcode
+			m.Answer = chain
+			m.Ns = inZone(resp.Ns, zone)
+			return m, nil
+		}
+		name = target
+	}
+	return nil, errTooManyCNAMEs
+}
+
+// lookup queries name and qtype from the closest known delegation.
+// It returns the final response and the zone that answers it.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16, depth int, b *budget) (*dns.Msg, string, error) {
+	d := r.closestDelegation(name)
+	qmin := !r.opts.DisableQNAMEMinimisation
+	probeLabels := 0
+	minimised := 0
+	for i := 0; i < maxIterations; i++ {
+		qname, qt := name, qtype
+		if qmin && minimised < maxMinimiseCount {
+			n := max(probeLabels, dns.CountLabel(d.zone)+1)
+			if n < dns.CountLabel(name) {
+				// RFC 9156 3. A is used as the QTYPE of minimised queries.
+				qname, qt = trimLabels(name, n), dns.TypeA
+				probeLabels = n
+				minimised++
+			}
+		}
+
+		resp, child, err := r.queryServers(ctx, d, qname, qt, depth, b)
+		if err != nil {
+			if qname != name && !errors.Is(err, errTooManyQueries) {
+				qmin = false // RFC 9156 3. Fall back to the full name.
+				continue
+			}
+			return nil, "", err
+		}
+		if child != nil {
+			d = child
+			r.storeDelegation(child)
+			continue
+		}
+		if qname != name {
+			if resp.Rcode != dns.RcodeSuccess {
+				// NXDOMAIN of the minimised name implies NXDOMAIN of name
+				// (RFC 8020). Send the full name to get the proper response.
+				qmin = false
+			} else {
+				probeLabels++
+			}
+			continue
+		}
+		return resp, d.zone, nil
+	}
+	return nil, "", errTooManyIterations
+}
+
+// queryServers sends the query to name servers of d until one of them
+// answers. If the response is a referral, child is the new delegation.
+func (r *Resolver) queryServers(ctx context.Context, d *delegation, qname string, qtype uint16, depth int, b *budget) (resp *dns.Msg, child *delegation, err error) {
+	addrs := d.addrs
+	if len(addrs) == 0 {
+		d, err = r.resolveNSAddrs(ctx, d, depth, b)
+		if err != nil {
+			return nil, nil, err
+		}
+		addrs = d.addrs
+	}
+
+	start := rand.IntN(len(addrs))
+	var lastErr error
+	for i := 0; i < len(addrs) && i < maxServerAttempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if err := b.take(); err != nil {
+			return nil, nil, err
+		}
+		addr := addrs[(start+i)%len(addrs)]
+		resp, err := r.exchange(ctx, addr, qname, qtype)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", addr, err)
+			continue
+		}
+		if child := r.referral(resp, d.zone, qname); child != nil {
+			return resp, child, nil
+		}
+		switch {
+		case resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError:
+			lastErr = fmt.Errorf("%s returned %s", addr, dns.RcodeToString[resp.Rcode])
+		case !resp.Authoritative:
+			lastErr = fmt.Errorf("%s is lame for %s", addr, d.zone)
+		default:
+			return resp, nil, nil
+		}
+		r.opts.Logger.Debug("name server failed", zap.String("zone", d.zone), zap.Error(lastErr))
+	}
+	return nil, nil, fmt.Errorf("all name servers of %s failed, last err: %w", d.zone, lastErr)
+}
+
+// resolveNSAddrs resolves the addresses of name servers of d that has
+// no glue. At most maxGluelessNS name servers will be resolved.
+func (r *Resolver) resolveNSAddrs(ctx context.Context, d *delegation, depth int, b *budget) (*delegation, error) {
+	nd := *d
+	var lastErr error
+	for i, ns := range d.ns {
+		if i >= maxGluelessNS {
+			break
+		}
+		if err := b.take(); err != nil {
+			return nil, err
+		}
+		m, err := r.resolve(ctx, ns, dns.TypeA, depth+1, b)
+		if errors.Is(err, errTooManyQueries) {
+			return nil, err
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				if addr, ok := netip.AddrFromSlice(a.A); ok {
+					nd.addrs = append(nd.addrs, netip.AddrPortFrom(addr.Unmap(), r.opts.Port))
+				}
+				if e := expireOf(a.Hdr.Ttl); e.Before(nd.expire) {
+					nd.expire = e
+				}
+			}
+		}
+		if len(nd.addrs) > 0 {
+			break
+		}
+	}
+	if len(nd.addrs) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no address record")
+		}
+		return nil, fmt.Errorf("failed to resolve name servers of %s, %w", d.zone, lastErr)
+	}
+	r.storeDelegation(&nd)
+	return &nd, nil
+}
+
+// referral returns the delegation in resp if it is a referral from zone
+// to a child zone that encloses qname.
+func (r *Resolver) referral(resp *dns.Msg, zone, qname string) *delegation {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil
+	}
+	d := &delegation{expire: time.Now().Add(maxCacheTTL)}
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue // Not a referral to a child zone.
+		}
+		if len(d.zone) == 0 {
+			d.zone = owner
+		}
+		if owner != d.zone {
+			continue
+		}
+		d.ns = append(d.ns, dns.CanonicalName(ns.Ns))
+		if e := expireOf(ns.Hdr.Ttl); e.Before(d.expire) {
+			d.expire = e
+		}
+	}
+	if len(d.ns) == 0 {
+		return nil
+	}
+
+	// Only glue within zone is accepted.
+	for _, rr := range resp.Extra {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) || !containsName(d.ns, owner) {
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			d.addrs = append(d.addrs, netip.AddrPortFrom(addr.Unmap(), r.opts.Port))
+			if e := expireOf(rr.Header().Ttl); e.Before(d.expire) {
+				d.expire = e
+			}
+		}
+	}
+	return d
+}
+
+// exchange sends a non-recursive query to addr.
+func (r *Resolver) exchange(ctx context.Context, addr netip.AddrPort, qname string, qtype uint16) (*dns.Msg, error) {
+	u, err := r.pool.get(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.opts.Disable0x20 {
+		qname = randomCase(qname)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(edns0UdpSize, false)
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.opts.QueryTimeout)
+	defer cancel()
+	rb, err := u.ExchangeContext(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(rb)
+	resp := new(dns.Msg)
+	if err := resp.Unpack(*rb); err != nil {
+		return nil, fmt.Errorf("invalid response, %w", err)
+	}
+
+	// The case of the question must be echoed as is (0x20).
+	if len(resp.Question) != 1 || resp.Question[0].Name != qname || resp.Question[0].Qtype != qtype {
+		return nil, errQuestionMismatch
+	}
+	return resp, nil
+}
+
+// closestDelegation returns the cached delegation that is closest to name.
+func (r *Resolver) closestDelegation(name string) *delegation {
+	for n := name; n != "."; n = parentName(n) {
+		if d, _, ok := r.delegations.Get(key(n)); ok {
+			return d
+		}
+	}
+	return r.root
+}
+
+func (r *Resolver) storeDelegation(d *delegation) {
+	if d.zone == "." {
+		return
+	}
+	r.delegations.Store(key(d.zone), d, d.expire)
+}
+
+// followCNAME follows the cname chain of name in answer. It returns
+// records of the chain. If done is false, target is the name that still
+// needs to be resolved.
+func followCNAME(answer []dns.RR, name string, qtype uint16) (target string, chain []dns.RR, done bool) {
+	followed := false
+	for i := 0; i <= maxCNAMEs; i++ {
+		var found bool
+		var cname *dns.CNAME
+		for _, rr := range answer {
+			h := rr.Header()
+			if !equalName(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == qtype || qtype == dns.TypeANY {
+				chain = append(chain, rr)
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok && cname == nil {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			return name, chain, found || !followed
+		}
+		chain = append(chain, cname)
+		name = dns.CanonicalName(cname.Target)
+		followed = true
+	}
+	return name, chain, false
+}
+
+// inZone returns records in rrs that are within zone.
+func inZone(rrs []dns.RR, zone string) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT || !dns.IsSubDomain(zone, rr.Header().Name) {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// randomCase randomizes the case of letters in s (draft-vixie-dnsext-dns0x20).
+func randomCase(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && rand.IntN(2) == 0 {
+			b[i] = c ^ 0x20
+		}
+	}
+	return string(b)
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if equalName(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalName(a, b string) bool {
+	return dns.CanonicalName(a) == dns.CanonicalName(b)
+}
+
+// parentName returns the parent of name. Parent of the root is the root.
+func parentName(name string) string {
+	idx := dns.Split(name)
+	if len(idx) < 2 {
+		return "."
+	}
+	return name[idx[1]:]
+}
+
+// trimLabels returns the last n labels of name.
+func trimLabels(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+	if n <= 0 {
+		return "."
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+func expireOf(ttl uint32) time.Time {
+	d := min(max(time.Duration(ttl)*time.Second, minCacheTTL), maxCacheTTL)
+	return time.Now().Add(d)
+}
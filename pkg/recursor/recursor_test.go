@@ -0,0 +1,301 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// authServer is an authoritative server of zones.
+type authServer struct {
+	zones map[string][]dns.RR
+	lame  bool
+
+	m    sync.Mutex
+	seen []dns.Question
+}
+
+func (s *authServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	s.m.Lock()
+	s.seen = append(s.seen, q)
+	s.m.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	name := dns.CanonicalName(q.Name)
+	zone, found := "", false
+	for z := range s.zones {
+		if dns.IsSubDomain(z, name) && (!found || dns.CountLabel(z) > dns.CountLabel(zone)) {
+			zone, found = z, true
+		}
+	}
+	if s.lame || !found {
+		resp.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(resp)
+		return
+	}
+	rrs := s.zones[zone]
+
+	// Referral
+	for _, rr := range rrs {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeNS && owner != zone && dns.IsSubDomain(owner, name) {
+			for _, rr := range rrs {
+				if ns, ok := rr.(*dns.NS); ok && equalName(ns.Hdr.Name, owner) {
+					resp.Ns = append(resp.Ns, ns)
+					for _, glue := range rrs {
+						if glue.Header().Rrtype == dns.TypeA && equalName(glue.Header().Name, ns.Ns) {
+							resp.Extra = append(resp.Extra, glue)
+						}
+					}
+				}
+			}
+			_ = w.WriteMsg(resp)
+			return
+		}
+	}
+
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range rrs {
+		h := rr.Header()
+		if dns.IsSubDomain(name, h.Name) {
+			exists = true
+		}
+		if equalName(h.Name, name) && (h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				resp.Ns = append(resp.Ns, rr)
+			}
+		}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (s *authServer) queries() []dns.Question {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]dns.Question(nil), s.seen...)
+}
+
+func mustRRs(t *testing.T, ss ...string) []dns.RR {
+	t.Helper()
+	var rrs []dns.RR
+	for _, s := range ss {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// startAuthServer starts s on ip:port. If port is 0, a random port is used.
+func startAuthServer(t *testing.T, ip string, port uint16, s *authServer) uint16 {
+	t.Helper()
+	c, err := net.ListenPacket("udp", netip.AddrPortFrom(netip.MustParseAddr(ip), port).String())
+	if err != nil {
+		t.Skipf("failed to listen on %s, %s", ip, err)
+	}
+	server := &dns.Server{PacketConn: c, Handler: s}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return uint16(c.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func Test_Resolver(t *testing.T) {
+	root := &authServer{zones: map[string][]dns.RR{
+		".": mustRRs(t,
+			". 3600 IN SOA a.root. admin.root. 1 3600 600 86400 60",
+			"test. 3600 IN NS ns.test.",
+			"ns.test. 3600 IN A 127.0.0.2",
+		),
+	}}
+	tld := &authServer{zones: map[string][]dns.RR{
+		"test.": mustRRs(t,
+			"test. 3600 IN SOA ns.test. admin.test. 1 3600 600 86400 60",
+			"test. 3600 IN NS ns.test.",
+			"ns.test. 3600 IN A 127.0.0.2",
+			"a.test. 300 IN A 192.0.2.1",
+			"sub.test. 3600 IN NS ns.sub.test.",
+			"ns.sub.test. 3600 IN A 127.0.0.3",
+			// Glueless. ns.sub.test. is in another zone.
+			"other.test. 3600 IN NS ns.sub.test.",
+			// The first server is lame.
+			"lame.test. 3600 IN NS ns1.lame.test.",
+			"lame.test. 3600 IN NS ns2.lame.test.",
+			"ns1.lame.test. 3600 IN A 127.0.0.4",
+			"ns2.lame.test. 3600 IN A 127.0.0.3",
+		),
+	}}
+	leaf := &authServer{zones: map[string][]dns.RR{
+		"sub.test.": mustRRs(t,
+			"sub.test. 3600 IN SOA ns.sub.test. admin.sub.test. 1 3600 600 86400 60",
+			"ns.sub.test. 3600 IN A 127.0.0.3",
+			"www.sub.test. 300 IN CNAME alias.other.test.",
+			"deep.x.y.z.sub.test. 300 IN A 192.0.2.3",
+		),
+		"other.test.": mustRRs(t,
+			"other.test. 3600 IN SOA ns.sub.test. admin.other.test. 1 3600 600 86400 60",
+			"alias.other.test. 300 IN A 192.0.2.2",
+		),
+		"lame.test.": mustRRs(t,
+			"lame.test. 3600 IN SOA ns2.lame.test. admin.lame.test. 1 3600 600 86400 60",
+			"www.lame.test. 300 IN A 192.0.2.4",
+		),
+	}}
+	lame := &authServer{lame: true}
+
+	port := startAuthServer(t, "127.0.0.1", 0, root)
+	startAuthServer(t, "127.0.0.2", port, tld)
+	startAuthServer(t, "127.0.0.3", port, leaf)
+	startAuthServer(t, "127.0.0.4", port, lame)
+
+	r := NewResolver(Opts{
+		RootHints:    []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)},
+		Port:         port,
+		QueryTimeout: time.Second,
+	})
+	defer r.Close()
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantAns   []string // Rdata of the answer, in order.
+	}{
+		{"simple", "a.test.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{"case insensitive", "A.Test.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{"nodata", "a.test.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		{"nxdomain", "nx.test.", dns.TypeA, dns.RcodeNameError, nil},
+		{"cname chain with glueless ns", "www.sub.test.", dns.TypeA, dns.RcodeSuccess, []string{"alias.other.test.", "192.0.2.2"}},
+		{"qname minimisation", "deep.x.y.z.sub.test.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.3"}},
+		{"lame delegation", "www.lame.test.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			m, err := r.Resolve(ctx, tt.qname, tt.qtype)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			var ans []string
+			for _, rr := range m.Answer {
+				s := rr.String()
+				ans = append(ans, s[strings.LastIndexByte(s, '\t')+1:])
+			}
+			if strings.Join(ans, ",") != strings.Join(tt.wantAns, ",") {
+				t.Fatalf("answer = %v, want %v", ans, tt.wantAns)
+			}
+		})
+	}
+
+	// Root and tld servers should only see minimised names.
+	for _, q := range append(root.queries(), tld.queries()...) {
+		if n := dns.CountLabel(q.Name); n > 2 {
+			t.Errorf("query %s is not minimised", q.Name)
+		}
+	}
+	// Names should be sent in random case.
+	mixed := false
+	for _, q := range leaf.queries() {
+		if q.Name != strings.ToLower(q.Name) {
+			mixed = true
+		}
+	}
+	if !mixed {
+		t.Error("0x20 is not applied")
+	}
+}
+
+func Test_Resolver_limits(t *testing.T) {
+	root := &authServer{zones: map[string][]dns.RR{
+		".": mustRRs(t,
+			". 3600 IN SOA a.root. admin.root. 1 3600 600 86400 60",
+			// Glueless name servers that don't exist.
+			"many.test. 3600 IN NS ns1.nx.test.",
+			"many.test. 3600 IN NS ns2.nx.test.",
+			"many.test. 3600 IN NS ns3.nx.test.",
+			"many.test. 3600 IN NS ns4.nx.test.",
+			"many.test. 3600 IN NS ns5.nx.test.",
+			"many.test. 3600 IN NS ns6.nx.test.",
+			// Glueless delegation loop.
+			"a.test. 3600 IN NS ns1.b.test.",
+			"a.test. 3600 IN NS ns2.b.test.",
+			"a.test. 3600 IN NS ns3.b.test.",
+			"b.test. 3600 IN NS ns1.a.test.",
+			"b.test. 3600 IN NS ns2.a.test.",
+			"b.test. 3600 IN NS ns3.a.test.",
+		),
+	}}
+	port := startAuthServer(t, "127.0.0.1", 0, root)
+	r := NewResolver(Opts{
+		RootHints:    []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)},
+		Port:         port,
+		QueryTimeout: time.Second,
+	})
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := r.Resolve(ctx, "www.many.test.", dns.TypeA); err == nil {
+		t.Fatal("want err for name servers without address")
+	}
+	resolved := make(map[string]struct{})
+	for _, q := range root.queries() {
+		if name := strings.ToLower(q.Name); strings.HasSuffix(name, ".nx.test.") {
+			resolved[name] = struct{}{}
+		}
+	}
+	if len(resolved) != maxGluelessNS {
+		t.Fatalf("want %d glueless name servers resolved, got %v", maxGluelessNS, resolved)
+	}
+
+	before := len(root.queries())
+	if _, err := r.Resolve(ctx, "www.a.test.", dns.TypeA); !errors.Is(err, errTooManyQueries) {
+		t.Fatalf("want errTooManyQueries, got %v", err)
+	}
+	if n := len(root.queries()) - before; n > maxQueries {
+		t.Fatalf("%d queries sent, want at most %d", n, maxQueries)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultCertCheckInterval = time.Minute
+
+// CertFile is a pair of PEM encoded certificate and key files.
+type CertFile struct {
+	Cert string
+	Key  string
+}
+
+type CertStoreOpts struct {
+	// CheckInterval is the interval of checking cert file changes.
+	// Default is 1 minute. Negative value disables reloading.
+	CheckInterval time.Duration
+
+	// Nil logger == nop
+	Logger *zap.Logger
+}
+
+// CertStore loads certificates from files and reloads them when the files
+// are changed. It selects the certificate by the SNI of the client, so one
+// listener can serve multiple names.
+// Use GetCertificate as tls.Config.GetCertificate.
+type CertStore struct {
+	files  []CertFile
+	logger *zap.Logger
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes []time.Time
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewCertStore loads certs from files. files must not be empty.
+func NewCertStore(files []CertFile, opts CertStoreOpts) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no cert file")
+	}
+	s := &CertStore{
+		files:       files,
+		logger:      opts.Logger,
+		certs:       make([]*tls.Certificate, len(files)),
+		modTimes:    make([]time.Time, len(files)),
+		closeNotify: make(chan struct{}),
+	}
+	if s.logger == nil {
+		s.logger = nopLogger
+	}
+	for i, f := range files {
+		c, mt, err := loadCertFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cert %s, %w", f.Cert, err)
+		}
+		s.certs[i], s.modTimes[i] = c, mt
+	}
+
+	interval := opts.CheckInterval
+	if interval == 0 {
+		interval = defaultCertCheckInterval
+	}
+	if interval > 0 {
+		go s.reloadLoop(interval)
+	}
+	return s, nil
+}
+
+func loadCertFile(f CertFile) (*tls.Certificate, time.Time, error) {
+	mt, err := certFileModTime(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return &c, mt, nil
+}
+
+// certFileModTime returns the latest mod time of the cert and key file.
+func certFileModTime(f CertFile) (time.Time, error) {
+	var t time.Time
+	for _, fn := range [...]string{f.Cert, f.Key} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if mt := fi.ModTime(); mt.After(t) {
+			t = mt
+		}
+	}
+	return t, nil
+}
+
+func (s *CertStore) reloadLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Reload()
+		case <-s.closeNotify:
+			return
+		}
+	}
+}
+
+// Reload reloads certs whose files were changed. If a cert fails to
+// load, the old one will be kept.
+func (s *CertStore) Reload() {
+	for i, f := range s.files {
+		mt, err := certFileModTime(f)
+		if err != nil {
+			s.logger.Warn("failed to stat cert file", zap.String("cert", f.Cert), zap.Error(err))
+			continue
+		}
+		s.mu.RLock()
+		changed := !mt.Equal(s.modTimes[i])
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		c, mt, err := loadCertFile(f)
+		if err != nil {
+			// Cert and key may be not both updated yet. Retry next time.
+			s.logger.Warn("failed to reload cert", zap.String("cert", f.Cert), zap.Error(err))
+			continue
+		}
+		s.mu.Lock()
+		s.certs[i], s.modTimes[i] = c, mt
+		s.mu.Unlock()
+		s.logger.Info("cert reloaded", zap.String("cert", f.Cert))
+	}
+}
+
+// GetCertificate selects the certificate that supports the client hello,
+// the same way as tls.Config does with tls.Config.Certificates.
+// If no cert matches, the first one will be returned.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certs) == 1 {
+		return s.certs[0], nil
+	}
+	for _, c := range s.certs {
+		if hello.SupportsCertificate(c) == nil {
+			return c, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+func (s *CertStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeNotify)
+	})
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+func writeTestCert(t *testing.T, dir, name string) CertFile {
+	t.Helper()
+	c, err := utils.GenerateCertificate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := CertFile{Cert: filepath.Join(dir, name+".crt"), Key: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(f.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_CertStore(t *testing.T) {
+	dir := t.TempDir()
+	fa := writeTestCert(t, dir, "a.example")
+	fb := writeTestCert(t, dir, "b.example")
+
+	s, err := NewCertStore([]CertFile{fa, fb}, CertStoreOpts{CheckInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	getCert := func(sni string) *tls.Certificate {
+		t.Helper()
+		c, err := s.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        sni,
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if got := getCert("b.example").Leaf.DNSNames[0]; got != "b.example" {
+		t.Fatalf("want cert b.example, got %s", got)
+	}
+	if got := getCert("a.example").Leaf.DNSNames[0]; got != "a.example" {
+		t.Fatalf("want cert a.example, got %s", got)
+	}
+	if got := getCert("unknown.example").Leaf.DNSNames[0]; got != "a.example" {
+		t.Fatalf("want default cert a.example, got %s", got)
+	}
+
+	// Replace cert b and reload.
+	old := getCert("b.example").Certificate[0]
+	writeTestCert(t, dir, "b.example")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fb.Cert, future, future); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload()
+	if bytes.Equal(getCert("b.example").Certificate[0], old) {
+		t.Fatal("cert b.example was not reloaded")
+	}
+
+	// Broken files should not replace the loaded cert.
+	loaded := getCert("b.example").Certificate[0]
+	if err := os.WriteFile(fb.Key, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload()
+	if !bytes.Equal(getCert("b.example").Certificate[0], loaded) {
+		t.Fatal("cert b.example was replaced by a broken one")
+	}
+}
@@ -74,6 +74,8 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 			if ok {
 				clientAddr = ta.AddrPort().Addr()
 			}
+			tlsState := c.ConnectionState().TLS
+			clientCert := ClientCertFromConnState(&tlsState)
 
 			firstRead := true
 			for {
@@ -106,7 +108,8 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 					}
 					queryMeta := QueryMeta{
 						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
+						ServerName: tlsState.ServerName,
+						ClientCert: clientCert,
 					}
 
 					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
@@ -26,8 +26,10 @@ import (
 	"io"
 	"net/http"
 	"net/netip"
+	"slices"
 	"strings"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -41,12 +43,27 @@ type HttpHandlerOpts struct {
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
+
+	// ODoHKey enables Oblivious DoH (RFC 9230) target support. Optional.
+	ODoHKey *odoh.KeyPair
+
+	// EnableJSON enables the JSON API (application/dns-json). GET requests
+	// that have a "name" parameter will be handled as JSON API requests.
+	EnableJSON bool
+
+	// AllowedOrigins are the origins that browsers may read JSON API
+	// responses from (CORS). "*" allows all origins. If it is empty,
+	// no Access-Control-Allow-Origin header is sent.
+	AllowedOrigins []string
 }
 
 type HttpHandler struct {
 	dnsHandler  Handler
 	logger      *zap.Logger
 	srcIPHeader string
+	odohKey     *odoh.KeyPair
+	enableJSON  bool
+	origins     []string
 }
 
 var _ http.Handler = (*HttpHandler)(nil)
@@ -55,6 +72,9 @@ func NewHttpHandler(h Handler, opts HttpHandlerOpts) *HttpHandler {
 	hh := new(HttpHandler)
 	hh.dnsHandler = h
 	hh.srcIPHeader = opts.GetSrcIPFromHeader
+	hh.odohKey = opts.ODoHKey
+	hh.enableJSON = opts.EnableJSON
+	hh.origins = opts.AllowedOrigins
 	hh.logger = opts.Logger
 	if hh.logger == nil {
 		hh.logger = nopLogger
@@ -86,12 +106,35 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// read msg
-	q, err := ReadMsgFromReq(req)
-	if err != nil {
-		h.warnErr(req, "invalid request", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	// ODoH query
+	var odohCtx *odoh.ResponseContext
+	var q *dns.Msg
+	var jsonMode bool
+	var err error
+	if h.odohKey != nil && req.Method == http.MethodPost && req.Header.Get("Content-Type") == odoh.ContentType {
+		q, odohCtx, err = h.readODoHMsgFromReq(req)
+		if err != nil {
+			h.warnErr(req, "invalid odoh request", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The client addr is the proxy's addr, which is meaningless.
+		clientAddr = netip.Addr{}
+	} else if jsonMode = h.enableJSON && isJSONRequest(req); jsonMode {
+		q, err = readJSONQuery(req)
+		if err != nil {
+			h.warnErr(req, "invalid json request", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else {
+		// read msg
+		q, err = ReadMsgFromReq(req)
+		if err != nil {
+			h.warnErr(req, "invalid request", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 
 	queryMeta := QueryMeta{
@@ -102,6 +145,7 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	if tlsStat := req.TLS; tlsStat != nil {
 		queryMeta.ServerName = tlsStat.ServerName
+		queryMeta.ClientCert = ClientCertFromConnState(tlsStat)
 	}
 	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
 	if resp == nil {
@@ -109,6 +153,23 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer pool.ReleaseBuf(resp)
+	if odohCtx != nil {
+		b, err := odohCtx.EncryptResponse(*resp)
+		if err != nil {
+			h.warnErr(req, "failed to encrypt odoh response", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", odoh.ContentType)
+		if _, err := w.Write(b); err != nil {
+			h.warnErr(req, "failed to write response", err)
+		}
+		return
+	}
+	if jsonMode {
+		h.writeJSONResponse(w, req, *resp)
+		return
+	}
 	w.Header().Set("Content-Type", "application/dns-message")
 	if _, err := w.Write(*resp); err != nil {
 		h.warnErr(req, "failed to write response", err)
@@ -116,6 +177,63 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (h *HttpHandler) writeJSONResponse(w http.ResponseWriter, req *http.Request, resp []byte) {
+	r := new(dns.Msg)
+	if err := r.Unpack(resp); err != nil {
+		h.warnErr(req, "failed to unpack response", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, err := marshalJSONResponse(r)
+	if err != nil {
+		h.warnErr(req, "failed to marshal json response", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ct := jsonContentType
+	if s := req.URL.Query().Get("ct"); s == "application/x-javascript" {
+		ct = s
+	}
+	w.Header().Set("Content-Type", ct)
+	h.setAllowOrigin(w, req)
+	if _, err := w.Write(b); err != nil {
+		h.warnErr(req, "failed to write response", err)
+	}
+}
+
+// setAllowOrigin sets the Access-Control-Allow-Origin header if the origin
+// of req is allowed.
+func (h *HttpHandler) setAllowOrigin(w http.ResponseWriter, req *http.Request) {
+	if len(h.origins) == 0 {
+		return
+	}
+	if slices.Contains(h.origins, "*") {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	if origin := req.Header.Get("Origin"); len(origin) > 0 && slices.Contains(h.origins, origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+func (h *HttpHandler) readODoHMsgFromReq(req *http.Request) (*dns.Msg, *odoh.ResponseContext, error) {
+	buf := bufPool.Get()
+	defer bufPool.Release(buf)
+	if _, err := buf.ReadFrom(io.LimitReader(req.Body, dns.MaxMsgSize)); err != nil {
+		return nil, nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	b, odohCtx, err := h.odohKey.DecryptQuery(buf.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt query: %w", err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return nil, nil, fmt.Errorf("failed to unpack msg [%x], %w", b, err)
+	}
+	return m, odohCtx, nil
+}
+
 func readClientAddrFromXFF(s string) (netip.Addr, error) {
 	if i := strings.IndexRune(s, ','); i > 0 {
 		return netip.ParseAddr(s[:i])
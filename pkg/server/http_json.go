@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// This file implements the DNS-over-HTTPS JSON API that is used by
+// Google and Cloudflare.
+// See https://developers.google.com/speed/public-dns/docs/doh/json.
+
+const (
+	jsonContentType      = "application/dns-json"
+	defaultJSONEDNS0Size = 1232
+)
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonMsg struct {
+	Status           int            `json:"Status"`
+	TC               bool           `json:"TC"`
+	RD               bool           `json:"RD"`
+	RA               bool           `json:"RA"`
+	AD               bool           `json:"AD"`
+	CD               bool           `json:"CD"`
+	Question         []jsonQuestion `json:"Question"`
+	Answer           []jsonRR       `json:"Answer,omitempty"`
+	Authority        []jsonRR       `json:"Authority,omitempty"`
+	Additional       []jsonRR       `json:"Additional,omitempty"`
+	EdnsClientSubnet string         `json:"edns_client_subnet,omitempty"`
+}
+
+// isJSONRequest reports whether req is a JSON API request.
+func isJSONRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.URL.Query().Has("name")
+}
+
+// readJSONQuery builds a query msg from the parameters of a JSON API request.
+// Supported parameters: name, type, cd, do, edns_client_subnet.
+func readJSONQuery(req *http.Request) (*dns.Msg, error) {
+	params := req.URL.Query()
+	name := params.Get("name")
+	if len(name) == 0 || len(name) > 253 {
+		return nil, errors.New("invalid name")
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, errors.New("invalid name")
+	}
+
+	qtype := dns.TypeA
+	if s := params.Get("type"); len(s) > 0 {
+		if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if t, ok := dns.StringToType[strings.ToUpper(s)]; ok {
+			qtype = t
+		} else {
+			return nil, fmt.Errorf("invalid type %s", s)
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	q.CheckingDisabled = parseJSONBool(params.Get("cd"))
+
+	do := parseJSONBool(params.Get("do"))
+	var ecs *dns.EDNS0_SUBNET
+	if s := params.Get("edns_client_subnet"); len(s) > 0 {
+		var err error
+		ecs, err = parseJSONECS(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid edns_client_subnet, %w", err)
+		}
+	}
+	if do || ecs != nil {
+		q.SetEdns0(defaultJSONEDNS0Size, do)
+		if ecs != nil {
+			opt := q.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
+	}
+	return q, nil
+}
+
+func parseJSONBool(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
+
+// parseJSONECS parses "ip[/prefix]".
+func parseJSONECS(s string) (*dns.EDNS0_SUBNET, error) {
+	var prefix netip.Prefix
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefix = p
+	} else {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	prefix = prefix.Masked()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(prefix.Bits()),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+	if prefix.Addr().Is4() {
+		ecs.Family = 1
+	} else {
+		ecs.Family = 2
+	}
+	return ecs, nil
+}
+
+// marshalJSONResponse converts r to the JSON API format.
+func marshalJSONResponse(r *dns.Msg) ([]byte, error) {
+	m := jsonMsg{
+		Status: r.Rcode,
+		TC:     r.Truncated,
+		RD:     r.RecursionDesired,
+		RA:     r.RecursionAvailable,
+		AD:     r.AuthenticatedData,
+		CD:     r.CheckingDisabled,
+	}
+	for _, q := range r.Question {
+		m.Question = append(m.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	m.Answer = toJSONRRs(r.Answer)
+	m.Authority = toJSONRRs(r.Ns)
+	m.Additional = toJSONRRs(r.Extra)
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				m.EdnsClientSubnet = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+			}
+		}
+	}
+	return json.Marshal(m)
+}
+
+func toJSONRRs(rrs []dns.RR) []jsonRR {
+	var s []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		s = append(s, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return s
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type jsonTestHandler struct {
+	q *dns.Msg
+}
+
+func (h *jsonTestHandler) Handle(_ context.Context, q *dns.Msg, _ QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.q = q
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN AAAA 2001:db8::1")
+	r.Answer = append(r.Answer, rr)
+	if opt := q.IsEdns0(); opt != nil {
+		r.Extra = append(r.Extra, opt)
+	}
+	b, _ := pack(r)
+	return b
+}
+
+func Test_HttpHandler_JSON(t *testing.T) {
+	dh := new(jsonTestHandler)
+	h := NewHttpHandler(dh, HttpHandlerOpts{EnableJSON: true})
+
+	req := httptest.NewRequest("GET", "/resolve?name=example.com&type=AAAA&cd=1&do=true&edns_client_subnet=1.2.3.4/24", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("unexpected status code %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != jsonContentType {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+
+	q := dh.q
+	if q.Question[0].Name != "example.com." || q.Question[0].Qtype != dns.TypeAAAA || !q.CheckingDisabled {
+		t.Fatalf("unexpected query %s", q)
+	}
+	opt := q.IsEdns0()
+	if opt == nil || !opt.Do() || len(opt.Option) != 1 {
+		t.Fatalf("missing edns0 do bit or ecs, %s", q)
+	}
+
+	var m jsonMsg
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Status != 0 || !m.RA || !m.CD || len(m.Answer) != 1 || len(m.Additional) != 0 {
+		t.Fatalf("unexpected response %s", w.Body)
+	}
+	if a := m.Answer[0]; a.Type != dns.TypeAAAA || a.TTL != 60 || a.Data != "2001:db8::1" {
+		t.Fatalf("unexpected answer %+v", a)
+	}
+	if m.EdnsClientSubnet != "1.2.3.0/24" {
+		t.Fatalf("unexpected ecs %s", m.EdnsClientSubnet)
+	}
+
+	for _, bad := range []string{"/resolve?name=", "/resolve?name=example.com&type=BAD", "/resolve?name=example.com&edns_client_subnet=x"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", bad, nil))
+		if w.Code != 400 {
+			t.Fatalf("%s: want status 400, got %d", bad, w.Code)
+		}
+	}
+
+	// CORS is opt-in.
+	if o := w.Header().Get("Access-Control-Allow-Origin"); len(o) > 0 {
+		t.Fatalf("unexpected allowed origin %s", o)
+	}
+	h = NewHttpHandler(dh, HttpHandlerOpts{EnableJSON: true, AllowedOrigins: []string{"https://a.example"}})
+	for origin, want := range map[string]string{"https://a.example": "https://a.example", "https://b.example": "", "": ""} {
+		req := httptest.NewRequest("GET", "/resolve?name=example.com", nil)
+		if len(origin) > 0 {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Fatalf("origin %q: want allowed origin %q, got %q", origin, want, got)
+		}
+	}
+	h = NewHttpHandler(dh, HttpHandlerOpts{EnableJSON: true, AllowedOrigins: []string{"*"}})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/resolve?name=example.com", nil))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Fatalf("want allowed origin *, got %q", got)
+	}
+
+	// JSON API is disabled.
+	h = NewHttpHandler(dh, HttpHandlerOpts{})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/resolve?name=example.com", nil))
+	if w.Code != 400 {
+		t.Fatalf("want status 400, got %d", w.Code)
+	}
+}
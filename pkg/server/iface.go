@@ -26,4 +26,6 @@ type QueryMeta struct {
 	ClientAddr netip.Addr
 	ServerName string
 	UrlPath    string
+	// ClientCert is the verified client certificate (mutual TLS).
+	ClientCert *ClientCert
 }
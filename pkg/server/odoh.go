@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const odohRelayTimeout = time.Second * 5
+
+// ODoHConfigsHandler serves the ODoH configs of kp. It should be registered
+// at odoh.ConfigsPath.
+func ODoHConfigsHandler(kp *odoh.KeyPair) http.Handler {
+	b := odoh.MarshalConfigs([]odoh.Config{kp.Config})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		_, _ = w.Write(b)
+	})
+}
+
+type ODoHRelayOpts struct {
+	// AllowedTargets is the list of target hosts (with port, if it is not 443)
+	// that the relay forwards queries to. If it is empty, all queries
+	// are denied, so the relay can't be abused as an open proxy.
+	AllowedTargets []string
+
+	// Client sends requests to targets. Default is a http.Client with
+	// a timeout of 5s.
+	Client *http.Client
+
+	// Logger specifies the logger which Handler writes its log to.
+	// Default is a nop logger.
+	Logger *zap.Logger
+}
+
+// ODoHRelay is an Oblivious DoH (RFC 9230) proxy. It forwards encrypted
+// queries to the targets that are specified by the "targethost" and
+// "targetpath" parameters.
+type ODoHRelay struct {
+	opts ODoHRelayOpts
+}
+
+var _ http.Handler = (*ODoHRelay)(nil)
+
+func NewODoHRelay(opts ODoHRelayOpts) *ODoHRelay {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: odohRelayTimeout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger
+	}
+	return &ODoHRelay{opts: opts}
+}
+
+func (r *ODoHRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get("Content-Type") != odoh.ContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	params := req.URL.Query()
+	targetHost, targetPath := params.Get("targethost"), params.Get("targetpath")
+	if len(targetHost) == 0 || !strings.HasPrefix(targetPath, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(r.opts.AllowedTargets, targetHost) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	target := url.URL{Scheme: "https", Host: targetHost, Path: targetPath}
+	ctx, cancel := context.WithTimeout(req.Context(), odohRelayTimeout)
+	defer cancel()
+	targetReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Don't forward any client information to the target.
+	targetReq.Header["Content-Type"] = []string{odoh.ContentType}
+	targetReq.Header["Accept"] = []string{odoh.ContentType}
+	targetReq.Header["User-Agent"] = nil
+
+	resp, err := r.opts.Client.Do(targetReq)
+	if err != nil {
+		r.opts.Logger.Warn("failed to forward odoh query", zap.String("target", target.String()), zap.Error(err))
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if ct := resp.Header.Get("Content-Type"); len(ct) > 0 {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(respBody)
+}
@@ -75,6 +75,11 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 			defer c.Close()
 			defer cancelConn(errConnectionCtxCanceled)
 
+			var (
+				tlsStateLoaded bool
+				serverName     string
+				clientCert     *ClientCert
+			)
 			firstRead := true
 			for {
 				if firstRead {
@@ -88,10 +93,13 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 					return // read err, close the connection
 				}
 
-				// Try to get server name from tls conn.
-				var serverName string
-				if tlsConn, ok := c.(*tls.Conn); ok {
-					serverName = tlsConn.ConnectionState().ServerName
+				// Try to get server name and client cert from tls conn.
+				// The handshake was completed by the first read.
+				if tlsConn, ok := c.(*tls.Conn); ok && !tlsStateLoaded {
+					tlsStateLoaded = true
+					s := tlsConn.ConnectionState()
+					serverName = s.ServerName
+					clientCert = ClientCertFromConnState(&s)
 				}
 
 				// handle query
@@ -101,7 +109,7 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 					if ok {
 						clientAddr = ta.AddrPort().Addr()
 					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName, ClientCert: clientCert}, pool.PackTCPBuffer)
 					if r == nil {
 						c.Close() // abort the connection
 						return
@@ -21,6 +21,11 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 )
 
 func LoadCert(tlsCfg *tls.Config, cert, key string) error {
@@ -31,3 +36,63 @@ func LoadCert(tlsCfg *tls.Config, cert, key string) error {
 	tlsCfg.Certificates = []tls.Certificate{c}
 	return nil
 }
+
+// LoadClientCA enables client certificate verification (mutual TLS).
+// Client certificates will be verified against the CAs in ca. If require
+// is true, clients without a valid certificate will be rejected. Otherwise,
+// the certificate is optional, but will be verified if given.
+func LoadClientCA(tlsCfg *tls.Config, ca string, require bool) error {
+	if len(ca) == 0 {
+		if require {
+			return errors.New("client ca is required to verify client certificates")
+		}
+		return nil
+	}
+	pool, err := utils.LoadCertPool([]string{ca})
+	if err != nil {
+		return fmt.Errorf("failed to load client ca, %w", err)
+	}
+	tlsCfg.ClientCAs = pool
+	if require {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// ClientCert is the identity of a verified client certificate.
+type ClientCert struct {
+	// Subject is the subject of the cert in RFC 2253 format.
+	Subject    string
+	CommonName string
+	// SANs contains the DNS names, email addresses, IP addresses and
+	// URIs in the subject alternative name extension.
+	SANs []string
+}
+
+// ClientCertFromConnState returns the identity of the verified client
+// certificate in s. It returns nil if the client did not send a certificate
+// or the certificate was not verified.
+func ClientCertFromConnState(s *tls.ConnectionState) *ClientCert {
+	if s == nil || len(s.VerifiedChains) == 0 || len(s.PeerCertificates) == 0 {
+		return nil
+	}
+	return newClientCert(s.PeerCertificates[0])
+}
+
+func newClientCert(c *x509.Certificate) *ClientCert {
+	cc := &ClientCert{
+		Subject:    c.Subject.String(),
+		CommonName: c.Subject.CommonName,
+	}
+	cc.SANs = append(cc.SANs, c.DNSNames...)
+	cc.SANs = append(cc.SANs, c.EmailAddresses...)
+	for _, ip := range c.IPAddresses {
+		cc.SANs = append(cc.SANs, ip.String())
+	}
+	for _, u := range c.URIs {
+		cc.SANs = append(cc.SANs, u.String())
+	}
+	return cc
+}
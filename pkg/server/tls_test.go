@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+)
+
+// metaHandler answers every query and sends the query meta to c.
+type metaHandler struct {
+	c chan QueryMeta
+}
+
+func (h *metaHandler) Handle(_ context.Context, q *dns.Msg, meta QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	h.c <- meta
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := pack(r)
+	return b
+}
+
+// issueTestCert issues a cert signed by parent. If parent is nil,
+// the cert is a self-signed CA.
+func issueTestCert(t *testing.T, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func Test_ServeTCP_mTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := utils.GenerateCertificate("dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("spiffe://example/client")
+	clientCert := issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		DNSNames:    []string{"client.example"},
+		URIs:        []*url.URL{u},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	otherCA := issueTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other ca"}}, nil)
+	untrustedCert := issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "untrusted"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &otherCA)
+
+	// serve starts a tls server. It returns the server addr and the
+	// channel of query metas.
+	serve := func(tc *tls.Config) (string, chan QueryMeta) {
+		t.Helper()
+		tc.Certificates = []tls.Certificate{serverCert}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		h := &metaHandler{c: make(chan QueryMeta, 1)}
+		go ServeTCP(tls.NewListener(l, tc), h, TCPServerOpts{})
+		return l.Addr().String(), h.c
+	}
+	exchange := func(addr string, cert *tls.Certificate) error {
+		t.Helper()
+		tc := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			tc.Certificates = []tls.Certificate{*cert}
+		}
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, tc)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(time.Second * 3))
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if _, err := dnsutils.WriteMsgToTCP(c, q); err != nil {
+			return err
+		}
+		_, _, err = dnsutils.ReadMsgFromTCP(c)
+		return err
+	}
+
+	// A valid cert is required.
+	tc := new(tls.Config)
+	if err := LoadClientCA(tc, caFile, true); err != nil {
+		t.Fatal(err)
+	}
+	addr, metas := serve(tc)
+	for _, cert := range []*tls.Certificate{nil, &untrustedCert} {
+		if err := exchange(addr, cert); err == nil {
+			t.Fatal("client without a valid cert should be rejected")
+		}
+	}
+	if err := exchange(addr, &clientCert); err != nil {
+		t.Fatal(err)
+	}
+	cc := (<-metas).ClientCert
+	if cc == nil {
+		t.Fatal("missing client cert")
+	}
+	if cc.CommonName != "client" || !slices.Equal(cc.SANs, []string{"client.example", "spiffe://example/client"}) {
+		t.Fatalf("unexpected client cert %+v", cc)
+	}
+
+	// Certs that are not verified don't have an identity.
+	addr, metas = serve(&tls.Config{ClientAuth: tls.RequestClientCert})
+	if err := exchange(addr, &untrustedCert); err != nil {
+		t.Fatal(err)
+	}
+	if cc := (<-metas).ClientCert; cc != nil {
+		t.Fatalf("unverified cert should not have an identity, got %+v", cc)
+	}
+
+	// Optional cert.
+	tc = new(tls.Config)
+	if err := LoadClientCA(tc, caFile, false); err != nil {
+		t.Fatal(err)
+	}
+	addr, metas = serve(tc)
+	if err := exchange(addr, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cc := (<-metas).ClientCert; cc != nil {
+		t.Fatalf("want no client cert, got %+v", cc)
+	}
+	if err := exchange(addr, &clientCert); err != nil {
+		t.Fatal(err)
+	}
+	if cc := (<-metas).ClientCert; cc == nil || cc.CommonName != "client" {
+		t.Fatalf("unexpected client cert %+v", cc)
+	}
+}
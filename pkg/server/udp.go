@@ -25,12 +25,18 @@ import (
 	"net"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/proxy_protocol"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
 
 type UDPServerOpts struct {
 	Logger *zap.Logger
+
+	// ProxyProtocol enables the PROXY protocol v2 for packets from
+	// trusted peers. Packets from trusted peers without a valid header
+	// will be dropped. Nil means disabled.
+	ProxyProtocol proxy_protocol.TrustedFunc
 }
 
 // ServeUDP starts a server at c. It returns if c had a read error.
@@ -71,9 +77,23 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 			continue
 		}
 
+		b := (*rb)[:n]
+		clientAddr := remoteAddr.Addr()
+		if opts.ProxyProtocol != nil && opts.ProxyProtocol(clientAddr) {
+			h, hl, err := proxy_protocol.ParseV2(b)
+			if err != nil {
+				logger.Warn("invalid proxy protocol header", zap.Error(err), zap.Stringer("from", remoteAddr))
+				continue
+			}
+			if !h.Local {
+				clientAddr = h.Src.Addr()
+			}
+			b = b[hl:]
+		}
+
 		q := new(dns.Msg)
-		if err := q.Unpack((*rb)[:n]); err != nil {
-			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", (*rb)[:n]), zap.Stringer("from", remoteAddr))
+		if err := q.Unpack(b); err != nil {
+			logger.Warn("invalid msg", zap.Error(err), zap.Binary("msg", b), zap.Stringer("from", remoteAddr))
 			continue
 		}
 
@@ -88,7 +108,7 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 
 		// handle query
 		go func() {
-			payload := h.Handle(listenerCtx, q, QueryMeta{ClientAddr: remoteAddr.Addr(), FromUDP: true}, pool.PackBuffer)
+			payload := h.Handle(listenerCtx, q, QueryMeta{ClientAddr: clientAddr, FromUDP: true}, pool.PackBuffer)
 			if payload == nil {
 				return
 			}
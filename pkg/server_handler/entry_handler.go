@@ -21,10 +21,13 @@ package server_handler
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dns_cookie"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/rate_limiter"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
@@ -60,6 +63,15 @@ type EntryHandlerOpts struct {
 	// QueryTimeout limits the timeout value of each query.
 	// Default is defaultQueryTimeout.
 	QueryTimeout time.Duration
+
+	// Cookie enables DNS cookies (RFC 7873) for UDP queries. Optional.
+	Cookie *dns_cookie.Server
+
+	// CookieLimiter limits the rate of UDP queries from each client that
+	// has no valid server cookie. Queries over the limit will get a BADCOOKIE
+	// response, or a truncated response if the client does not send a cookie.
+	// Optional. It has no effect if Cookie is nil.
+	CookieLimiter *rate_limiter.Limiter
 }
 
 func (opts *EntryHandlerOpts) init() {
@@ -96,7 +108,39 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	qCtx := query_context.NewContext(q)
 	qCtx.ServerMeta = serverMeta
 
-	// exec entry
+	clientCookie, resp := h.checkCookie(qCtx)
+	if resp == nil {
+		resp = h.execEntry(ctx, qCtx)
+	}
+
+	// We assume that our server is a forwarder.
+	resp.RecursionAvailable = true
+
+	// add respOpt back to resp
+	if respOpt := qCtx.RespOpt(); respOpt != nil {
+		if clientCookie != nil {
+			sc := h.opts.Cookie.Generate(clientCookie, serverMeta.ClientAddr)
+			respOpt.Option = append(respOpt.Option, dns_cookie.NewOption(clientCookie, sc))
+		}
+		resp.Extra = append(resp.Extra, respOpt)
+	}
+
+	if serverMeta.FromUDP {
+		udpSize := getValidUDPSize(qCtx.ClientOpt())
+		resp.Truncate(udpSize)
+	}
+
+	payload, err := packMsgPayload(resp)
+	if err != nil {
+		h.opts.Logger.Error("internal err: failed to pack resp msg", qCtx.InfoField(), zap.Error(err))
+		return nil
+	}
+	return payload
+}
+
+// execEntry executes the entry and returns a non-nil response.
+func (h *EntryHandler) execEntry(ctx context.Context, qCtx *query_context.Context) *dns.Msg {
+	q := qCtx.Q()
 	err := h.opts.Entry.Exec(ctx, qCtx)
 	var resp *dns.Msg
 	if err != nil {
@@ -104,6 +148,13 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp = new(dns.Msg)
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeServerFailure
+		if !qCtx.HasEDE() {
+			if errors.Is(err, context.DeadlineExceeded) {
+				qCtx.SetEDE(dns.ExtendedErrorCodeNoReachableAuthority, "")
+			} else {
+				qCtx.SetEDE(dns.ExtendedErrorCodeOther, "")
+			}
+		}
 	} else {
 		resp = qCtx.R()
 	}
@@ -113,25 +164,41 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeRefused
 	}
-	// We assume that our server is a forwarder.
-	resp.RecursionAvailable = true
+	return resp
+}
 
-	// add respOpt back to resp
-	if respOpt := qCtx.RespOpt(); respOpt != nil {
-		resp.Extra = append(resp.Extra, respOpt)
+// checkCookie checks the cookie of UDP queries if cookie is enabled.
+// clientCookie is the client cookie from the query, if any. If the query
+// should not be passed to the entry, checkCookie returns a non-nil resp.
+func (h *EntryHandler) checkCookie(qCtx *query_context.Context) (clientCookie []byte, resp *dns.Msg) {
+	if h.opts.Cookie == nil || !qCtx.ServerMeta.FromUDP {
+		return nil, nil
 	}
 
-	if serverMeta.FromUDP {
-		udpSize := getValidUDPSize(qCtx.ClientOpt())
-		resp.Truncate(udpSize)
+	cc, sc, found, err := dns_cookie.FromOpt(qCtx.ClientOpt())
+	if err != nil {
+		resp = new(dns.Msg)
+		resp.SetRcode(qCtx.Q(), dns.RcodeFormatError)
+		return nil, resp
 	}
 
-	payload, err := packMsgPayload(resp)
-	if err != nil {
-		h.opts.Logger.Error("internal err: failed to pack resp msg", qCtx.InfoField(), zap.Error(err))
-		return nil
+	clientAddr := qCtx.ServerMeta.ClientAddr
+	if found && len(sc) > 0 && h.opts.Cookie.Verify(cc, sc, clientAddr) {
+		return cc, nil
 	}
-	return payload
+
+	// Client has no valid server cookie.
+	if l := h.opts.CookieLimiter; l != nil && clientAddr.IsValid() && !l.Allow(clientAddr.Unmap()) {
+		resp = new(dns.Msg)
+		resp.SetReply(qCtx.Q())
+		if found {
+			resp.Rcode = dns.RcodeBadCookie
+		} else {
+			// Client does not support cookie. Force it to use TCP.
+			resp.Truncated = true
+		}
+	}
+	return cc, resp
 }
 
 // opt can be nil.
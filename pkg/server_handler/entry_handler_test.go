@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package server_handler_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/ede"
+	fastforward "github.com/IrineSistiana/mosdns/v5/plugin/executable/forward"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// chainEntry runs nodes as the entry.
+func chainEntry(nodes ...*sequence.ChainNode) sequence.Executable {
+	return sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		cw := sequence.NewChainWalker(nodes, nil)
+		return cw.ExecNext(ctx, qCtx)
+	})
+}
+
+// handle sends a query with EDNS0 to entry and returns the written response
+// and its first EDE.
+func handle(t *testing.T, entry sequence.Executable) (*dns.Msg, *dns.EDNS0_EDE) {
+	t.Helper()
+	h := server_handler.NewEntryHandler(server_handler.EntryHandlerOpts{Entry: entry, QueryTimeout: time.Second})
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	payload := h.Handle(context.Background(), q, server.QueryMeta{}, pool.PackBuffer)
+	if payload == nil {
+		t.Fatal("no response")
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(*payload); err != nil {
+		t.Fatal(err)
+	}
+	var e *dns.EDNS0_EDE
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if v, ok := o.(*dns.EDNS0_EDE); ok && e == nil {
+				e = v
+			}
+		}
+	}
+	return r, e
+}
+
+func TestEntryHandler_EDE_reject(t *testing.T) {
+	r, e := handle(t, chainEntry(&sequence.ChainNode{RE: sequence.ActionReject{Rcode: dns.RcodeRefused}}))
+	if r.Rcode != dns.RcodeRefused || e == nil || e.InfoCode != dns.ExtendedErrorCodeBlocked {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func TestEntryHandler_EDE_noResponse(t *testing.T) {
+	r, e := handle(t, chainEntry())
+	if r.Rcode != dns.RcodeRefused || e != nil {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func TestEntryHandler_EDE_quickSetup(t *testing.T) {
+	exec, err := ede.QuickSetup(nil, "filtered by policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, e := handle(t, chainEntry(
+		&sequence.ChainNode{E: exec.(sequence.Executable)},
+		&sequence.ChainNode{RE: sequence.ActionReject{Rcode: dns.RcodeNameError}},
+	))
+	if e == nil || e.InfoCode != dns.ExtendedErrorCodeFiltered || e.ExtraText != "by policy" {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func TestEntryHandler_EDE_cacheLazyHit(t *testing.T) {
+	c, err := cache.NewCache(&cache.Args{LazyCacheTTL: 3600}, cache.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	upstream := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil {
+			return nil
+		}
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+			A:   net.IPv4(1, 2, 3, 4),
+		}}
+		qCtx.SetResponse(r)
+		return nil
+	})
+	entry := chainEntry(&sequence.ChainNode{RE: c}, &sequence.ChainNode{E: upstream})
+
+	if _, e := handle(t, entry); e != nil {
+		t.Fatalf("unexpected ede %s", e)
+	}
+	time.Sleep(time.Millisecond * 1100) // Wait for the msg to expire.
+	r, e := handle(t, entry)
+	if len(r.Answer) != 1 || e == nil || e.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func TestEntryHandler_EDE_forwardFailure(t *testing.T) {
+	// A closed port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	f, err := fastforward.NewForward(&fastforward.Args{
+		Upstreams: []fastforward.UpstreamConfig{{Addr: "tcp://" + addr}},
+	}, fastforward.Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, e := handle(t, chainEntry(&sequence.ChainNode{E: f}))
+	if r.Rcode != dns.RcodeServerFailure || e == nil || e.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
 )
@@ -38,42 +39,68 @@ const (
 	minimumUpdateInterval = time.Minute * 5
 	retryInterval         = time.Second * 2
 	queryTimeout          = time.Second * 5
+
+	// connAttemptDelay is the "Connection Attempt Delay" in RFC 8305 5.
+	connAttemptDelay = time.Millisecond * 250
+	// failurePenalty is how long a failed address will be tried last.
+	failurePenalty = time.Second * 30
 )
 
 var (
 	errNoAddrInResp = errors.New("resp does not have ip address")
 )
 
-func New(
-	host string,
-	port uint16,
-	bootstrapServer netip.AddrPort,
-	bootstrapVer int, // 0,4,6
-	logger *zap.Logger, // not nil
-) (*Bootstrap, error) {
+// Exchanger is a dns upstream that can be used to resolve the host.
+type Exchanger interface {
+	ExchangeContext(ctx context.Context, m []byte) (*[]byte, error)
+}
+
+type Opts struct {
+	// Server is a plain dns server to resolve the host.
+	Server netip.AddrPort
+
+	// Upstream resolves the host instead of Server if it is not nil.
+	Upstream Exchanger
+
+	// Version is the ip version to resolve. One of 0 (default, same as 4),
+	// 4, 6 and 46 (dual-stack, both A and AAAA).
+	Version int
+
+	Logger *zap.Logger // not nil
+}
+
+func New(host string, port uint16, opts Opts) (*Bootstrap, error) {
 	dp := new(Bootstrap)
 	dp.fqdn = dns.Fqdn(host)
 	dp.port = port
-	if !bootstrapServer.IsValid() {
-		return nil, errors.New("invalid bootstrap server address")
+	if opts.Upstream != nil {
+		dp.upstream = opts.Upstream
+	} else {
+		if !opts.Server.IsValid() {
+			return nil, errors.New("invalid bootstrap server address")
+		}
+		dp.bootstrap = net.UDPAddrFromAddrPort(opts.Server)
 	}
-	dp.bootstrap = net.UDPAddrFromAddrPort(bootstrapServer)
-	qt, ok := bootstrapVer2Qt(bootstrapVer)
+	qts, ok := bootstrapVer2Qt(opts.Version)
 	if !ok {
-		return nil, fmt.Errorf("invalid bootstrap version %d", bootstrapVer)
+		return nil, fmt.Errorf("invalid bootstrap version %d", opts.Version)
 	}
-	dp.qt = qt
-	dp.logger = logger
+	dp.qts = qts
+	dp.logger = opts.Logger
 
 	dp.readyNotify = make(chan struct{})
+	dp.failed = make(map[netip.Addr]time.Time)
 	return dp, nil
 }
 
+// Bootstrap resolves the upstream host and keeps all its addresses.
+// Addresses that failed to connect will be tried last for a while.
 type Bootstrap struct {
 	fqdn      string
 	port      uint16
-	bootstrap *net.UDPAddr
-	qt        uint16      // dns.TypeA or dns.TypeAAAA
+	bootstrap *net.UDPAddr // nil if upstream is used
+	upstream  Exchanger
+	qts       []uint16    // dns.TypeA and/or dns.TypeAAAA
 	logger    *zap.Logger // not nil
 
 	updating   atomic.Bool
@@ -82,22 +109,138 @@ type Bootstrap struct {
 	readyNotify chan struct{}
 	m           sync.Mutex
 	ready       bool
-	addrStr     string
+	addrs       []netip.Addr // sorted, see sortAddrs
+	failed      map[netip.Addr]time.Time
 }
 
-func (sp *Bootstrap) GetAddrPortStr(ctx context.Context) (string, error) {
+// GetAddrs returns all addresses of the host, ordered by preference.
+func (sp *Bootstrap) GetAddrs(ctx context.Context) ([]netip.AddrPort, error) {
 	sp.tryUpdate()
 
 	select {
 	case <-ctx.Done():
-		return "", context.Cause(ctx)
+		return nil, context.Cause(ctx)
 	case <-sp.readyNotify:
 	}
 
 	sp.m.Lock()
-	addr := sp.addrStr
+	defer sp.m.Unlock()
+	now := time.Now()
+	aps := make([]netip.AddrPort, 0, len(sp.addrs))
+	var failed []netip.AddrPort
+	for _, addr := range sp.addrs {
+		ap := netip.AddrPortFrom(addr, sp.port)
+		if t, ok := sp.failed[addr]; ok {
+			if now.Before(t.Add(failurePenalty)) {
+				failed = append(failed, ap)
+				continue
+			}
+			delete(sp.failed, addr)
+		}
+		aps = append(aps, ap)
+	}
+	return append(aps, failed...), nil
+}
+
+// GetAddr returns the most preferred address of the host.
+func (sp *Bootstrap) GetAddr(ctx context.Context) (netip.AddrPort, error) {
+	aps, err := sp.GetAddrs(ctx)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return aps[0], nil
+}
+
+// MarkFailed makes addr be tried last for a while.
+func (sp *Bootstrap) MarkFailed(addr netip.AddrPort) {
+	sp.m.Lock()
+	sp.failed[addr.Addr()] = time.Now()
 	sp.m.Unlock()
-	return addr, nil
+}
+
+// DialContext connects to the host with the Happy Eyeballs algorithm
+// (RFC 8305). network must be a stream network, e.g. "tcp".
+func (sp *Bootstrap) DialContext(ctx context.Context, network string, d *net.Dialer) (net.Conn, error) {
+	aps, err := sp.GetAddrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap failed, %w", err)
+	}
+	dial := func(ctx context.Context, ap netip.AddrPort) (net.Conn, error) {
+		return d.DialContext(ctx, network, ap.String())
+	}
+	return happyEyeballs(ctx, aps, dial, connAttemptDelay, sp.MarkFailed)
+}
+
+// happyEyeballs races connections to aps. A new attempt starts every delay,
+// or immediately if the previous attempt failed. The first established
+// connection wins.
+// onFail will be called with addresses that failed to connect.
+func happyEyeballs(
+	ctx context.Context,
+	aps []netip.AddrPort,
+	dial func(ctx context.Context, ap netip.AddrPort) (net.Conn, error),
+	delay time.Duration,
+	onFail func(ap netip.AddrPort),
+) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type res struct {
+		c   net.Conn
+		ap  netip.AddrPort
+		err error
+	}
+	resC := make(chan res, len(aps))
+	next, pending := 0, 0
+	startNext := func() {
+		ap := aps[next]
+		next++
+		pending++
+		go func() {
+			c, err := dial(ctx, ap)
+			resC <- res{c: c, ap: ap, err: err}
+		}()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	startNext()
+	var errs []error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(aps) {
+				startNext()
+				timer.Reset(delay)
+			}
+		case r := <-resC:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// Close connections that lose the race.
+					go func(n int) {
+						for i := 0; i < n; i++ {
+							if r := <-resC; r.c != nil {
+								r.c.Close()
+							}
+						}
+					}(pending)
+				}
+				return r.c, nil
+			}
+			if ctx.Err() != nil { // canceled, not the address's fault.
+				errs = append(errs, r.err)
+				continue
+			}
+			onFail(r.ap)
+			errs = append(errs, fmt.Errorf("%s: %w", r.ap, r.err))
+			if next < len(aps) {
+				startNext()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
 }
 
 func (sp *Bootstrap) tryUpdate() {
@@ -108,7 +251,7 @@ func (sp *Bootstrap) tryUpdate() {
 				ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
 				defer cancel()
 				start := time.Now()
-				addr, ttl, err := sp.updateAddr(ctx)
+				addrs, ttl, err := sp.updateAddr(ctx)
 				if err != nil {
 					sp.logger.Check(zap.WarnLevel, "failed to update bootstrap addr").Write(
 						zap.String("fqdn", sp.fqdn),
@@ -122,7 +265,7 @@ func (sp *Bootstrap) tryUpdate() {
 					}
 					sp.logger.Check(zap.DebugLevel, "bootstrap addr updated").Write(
 						zap.String("fqdn", sp.fqdn),
-						zap.Stringer("addr", addr),
+						zap.Any("addrs", addrs),
 						zap.Duration("ttl", updateInterval),
 						zap.Duration("elapse", time.Since(start)),
 					)
@@ -135,33 +278,141 @@ func (sp *Bootstrap) tryUpdate() {
 	}
 }
 
-func (sp *Bootstrap) updateAddr(ctx context.Context) (netip.Addr, uint32, error) {
-	addr, ttl, err := sp.resolve(ctx, sp.qt)
-	if err != nil {
-		return netip.Addr{}, 0, err
+func (sp *Bootstrap) updateAddr(ctx context.Context) ([]netip.Addr, uint32, error) {
+	type res struct {
+		addrs []netip.Addr
+		ttl   uint32
+		err   error
+	}
+	resC := make(chan res, len(sp.qts))
+	for _, qt := range sp.qts {
+		go func() {
+			addrs, ttl, err := sp.resolve(ctx, qt)
+			resC <- res{addrs: addrs, ttl: ttl, err: err}
+		}()
 	}
 
-	addrPort := netip.AddrPortFrom(addr, sp.port).String()
+	var addrs []netip.Addr
+	var minTTL uint32
+	var errs []error
+	for range sp.qts {
+		r := <-resC
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if len(addrs) == 0 || r.ttl < minTTL {
+			minTTL = r.ttl
+		}
+		addrs = append(addrs, r.addrs...)
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	addrs = sortAddrs(addrs)
+
 	sp.m.Lock()
-	sp.addrStr = addrPort
+	sp.addrs = addrs
 	if !sp.ready {
 		sp.ready = true
 		close(sp.readyNotify)
 	}
 	sp.m.Unlock()
-	return addr, ttl, nil
+	return addrs, minTTL, nil
 }
 
-func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32, error) {
+// sortAddrs interleaves addresses by family, starting with IPv6,
+// as RFC 8305 4 suggested.
+func sortAddrs(addrs []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	sorted := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) ([]netip.Addr, uint32, error) {
 	const edns0UdpSize = 1200
 
 	q := new(dns.Msg)
 	q.SetQuestion(sp.fqdn, qt)
 	q.SetEdns0(edns0UdpSize, false)
 
+	var resp *dns.Msg
+	var err error
+	if sp.upstream != nil {
+		resp, err = sp.exchangeUpstream(ctx, q)
+	} else {
+		resp, err = sp.exchangeUDP(ctx, q, edns0UdpSize)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []netip.Addr
+	var minTTL uint32
+	for _, v := range resp.Answer {
+		var ip net.IP
+		var ttl uint32
+		switch rr := v.(type) {
+		case *dns.A:
+			ip = rr.A
+			ttl = rr.Hdr.Ttl
+		case *dns.AAAA:
+			ip = rr.AAAA
+			ttl = rr.Hdr.Ttl
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if ok {
+			if len(addrs) == 0 || ttl < minTTL {
+				minTTL = ttl
+			}
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	if len(addrs) == 0 {
+		// No ip addr in resp.
+		return nil, 0, errNoAddrInResp
+	}
+	return addrs, minTTL, nil
+}
+
+func (sp *Bootstrap) exchangeUpstream(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	r, err := sp.upstream.ExchangeContext(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange with bootstrap upstream, %w", err)
+	}
+	defer pool.ReleaseBuf(r)
+	resp := new(dns.Msg)
+	if err := resp.Unpack(*r); err != nil {
+		return nil, fmt.Errorf("invalid resp, %w", err)
+	}
+	return resp, nil
+}
+
+func (sp *Bootstrap) exchangeUDP(ctx context.Context, q *dns.Msg, udpSize int) (*dns.Msg, error) {
 	c, err := net.DialUDP("udp", nil, sp.bootstrap)
 	if err != nil {
-		return netip.Addr{}, 0, err
+		return nil, err
 	}
 	defer c.Close()
 
@@ -196,53 +447,32 @@ func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32
 	}()
 
 	go func() {
-		m, _, err := dnsutils.ReadMsgFromUDP(c, edns0UdpSize)
+		m, _, err := dnsutils.ReadMsgFromUDP(c, udpSize)
 		readResC <- res{resp: m, err: err}
 	}()
 
 	select {
 	case <-ctx.Done():
-		return netip.Addr{}, 0, context.Cause(ctx)
+		return nil, context.Cause(ctx)
 	case err := <-writeErrC:
-		return netip.Addr{}, 0, fmt.Errorf("failed to write query, %w", err)
+		return nil, fmt.Errorf("failed to write query, %w", err)
 	case r := <-readResC:
-		resp := r.resp
-		err := r.err
-		if err != nil {
-			return netip.Addr{}, 0, fmt.Errorf("failed to read resp, %w", err)
-		}
-
-		for _, v := range resp.Answer {
-			var ip net.IP
-			var ttl uint32
-			switch rr := v.(type) {
-			case *dns.A:
-				ip = rr.A
-				ttl = rr.Hdr.Ttl
-			case *dns.AAAA:
-				ip = rr.AAAA
-				ttl = rr.Hdr.Ttl
-			default:
-				continue
-			}
-			addr, ok := netip.AddrFromSlice(ip)
-			if ok {
-				return addr, ttl, nil
-			}
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to read resp, %w", r.err)
 		}
-
-		// No ip addr in resp.
-		return netip.Addr{}, 0, errNoAddrInResp
+		return r.resp, nil
 	}
 }
 
-func bootstrapVer2Qt(ver int) (uint16, bool) {
+func bootstrapVer2Qt(ver int) ([]uint16, bool) {
 	switch ver {
 	case 0, 4:
-		return dns.TypeA, true
+		return []uint16{dns.TypeA}, true
+	case 46:
+		return []uint16{dns.TypeAAAA, dns.TypeA}, true
 	case 6:
-		return dns.TypeAAAA, true
+		return []uint16{dns.TypeAAAA}, true
 	default:
-		return 0, false
+		return nil, false
 	}
 }
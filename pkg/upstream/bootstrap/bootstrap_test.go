@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type fakeUpstream struct{}
+
+func (fakeUpstream) ExchangeContext(_ context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		r.Answer = append(r.Answer,
+			&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")},
+			&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.2")},
+		)
+	case dns.TypeAAAA:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+	}
+	b, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+	buf := pool.GetBuf(len(b))
+	copy(*buf, b)
+	return buf, nil
+}
+
+func Test_Bootstrap(t *testing.T) {
+	aps := func(s ...string) []netip.AddrPort {
+		var r []netip.AddrPort
+		for _, a := range s {
+			r = append(r, netip.MustParseAddrPort(a))
+		}
+		return r
+	}
+	tests := []struct {
+		name string
+		ver  int
+		want []netip.AddrPort
+	}{
+		{"default", 0, aps("192.0.2.1:853", "192.0.2.2:853")},
+		{"dual", 46, aps("[2001:db8::1]:853", "192.0.2.1:853", "192.0.2.2:853")},
+		{"v4", 4, aps("192.0.2.1:853", "192.0.2.2:853")},
+		{"v6", 6, aps("[2001:db8::1]:853")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := New("example.com", 853, Opts{Upstream: fakeUpstream{}, Version: tt.ver, Logger: zap.NewNop()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got, err := bs.GetAddrs(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("GetAddrs() = %v, want %v", got, tt.want)
+			}
+
+			// Failed addr should be tried last.
+			bs.MarkFailed(got[0])
+			got2, _ := bs.GetAddrs(ctx)
+			if len(got) > 1 && (got2[0] == got[0] || got2[len(got2)-1] != got[0]) {
+				t.Fatalf("failed addr is not moved to the end, %v", got2)
+			}
+		})
+	}
+}
+
+func Test_sortAddrs(t *testing.T) {
+	var in []netip.Addr
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2"} {
+		in = append(in, netip.MustParseAddr(s))
+	}
+	want := []netip.Addr{in[3], in[0], in[4], in[1], in[2]}
+	if got := sortAddrs(in); !slices.Equal(got, want) {
+		t.Fatalf("sortAddrs() = %v, want %v", got, want)
+	}
+}
+
+type fakeConn struct {
+	net.Conn
+	ap netip.AddrPort
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func Test_happyEyeballs(t *testing.T) {
+	a1 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	a2 := netip.MustParseAddrPort("192.0.2.1:53")
+	a3 := netip.MustParseAddrPort("192.0.2.2:53")
+	errDial := errors.New("dial err")
+
+	type dialRes struct {
+		delay time.Duration
+		err   error
+	}
+	tests := []struct {
+		name       string
+		dial       map[netip.AddrPort]dialRes
+		want       netip.AddrPort
+		wantFailed []netip.AddrPort
+		wantErr    bool
+	}{
+		{
+			name: "first wins",
+			dial: map[netip.AddrPort]dialRes{a1: {}, a2: {}, a3: {}},
+			want: a1,
+		},
+		{
+			name:       "first fails immediately",
+			dial:       map[netip.AddrPort]dialRes{a1: {err: errDial}, a2: {}, a3: {}},
+			want:       a2,
+			wantFailed: []netip.AddrPort{a1},
+		},
+		{
+			name: "first is slow",
+			dial: map[netip.AddrPort]dialRes{a1: {delay: time.Second}, a2: {}, a3: {}},
+			want: a2,
+		},
+		{
+			name:       "all failed",
+			dial:       map[netip.AddrPort]dialRes{a1: {err: errDial}, a2: {err: errDial}, a3: {err: errDial}},
+			wantFailed: []netip.AddrPort{a1, a2, a3},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := func(ctx context.Context, ap netip.AddrPort) (net.Conn, error) {
+				r := tt.dial[ap]
+				if r.delay > 0 {
+					select {
+					case <-time.After(r.delay):
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				}
+				if r.err != nil {
+					return nil, r.err
+				}
+				return &fakeConn{ap: ap}, nil
+			}
+			var mu sync.Mutex
+			var failed []netip.AddrPort
+			onFail := func(ap netip.AddrPort) {
+				mu.Lock()
+				failed = append(failed, ap)
+				mu.Unlock()
+			}
+
+			c, err := happyEyeballs(context.Background(), []netip.AddrPort{a1, a2, a3}, dial, time.Millisecond*50, onFail)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("happyEyeballs() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if got := c.(*fakeConn).ap; got != tt.want {
+					t.Fatalf("happyEyeballs() connected to %s, want %s", got, tt.want)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(failed, tt.wantFailed) {
+				t.Fatalf("failed addrs = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
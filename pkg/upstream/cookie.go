@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dns_cookie"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const cookieEdns0Size = 1200
+
+// clientCookie adds client cookies (RFC 7873) to queries and verifies
+// the client cookie in responses.
+type clientCookie struct {
+	cc []byte
+
+	m  sync.Mutex
+	sc []byte // server cookie learned from the server.
+}
+
+func newClientCookie() *clientCookie {
+	return &clientCookie{cc: dns_cookie.NewClientCookie()}
+}
+
+func (c *clientCookie) serverCookie() []byte {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.sc
+}
+
+func (c *clientCookie) setServerCookie(sc []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.sc = sc
+}
+
+// accept reports whether the response r should be accepted. As RFC 7873 5.3
+// says, responses with a mismatched client cookie, or without a cookie after
+// a server cookie was learned, are discarded. Responses that cannot be
+// unpacked are accepted and left to the caller.
+func (c *clientCookie) accept(r []byte) bool {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(r); err != nil {
+		return true
+	}
+	cc, _, found, err := dns_cookie.FromOpt(resp.IsEdns0())
+	if err != nil {
+		return false
+	}
+	if !found {
+		return c.serverCookie() == nil
+	}
+	return bytes.Equal(cc, c.cc)
+}
+
+// exchange adds the cookie to q and exchanges it by exchangeFunc.
+// exchangeFunc should drop spoofed responses by accept. If the server
+// responds a BADCOOKIE, the query will be retried once with the new
+// server cookie.
+func (c *clientCookie) exchange(
+	ctx context.Context,
+	q []byte,
+	exchangeFunc func(ctx context.Context, q []byte) (*[]byte, error),
+) (*[]byte, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(q); err != nil {
+		return nil, err
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(cookieEdns0Size, false)
+		opt = m.IsEdns0()
+	}
+
+	for retried := false; ; retried = true {
+		opts := opt.Option[:0]
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0COOKIE {
+				opts = append(opts, o)
+			}
+		}
+		opt.Option = append(opts, dns_cookie.NewOption(c.cc, c.serverCookie()))
+
+		qb, err := pool.PackBuffer(m)
+		if err != nil {
+			return nil, err
+		}
+		r, err := exchangeFunc(ctx, *qb)
+		pool.ReleaseBuf(qb)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(*r); err != nil {
+			pool.ReleaseBuf(r)
+			return nil, err
+		}
+		cc, sc, found, _ := dns_cookie.FromOpt(resp.IsEdns0())
+		if !found || !bytes.Equal(cc, c.cc) {
+			return r, nil
+		}
+		if len(sc) > 0 {
+			c.setServerCookie(sc)
+		}
+		if resp.Rcode == dns.RcodeBadCookie && !retried {
+			pool.ReleaseBuf(r)
+			continue
+		}
+		return r, nil
+	}
+}
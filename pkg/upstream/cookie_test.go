@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dns_cookie"
+	"github.com/miekg/dns"
+)
+
+func Test_udpCookie(t *testing.T) {
+	serverCookie := []byte("01234567")
+	var (
+		mu              sync.Mutex
+		spoof           bool
+		noCookie        bool
+		gotServerCookie []byte
+	)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		cc, sc, _, _ := dns_cookie.FromOpt(q.IsEdns0())
+		gotServerCookie = sc
+		r.SetEdns0(1200, false)
+		if spoof {
+			// A forged reply arrives before the real one.
+			fr := r.Copy()
+			fr.IsEdns0().Option = append(fr.IsEdns0().Option, dns_cookie.NewOption(dns_cookie.NewClientCookie(), serverCookie))
+			w.WriteMsg(fr)
+		}
+		if noCookie {
+			w.WriteMsg(r)
+			return
+		}
+		r.IsEdns0().Option = append(r.IsEdns0().Option, dns_cookie.NewOption(cc, serverCookie))
+		w.WriteMsg(r)
+	})
+	addr, shutdown := newUDPTestServer(t, handler)
+	defer shutdown()
+
+	u, err := NewUpstream(addr, Opt{EnableCookie: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	qb, _ := q.Pack()
+	exchange := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := u.ExchangeContext(ctx, qb)
+		return err
+	}
+
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+	// Second query should carry the learned server cookie.
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if string(gotServerCookie) != string(serverCookie) {
+		t.Fatalf("server cookie was not sent back, got %x", gotServerCookie)
+	}
+	spoof = true
+	mu.Unlock()
+	// The forged reply should be dropped and the real one accepted.
+	if err := exchange(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Server is known to support cookies. Responses without cookie
+	// should be dropped until the query times out.
+	mu.Lock()
+	spoof, noCookie = false, true
+	mu.Unlock()
+	if err := exchange(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	odohConfigTTL = time.Hour
+	// odohConfigRetryInterval is the interval to retry a failed config
+	// refresh while the cached config is still in use.
+	odohConfigRetryInterval = time.Second * 30
+	odohConfigFetchTimeout  = time.Second * 5
+)
+
+// ODoHUpstream is an Oblivious DNS over HTTPS (RFC 9230) upstream.
+type ODoHUpstream struct {
+	rt        http.RoundTripper
+	logger    *zap.Logger // non-nil
+	configURL string
+	queryURL  string
+
+	m         sync.Mutex
+	config    *odoh.Config
+	refreshAt time.Time
+	sf        singleflight.Group // de-duplicates config fetches.
+}
+
+// NewODoHUpstream creates an ODoH upstream. target is the url of the target,
+// e.g. "https://odoh.example.com/dns-query". proxy is the url of the proxy
+// (relay). If proxy is empty, queries will be sent to the target directly,
+// which provides no privacy benefit over DoH.
+// ODoH configs are always fetched from the target directly.
+func NewODoHUpstream(target, proxy string, rt http.RoundTripper, logger *zap.Logger) (*ODoHUpstream, error) {
+	targetURL, err := urlpkg.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target url, %w", err)
+	}
+	if len(targetURL.Path) == 0 {
+		targetURL.Path = "/dns-query"
+	}
+
+	queryURL := targetURL.String()
+	if len(proxy) > 0 {
+		proxyURL, err := urlpkg.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url, %w", err)
+		}
+		q := proxyURL.Query()
+		q.Set("targethost", targetURL.Host)
+		q.Set("targetpath", targetURL.Path)
+		proxyURL.RawQuery = q.Encode()
+		queryURL = proxyURL.String()
+	}
+
+	if logger == nil {
+		logger = nopLogger
+	}
+	configURL := *targetURL
+	configURL.Path = odoh.ConfigsPath
+	configURL.RawQuery = ""
+	return &ODoHUpstream{
+		rt:        rt,
+		logger:    logger,
+		configURL: configURL.String(),
+		queryURL:  queryURL,
+	}, nil
+}
+
+func (u *ODoHUpstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	type res struct {
+		r   *[]byte
+		err error
+	}
+
+	qc := bytes.Clone(q)
+	// Use a zero id for the same reason as DoH.
+	qc[0] = 0
+	qc[1] = 0
+
+	resChan := make(chan res, 1)
+	go func() {
+		// See Upstream.ExchangeContext.
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDoHTimeout)
+		defer cancel()
+		r, err := u.exchange(ctx, qc)
+		if err != nil {
+			u.logger.Check(zap.WarnLevel, "exchange failed").Write(zap.Error(err))
+		}
+		resChan <- res{r: r, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-resChan:
+		r := res.r
+		err := res.err
+		if r != nil {
+			binary.BigEndian.PutUint16(*r, binary.BigEndian.Uint16(q))
+		}
+		return r, err
+	}
+}
+
+func (u *ODoHUpstream) exchange(ctx context.Context, q []byte) (*[]byte, error) {
+	config, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get odoh config, %w", err)
+	}
+	body, qCtx, err := odoh.EncryptQuery(*config, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt query, %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.queryURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{odoh.ContentType}
+	req.Header["Accept"] = []string{odoh.ContentType}
+	req.Header["User-Agent"] = nil
+	respBody, err := u.roundTrip(req)
+	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) && se.code < 500 {
+			// The target may have rotated its key. Refresh the config next time.
+			u.invalidateConfig(config)
+		}
+		return nil, err
+	}
+
+	r, err := qCtx.DecryptResponse(respBody)
+	if err != nil {
+		u.invalidateConfig(config)
+		return nil, fmt.Errorf("failed to decrypt response, %w", err)
+	}
+	if len(r) < dnsutils.DnsHeaderLen {
+		return nil, dnsutils.ErrPayloadTooSmall
+	}
+	payload := pool.GetBuf(len(r))
+	copy(*payload, r)
+	return payload, nil
+}
+
+// getConfig returns the cached target config or fetches a new one.
+// An outdated config is still used while it is refreshed in the background.
+func (u *ODoHUpstream) getConfig(ctx context.Context) (*odoh.Config, error) {
+	u.m.Lock()
+	config, refreshAt := u.config, u.refreshAt
+	u.m.Unlock()
+
+	if config != nil {
+		if time.Now().After(refreshAt) {
+			u.refreshConfig()
+		}
+		return config, nil
+	}
+
+	// No config. Wait for the fetch.
+	select {
+	case res := <-u.refreshConfig():
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*odoh.Config), nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// refreshConfig fetches the target config in the background. Concurrent
+// calls share the same fetch.
+func (u *ODoHUpstream) refreshConfig() <-chan singleflight.Result {
+	return u.sf.DoChan("", func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), odohConfigFetchTimeout)
+		defer cancel()
+		config, err := u.fetchConfig(ctx)
+
+		u.m.Lock()
+		defer u.m.Unlock()
+		if err != nil {
+			if u.config != nil {
+				u.logger.Warn("failed to refresh odoh config", zap.Error(err))
+				u.refreshAt = time.Now().Add(odohConfigRetryInterval)
+			}
+			return nil, err
+		}
+		u.config = config
+		u.refreshAt = time.Now().Add(odohConfigTTL)
+		return config, nil
+	})
+}
+
+func (u *ODoHUpstream) fetchConfig(ctx context.Context) (*odoh.Config, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.configURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header["User-Agent"] = nil
+	b, err := u.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	cs, err := odoh.ParseConfigs(b)
+	if err != nil {
+		return nil, err
+	}
+	return &cs[0], nil
+}
+
+func (u *ODoHUpstream) invalidateConfig(c *odoh.Config) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.config == c {
+		u.config = nil
+	}
+}
+
+func (u *ODoHUpstream) roundTrip(req *http.Request) ([]byte, error) {
+	resp, err := u.rt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body1k, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &statusError{code: resp.StatusCode, body: body1k}
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	return b, nil
+}
+
+type statusError struct {
+	code int
+	body []byte
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad http status codes %d with body [%s]", e.code, e.body)
+}
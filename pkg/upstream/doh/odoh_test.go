@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+)
+
+type echoHandler struct{}
+
+func (echoHandler) Handle(_ context.Context, q *dns.Msg, _ server.QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN A 127.0.0.1")
+	r.Answer = append(r.Answer, rr)
+	b, _ := pack(r)
+	return b
+}
+
+func TestODoHUpstream(t *testing.T) {
+	kp, err := odoh.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetMux := http.NewServeMux()
+	targetMux.Handle(odoh.ConfigsPath, server.ODoHConfigsHandler(kp))
+	targetMux.Handle("/dns-query", server.NewHttpHandler(echoHandler{}, server.HttpHandlerOpts{ODoHKey: kp}))
+	target := httptest.NewTLSServer(targetMux)
+	defer target.Close()
+
+	relay := httptest.NewTLSServer(server.NewODoHRelay(server.ODoHRelayOpts{
+		Client:         target.Client(),
+		AllowedTargets: []string{target.Listener.Addr().String()},
+	}))
+	defer relay.Close()
+
+	// The test client trusts both test servers since they share the same cert.
+	rt := target.Client().Transport
+	for _, proxy := range []string{"", relay.URL + "/proxy"} {
+		u, err := NewODoHUpstream(target.URL+"/dns-query", proxy, rt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qb, _ := q.Pack()
+		rb, err := u.ExchangeContext(context.Background(), qb)
+		if err != nil {
+			t.Fatalf("proxy %q: %v", proxy, err)
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*rb); err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != q.Id || len(r.Answer) != 1 {
+			t.Fatalf("proxy %q: unexpected response %s", proxy, r)
+		}
+	}
+
+	// Relay should reject targets that are not allowed. A relay without
+	// allowed targets rejects all queries.
+	for _, targets := range [][]string{{"odoh.example.com"}, nil} {
+		blocked := httptest.NewTLSServer(server.NewODoHRelay(server.ODoHRelayOpts{
+			Client:         target.Client(),
+			AllowedTargets: targets,
+		}))
+		u, _ := NewODoHUpstream(target.URL+"/dns-query", blocked.URL+"/proxy", rt, nil)
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qb, _ := q.Pack()
+		_, err := u.ExchangeContext(context.Background(), qb)
+		blocked.Close()
+		if err == nil {
+			t.Fatalf("relay with targets %v should reject disallowed target", targets)
+		}
+	}
+}
+
+func TestODoHUpstream_refreshConfig(t *testing.T) {
+	kp, err := odoh.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	block := make(chan struct{})
+	configsHandler := server.ODoHConfigsHandler(kp)
+	targetMux := http.NewServeMux()
+	targetMux.HandleFunc(odoh.ConfigsPath, func(w http.ResponseWriter, req *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-block
+		}
+		configsHandler.ServeHTTP(w, req)
+	})
+	targetMux.Handle("/dns-query", server.NewHttpHandler(echoHandler{}, server.HttpHandlerOpts{ODoHKey: kp}))
+	target := httptest.NewTLSServer(targetMux)
+	defer target.Close()
+	defer close(block)
+
+	u, err := NewODoHUpstream(target.URL+"/dns-query", "", target.Client().Transport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func() {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qb, _ := q.Pack()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := u.ExchangeContext(ctx, qb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exchange()
+
+	// The outdated config is still used while the refresh is blocked.
+	u.m.Lock()
+	u.refreshAt = time.Now()
+	u.m.Unlock()
+	for i := 0; i < 3; i++ {
+		exchange()
+	}
+	deadline := time.Now().Add(time.Second)
+	for fetches.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("want 2 config fetches, got %d", n)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// httpConnectDialer dials connections through a http proxy with the
+// CONNECT method. It supports basic auth in the proxy url.
+type httpConnectDialer struct {
+	proxy  *url.URL
+	dialer *net.Dialer
+}
+
+func newHttpConnectDialer(proxyURL string, d *net.Dialer) (*httpConnectDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url, %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme [%s]", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid proxy url, missing host")
+	}
+	return &httpConnectDialer{proxy: u, dialer: d}, nil
+}
+
+func (d *httpConnectDialer) proxyAddr() string {
+	if len(d.proxy.Port()) > 0 {
+		return d.proxy.Host
+	}
+	if d.proxy.Scheme == "https" {
+		return net.JoinHostPort(d.proxy.Hostname(), "443")
+	}
+	return net.JoinHostPort(d.proxy.Hostname(), "80")
+}
+
+// DialContext dials addr (host:port) through the proxy.
+func (d *httpConnectDialer) DialContext(ctx context.Context, addr string) (_ net.Conn, err error) {
+	c, err := d.dialer.DialContext(ctx, "tcp", d.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.Close()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer func() {
+		if !stop() && err == nil {
+			err = context.Cause(ctx)
+		}
+	}()
+
+	if d.proxy.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("proxy tls handshake failed, %w", err)
+		}
+		c = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		p, _ := u.Password()
+		req.SetBasicAuth(u.Username(), p)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(c); err != nil {
+		return nil, fmt.Errorf("failed to write connect request, %w", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connect response, %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy connect failed, %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The server sent data before we did. Keep it.
+		return &bufferedConn{Conn: c, br: br}, nil
+	}
+	return c, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
@@ -0,0 +1,398 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// fakeSocks5 is a minimal socks5 server that only supports UDP ASSOCIATE.
+type fakeSocks5 struct {
+	l       net.Listener
+	relayed atomic.Int64
+}
+
+func newFakeSocks5(t testing.TB) *fakeSocks5 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSocks5{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSocks5) handle(c net.Conn) {
+	defer c.Close()
+	b := make([]byte, 512)
+	if _, err := io.ReadFull(c, b[:3]); err != nil { // greeting with one method
+		return
+	}
+	c.Write([]byte{5, 0})
+	if _, err := io.ReadFull(c, b[:10]); err != nil || b[1] != socks5CmdUDPAssoc {
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	// Reply an unspecified address, which means the server address.
+	reply := []byte{5, 0, 0, socks5AtypIPv4, 0, 0, 0, 0}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+	c.Write(reply)
+
+	go func() {
+		var client netip.AddrPort
+		b := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			if from.Addr().IsLoopback() && from.Port() != 0 && (!client.IsValid() || from == client) {
+				if dst, payload, err := unpackSocks5UDP(b[:n]); err == nil {
+					client = from
+					s.relayed.Add(1)
+					relay.WriteToUDPAddrPort(payload, dst)
+					continue
+				}
+			}
+			// From the destination.
+			h := []byte{0, 0, 0, socks5AtypIPv4}
+			h = append(h, from.Addr().AsSlice()...)
+			h = binary.BigEndian.AppendUint16(h, from.Port())
+			relay.WriteToUDPAddrPort(append(h, b[:n]...), client)
+		}
+	}()
+	io.Copy(io.Discard, c)
+}
+
+// fakeHttpProxy is a http CONNECT proxy with basic auth "u:p".
+func newFakeHttpProxy(t testing.TB) (addr string, connects *atomic.Int64) {
+	connects = new(atomic.Int64)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+		connects.Add(1)
+		c, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(dst, brw)
+			dst.Close()
+		}()
+		io.Copy(c, dst)
+	})}
+	go hs.Serve(l)
+	t.Cleanup(func() { hs.Close() })
+	return l.Addr().String(), connects
+}
+
+type echoHandler struct{}
+
+func (echoHandler) Handle(_ context.Context, q *dns.Msg, _ server.QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := pack(r)
+	return b
+}
+
+func newDoQTestServer(t testing.TB) string {
+	cert, err := utils.GenerateCertificate("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeDoQ(l, echoHandler{}, server.DoQServerOpts{})
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func testExchange(t *testing.T, u Upstream) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	r, err := u.ExchangeContext(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(*r); err != nil || resp.Id != q.Id {
+		t.Fatalf("invalid response, %v", err)
+	}
+}
+
+func Test_socks5UDP(t *testing.T) {
+	s5 := newFakeSocks5(t)
+	udpAddr, shutdown := newUDPTestServer(t, &vServer{})
+	defer shutdown()
+	doqAddr := newDoQTestServer(t)
+
+	for _, addr := range []string{"udp://" + udpAddr, "quic://" + doqAddr} {
+		t.Run(addr, func(t *testing.T) {
+			before := s5.relayed.Load()
+			u, err := NewUpstream(addr, Opt{
+				Socks5:    s5.l.Addr().String(),
+				Socks5UDP: true,
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			testExchange(t, u)
+			if s5.relayed.Load() == before {
+				t.Fatal("query was not relayed by the socks5 server")
+			}
+		})
+	}
+}
+
+func Test_socks5PacketConn_reassociate(t *testing.T) {
+	s5 := newFakeSocks5(t)
+	pc := newSocks5PacketConn(&net.Dialer{}, s5.l.Addr().String())
+	defer pc.Close()
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDPAddrPort(b[:n], from)
+		}
+	}()
+
+	roundTrip := func() {
+		t.Helper()
+		if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second * 2))
+		b := make([]byte, 16)
+		n, _, err := pc.ReadFrom(b)
+		if err != nil || string(b[:n]) != "ping" {
+			t.Fatalf("unexpected read %q, %v", b[:n], err)
+		}
+	}
+	roundTrip()
+
+	// Break the association. The first write fails and drops it, and the
+	// next one should re-associate.
+	pc.m.Lock()
+	a := pc.a
+	pc.m.Unlock()
+	a.ctrl.Close()
+	time.Sleep(time.Millisecond * 50) // wait for a to be closed
+	if _, err := pc.WriteTo([]byte("ping"), echo.LocalAddr()); err == nil {
+		t.Fatal("want write err on a broken association")
+	}
+	roundTrip()
+	if pc.a == a {
+		t.Fatal("association was not renewed")
+	}
+}
+
+func Test_httpProxy(t *testing.T) {
+	proxyAddr, connects := newFakeHttpProxy(t)
+	tcpAddr, shutdown := newTCPTestServer(t, &vServer{})
+	defer shutdown()
+
+	u, err := NewUpstream("tcp://"+tcpAddr, Opt{HTTPProxy: "http://u:p@" + proxyAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	testExchange(t, u)
+	if connects.Load() != 1 {
+		t.Fatalf("want 1 connect, got %d", connects.Load())
+	}
+
+	// Wrong password.
+	d, err := newHttpConnectDialer("http://u:wrong@"+proxyAddr, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), tcpAddr); err == nil {
+		t.Fatal("want auth err")
+	}
+
+	// Not supported by udp based protocols.
+	if _, err := NewUpstream("udp://"+tcpAddr, Opt{HTTPProxy: "http://" + proxyAddr}); err == nil {
+		t.Fatal("want err for udp upstream")
+	}
+}
+
+func Test_httpProxy_odoh(t *testing.T) {
+	proxyAddr, connects := newFakeHttpProxy(t)
+	kp, err := odoh.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetMux := http.NewServeMux()
+	targetMux.Handle(odoh.ConfigsPath, server.ODoHConfigsHandler(kp))
+	targetMux.Handle("/dns-query", server.NewHttpHandler(echoHandler{}, server.HttpHandlerOpts{ODoHKey: kp}))
+	target := httptest.NewTLSServer(targetMux)
+	defer target.Close()
+	relay := httptest.NewTLSServer(server.NewODoHRelay(server.ODoHRelayOpts{
+		Client:         target.Client(),
+		AllowedTargets: []string{target.Listener.Addr().String()},
+	}))
+	defer relay.Close()
+	trustTestRelay(t, relay)
+
+	// Use "localhost" so the relay host differs from the target host.
+	_, relayPort, _ := net.SplitHostPort(relay.Listener.Addr().String())
+	u, err := NewUpstream("odoh://"+target.Listener.Addr().String()+"/dns-query", Opt{
+		HTTPProxy: "http://u:p@" + proxyAddr,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		ODoHProxy: "https://localhost:" + relayPort + "/proxy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	testExchange(t, u)
+	// One connection to the target for the config, one to the relay.
+	if connects.Load() != 2 {
+		t.Fatalf("want 2 connects, got %d", connects.Load())
+	}
+}
+
+// trustTestRelay makes odoh upstreams trust the certificate of relay.
+func trustTestRelay(t *testing.T, relay *httptest.Server) {
+	pool := x509.NewCertPool()
+	pool.AddCert(relay.Certificate())
+	odohRelayTLSConfig = &tls.Config{RootCAs: pool, ServerName: "example.com"}
+	t.Cleanup(func() { odohRelayTLSConfig = nil })
+}
+
+func Test_odoh_spkiPins(t *testing.T) {
+	kp, err := odoh.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := utils.GenerateCertificate("target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetMux := http.NewServeMux()
+	targetMux.Handle(odoh.ConfigsPath, server.ODoHConfigsHandler(kp))
+	targetMux.Handle("/dns-query", server.NewHttpHandler(echoHandler{}, server.HttpHandlerOpts{ODoHKey: kp}))
+	target := httptest.NewUnstartedServer(targetMux)
+	target.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	target.StartTLS()
+	defer target.Close()
+	relay := httptest.NewTLSServer(server.NewODoHRelay(server.ODoHRelayOpts{
+		Client:         &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
+		AllowedTargets: []string{target.Listener.Addr().String()},
+	}))
+	defer relay.Close()
+	trustTestRelay(t, relay)
+
+	// The pin only matches the target. Connections to the relay must not
+	// use it.
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	_, relayPort, _ := net.SplitHostPort(relay.Listener.Addr().String())
+	u, err := NewUpstream("odoh://"+target.Listener.Addr().String()+"/dns-query", Opt{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo) != pin {
+					return errors.New("pin mismatched")
+				}
+				return nil
+			},
+		},
+		ODoHProxy: "https://localhost:" + relayPort + "/proxy",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	testExchange(t, u)
+}
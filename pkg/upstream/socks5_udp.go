@@ -0,0 +1,411 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+)
+
+// SOCKS5 UDP ASSOCIATE (RFC 1928 section 7).
+
+const (
+	socks5Ver            = 5
+	socks5CmdUDPAssoc    = 3
+	socks5AtypIPv4       = 1
+	socks5AtypIPv6       = 4
+	socks5MaxUDPHeader   = 4 + 16 + 2
+	socks5RedialInterval = time.Second
+	socks5DialTimeout    = time.Second * 5
+)
+
+var errSocks5BadPacket = errors.New("invalid socks5 udp packet")
+
+// socks5UDPAssoc is a UDP association. It implements net.PacketConn.
+// The association lives as long as the control connection. Close closes both.
+type socks5UDPAssoc struct {
+	ctrl net.Conn
+	c    net.Conn // udp socket connected to the relay
+
+	rm sync.Mutex
+	rb []byte
+
+	closeOnce sync.Once
+}
+
+var _ net.PacketConn = (*socks5UDPAssoc)(nil)
+
+// dialSocks5UDP creates a UDP association through the socks5 server at
+// proxyAddr. No authentication is supported.
+func dialSocks5UDP(ctx context.Context, d *net.Dialer, proxyAddr string) (_ *socks5UDPAssoc, err error) {
+	ctrl, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			ctrl.Close()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { ctrl.SetDeadline(time.Now()) })
+	relay, err := socks5Associate(ctrl)
+	if !stop() {
+		return nil, context.Cause(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// Relay may reply an unspecified address. RFC 1928 does not define
+	// this, but most servers mean "the same address as the server".
+	if relay.Addr().IsUnspecified() {
+		ta, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, errors.New("cannot determine socks5 relay address")
+		}
+		relay = netip.AddrPortFrom(ta.AddrPort().Addr(), relay.Port())
+	}
+	c, err := d.DialContext(ctx, "udp", relay.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial socks5 relay, %w", err)
+	}
+
+	a := &socks5UDPAssoc{ctrl: ctrl, c: c}
+	go func() {
+		// The association terminates when the control connection closes.
+		_, _ = io.Copy(io.Discard, ctrl)
+		a.Close()
+	}()
+	return a, nil
+}
+
+// socks5Associate sends the UDP ASSOCIATE request and returns the relay
+// address.
+func socks5Associate(c net.Conn) (netip.AddrPort, error) {
+	// Greeting, no authentication.
+	if _, err := c.Write([]byte{socks5Ver, 1, 0}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	b := make([]byte, 4+16+2)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if b[0] != socks5Ver || b[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 server does not accept no authentication method, %d", b[1])
+	}
+
+	// We don't know the client address yet. Send zeros.
+	if _, err := c.Write([]byte{socks5Ver, socks5CmdUDPAssoc, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if b[0] != socks5Ver {
+		return netip.AddrPort{}, fmt.Errorf("invalid socks5 version %d", b[0])
+	}
+	if b[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 udp associate failed, reply code %d", b[1])
+	}
+	var addrLen int
+	switch b[3] {
+	case socks5AtypIPv4:
+		addrLen = 4
+	case socks5AtypIPv6:
+		addrLen = 16
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported socks5 relay address type %d", b[3])
+	}
+	if _, err := io.ReadFull(c, b[:addrLen+2]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, _ := netip.AddrFromSlice(b[:addrLen])
+	return netip.AddrPortFrom(addr.Unmap(), binary.BigEndian.Uint16(b[addrLen:])), nil
+}
+
+func (a *socks5UDPAssoc) ReadFrom(p []byte) (int, net.Addr, error) {
+	a.rm.Lock()
+	defer a.rm.Unlock()
+	if len(a.rb) < len(p)+socks5MaxUDPHeader {
+		a.rb = make([]byte, len(p)+socks5MaxUDPHeader)
+	}
+	for {
+		n, err := a.c.Read(a.rb)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, payload, err := unpackSocks5UDP(a.rb[:n])
+		if err != nil {
+			continue // ignore invalid packets
+		}
+		return copy(p, payload), net.UDPAddrFromAddrPort(addr), nil
+	}
+}
+
+func unpackSocks5UDP(b []byte) (netip.AddrPort, []byte, error) {
+	// RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT(2) DATA
+	if len(b) < 4 || b[2] != 0 { // fragmentation is not supported
+		return netip.AddrPort{}, nil, errSocks5BadPacket
+	}
+	var addrLen int
+	switch b[3] {
+	case socks5AtypIPv4:
+		addrLen = 4
+	case socks5AtypIPv6:
+		addrLen = 16
+	default:
+		return netip.AddrPort{}, nil, errSocks5BadPacket
+	}
+	if len(b) < 4+addrLen+2 {
+		return netip.AddrPort{}, nil, errSocks5BadPacket
+	}
+	addr, _ := netip.AddrFromSlice(b[4 : 4+addrLen])
+	port := binary.BigEndian.Uint16(b[4+addrLen:])
+	return netip.AddrPortFrom(addr.Unmap(), port), b[4+addrLen+2:], nil
+}
+
+func (a *socks5UDPAssoc) WriteTo(p []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported addr type %T", addr)
+	}
+	ap := ua.AddrPort()
+	ip := ap.Addr().Unmap()
+
+	bp := pool.GetBuf(socks5MaxUDPHeader + len(p))
+	defer pool.ReleaseBuf(bp)
+	b := (*bp)[:0]
+	b = append(b, 0, 0, 0)
+	if ip.Is4() {
+		b = append(b, socks5AtypIPv4)
+	} else {
+		b = append(b, socks5AtypIPv6)
+	}
+	b = append(b, ip.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, ap.Port())
+	b = append(b, p...)
+	if _, err := a.c.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *socks5UDPAssoc) Close() error {
+	a.closeOnce.Do(func() {
+		a.ctrl.Close()
+		a.c.Close()
+	})
+	return nil
+}
+
+func (a *socks5UDPAssoc) LocalAddr() net.Addr                { return a.c.LocalAddr() }
+func (a *socks5UDPAssoc) SetDeadline(t time.Time) error      { return a.c.SetDeadline(t) }
+func (a *socks5UDPAssoc) SetReadDeadline(t time.Time) error  { return a.c.SetReadDeadline(t) }
+func (a *socks5UDPAssoc) SetWriteDeadline(t time.Time) error { return a.c.SetWriteDeadline(t) }
+
+// socks5UDPConn is a net.Conn that sends packets to raddr though the
+// association.
+type socks5UDPConn struct {
+	*socks5UDPAssoc
+	raddr *net.UDPAddr
+}
+
+var _ net.Conn = (*socks5UDPConn)(nil)
+
+func (c *socks5UDPConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *socks5UDPConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.raddr)
+}
+
+func (c *socks5UDPConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// socks5PacketConn is a net.PacketConn for quic transports, which are
+// long-lived. It re-associates if the association was broken.
+type socks5PacketConn struct {
+	dial func(ctx context.Context) (*socks5UDPAssoc, error)
+
+	m            sync.Mutex
+	a            *socks5UDPAssoc
+	readDeadline time.Time
+	closed       bool
+	closeNotify  chan struct{}
+}
+
+var _ net.PacketConn = (*socks5PacketConn)(nil)
+
+func newSocks5PacketConn(d *net.Dialer, proxyAddr string) *socks5PacketConn {
+	return &socks5PacketConn{
+		dial: func(ctx context.Context) (*socks5UDPAssoc, error) {
+			return dialSocks5UDP(ctx, d, proxyAddr)
+		},
+		closeNotify: make(chan struct{}),
+	}
+}
+
+// assoc returns the current association or creates a new one.
+func (c *socks5PacketConn) assoc() (*socks5UDPAssoc, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil, net.ErrClosed
+	}
+	if c.a != nil {
+		return c.a, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), socks5DialTimeout)
+	defer cancel()
+	a, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = a.SetReadDeadline(c.readDeadline)
+	c.a = a
+	return a, nil
+}
+
+// drop closes a and removes it if it is the current association.
+func (c *socks5PacketConn) drop(a *socks5UDPAssoc) {
+	c.m.Lock()
+	if c.a == a {
+		c.a = nil
+	}
+	c.m.Unlock()
+	a.Close()
+}
+
+func (c *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		a, err := c.assoc()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return 0, nil, err
+			}
+			if err := c.waitRedial(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		n, addr, err := a.ReadFrom(p)
+		if err == nil {
+			return n, addr, nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, nil, err
+		}
+		c.drop(a)
+	}
+}
+
+// waitRedial waits before the next dial. It returns an error if c was
+// closed or the read deadline exceeded.
+func (c *socks5PacketConn) waitRedial() error {
+	c.m.Lock()
+	d := c.readDeadline
+	c.m.Unlock()
+	wait := socks5RedialInterval
+	if !d.IsZero() {
+		if until := time.Until(d); until < wait {
+			if until <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			wait = until
+		}
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.closeNotify:
+		return net.ErrClosed
+	}
+}
+
+func (c *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	a, err := c.assoc()
+	if err != nil {
+		return 0, err
+	}
+	n, err := a.WriteTo(p, addr)
+	if err != nil {
+		c.drop(a)
+	}
+	return n, err
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.closeNotify)
+		if c.a != nil {
+			c.a.Close()
+			c.a = nil
+		}
+	}
+	return nil
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *socks5PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.readDeadline = t
+	if c.a != nil {
+		return c.a.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *socks5PacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadBuffer is a no-op. It stops quic-go from complaining that the
+// buffer size cannot be set.
+func (c *socks5PacketConn) SetReadBuffer(int) error { return nil }
+
+// SetWriteBuffer is a no-op. See SetReadBuffer.
+func (c *socks5PacketConn) SetWriteBuffer(int) error { return nil }
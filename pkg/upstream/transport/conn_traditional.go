@@ -61,6 +61,8 @@ type TraditionalDnsConn struct {
 	// It can identify c is dead or buggy in some circumstances. e.g. Network is dropped
 	// and the sockets were still open because no fin or rst was received.
 	waitingResp atomic.Bool
+
+	acceptResp func(r []byte) bool // maybe nil
 }
 
 type TraditionalDnsConnOpts struct {
@@ -75,6 +77,11 @@ type TraditionalDnsConnOpts struct {
 	// MaxConcurrentQuery limits the number of maximum concurrent queries
 	// in the connection. Default is defaultTdcMaxConcurrentQuery.
 	MaxConcurrentQuery int
+
+	// AcceptResp, if not nil, is called on every response read from the
+	// connection. Responses it rejects are dropped as if they never arrived,
+	// so the query keeps waiting for its real reply.
+	AcceptResp func(r []byte) bool
 }
 
 func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
@@ -83,6 +90,7 @@ func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
 		isTcp:       opt.WithLengthHeader,
 		closeNotify: make(chan struct{}),
 		queue:       make(map[uint32]chan *[]byte),
+		acceptResp:  opt.AcceptResp,
 	}
 	setDefaultGZ(&dc.idleTimeout, opt.IdleTimeout, defaultIdleTimeout)
 	setDefaultGZ(&dc.maxCq, opt.MaxConcurrentQuery, defaultTdcMaxConcurrentQuery)
@@ -186,6 +194,10 @@ func (dc *TraditionalDnsConn) readLoop() {
 			dc.CloseWithErr(fmt.Errorf("read err, %w", err)) // abort this connection.
 			return
 		}
+		if dc.acceptResp != nil && !dc.acceptResp(*r) {
+			pool.ReleaseBuf(r)
+			continue
+		}
 		dc.waitingResp.Store(false)
 
 		rid := binary.BigEndian.Uint16(*r)
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+)
+
+// cacheBackend stores cached items.
+// Implementations must be safe for concurrent use.
+type cacheBackend interface {
+	// Get returns the item of k. ok is false if k is not found or expired.
+	Get(k key) (v *item, cacheExpirationTime time.Time, ok bool)
+	// Store stores v. It is a noop if cacheExpirationTime is before now.
+	Store(k key, v *item, cacheExpirationTime time.Time)
+	Delete(k key)
+	// Range calls f through all entries. If f returns an error, the same
+	// error will be returned by Range.
+	Range(f func(k key, v *item, cacheExpirationTime time.Time) error) error
+	// Len returns the number of stored entries.
+	Len() int
+	Flush()
+	Close() error
+}
+
+// batchGetter is an optional interface of cacheBackend. Backends that
+// implement it can get multiple items in one round trip.
+type batchGetter interface {
+	// GetBatch returns the items of ks. The item is nil if the key is
+	// not found or expired.
+	GetBatch(ks []key) []*item
+}
+
+// getBatch returns the items of ks from backend.
+func getBatch(backend cacheBackend, ks []key) []*item {
+	if bg, ok := backend.(batchGetter); ok {
+		return bg.GetBatch(ks)
+	}
+	vs := make([]*item, len(ks))
+	for i, k := range ks {
+		vs[i], _, _ = backend.Get(k)
+	}
+	return vs
+}
+
+var _ cacheBackend = (*cache.Cache[key, *item])(nil)
+
+func newMemBackend(size int) *cache.Cache[key, *item] {
+	return cache.New[key, *item](cache.Opts{Size: size})
+}
@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
 	"sync"
@@ -73,18 +74,81 @@ type Args struct {
 	LazyCacheTTL int    `yaml:"lazy_cache_ttl"`
 	DumpFile     string `yaml:"dump_file"`
 	DumpInterval int    `yaml:"dump_interval"`
+
+	// Negative (NXDOMAIN and NODATA) responses are cached for the minimum
+	// of the authority SOA ttl and its MINIMUM field, up to MaxNegativeTTL
+	// (default 300). NegativeTTL is used if the response has no SOA.
+	// Default is 30. Negative values disable caching them.
+	NegativeTTL    int `yaml:"negative_ttl"`
+	MaxNegativeTTL int `yaml:"max_negative_ttl"`
+
+	// ServfailTTL is the ttl of SERVFAIL responses. Default is 5 (RFC 9520).
+	// RefusedTTL is the ttl of REFUSED responses. NoResponseTTL is the ttl
+	// of a SERVFAIL that is cached when there is no response at all.
+	// Negative values (and 0 for RefusedTTL and NoResponseTTL) disable them.
+	ServfailTTL   int `yaml:"servfail_ttl"`
+	RefusedTTL    int `yaml:"refused_ttl"`
+	NoResponseTTL int `yaml:"no_response_ttl"`
+
+	// MinTTL and MaxTTL clamp the ttl of positive and negative responses.
+	// 0 means no limit.
+	MinTTL int `yaml:"min_ttl"`
+	MaxTTL int `yaml:"max_ttl"`
+
+	// ECS enables ECS-aware caching. Responses to queries with ECS (e.g.
+	// added by ecs_handler, which should be placed before this plugin)
+	// are cached per subnet, using the scope prefix length returned by
+	// the upstream (RFC 7871 7.3). ECSMaxSubnets limits the number of
+	// subnet variants stored per name. Default is 16.
+	ECS           bool `yaml:"ecs"`
+	ECSMaxSubnets int  `yaml:"ecs_max_subnets"`
+
+	// Redis stores the cache in redis instead of memory, so it can be shared
+	// by multiple mosdns instances. Format: redis://[user:password@]host:port[/db].
+	// RedisTimeout is the timeout of redis operations in milliseconds. Default is 50.
+	// RedisKeyPrefix is prepended to all redis keys. Default is "mosdns_cache:<tag>:".
+	// RedisL1Size is the size of the in-memory cache in front of redis.
+	// Default is 0, which disables it.
+	// Note that the ecs index is not shared. Instances only find ecs
+	// variants that they have stored or loaded from a dump.
+	Redis          string `yaml:"redis"`
+	RedisTimeout   int    `yaml:"redis_timeout"`
+	RedisKeyPrefix string `yaml:"redis_key_prefix"`
+	RedisL1Size    int    `yaml:"redis_l1_size"`
+
+	// Prefetch refreshes popular entries in the background before they
+	// expire. An entry is refreshed if it is hit in the last PrefetchPercent
+	// percent of its ttl (default 10), and has been hit at least
+	// PrefetchMinHits times (default 2) since it was stored.
+	// PrefetchConcurrency limits the number of concurrent prefetches.
+	// Default is 16.
+	Prefetch            bool `yaml:"prefetch"`
+	PrefetchPercent     int  `yaml:"prefetch_percent"`
+	PrefetchMinHits     int  `yaml:"prefetch_min_hits"`
+	PrefetchConcurrency int  `yaml:"prefetch_concurrency"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultUnsignNum(&a.Size, 1024)
 	utils.SetDefaultUnsignNum(&a.DumpInterval, 600)
+	utils.SetDefaultNum(&a.NegativeTTL, 30)
+	utils.SetDefaultUnsignNum(&a.MaxNegativeTTL, 300)
+	utils.SetDefaultNum(&a.ServfailTTL, 5)
+	utils.SetDefaultUnsignNum(&a.ECSMaxSubnets, 16)
+	utils.SetDefaultUnsignNum(&a.RedisTimeout, 50)
+	utils.SetDefaultUnsignNum(&a.PrefetchPercent, 10)
+	utils.SetDefaultUnsignNum(&a.PrefetchMinHits, 2)
+	utils.SetDefaultUnsignNum(&a.PrefetchConcurrency, 16)
 }
 
 type Cache struct {
 	args *Args
 
 	logger       *zap.Logger
-	backend      *cache.Cache[key, *item]
+	backend      cacheBackend
+	ecsIndex     *ecsIndex                      // nil if ecs is disabled.
+	hits         *cache.Cache[key, *hitCounter] // nil if prefetch is disabled.
+	prefetchSem  chan struct{}
 	lazyUpdateSF singleflight.Group
 	closeOnce    sync.Once
 	closeNotify  chan struct{}
@@ -93,14 +157,23 @@ type Cache struct {
 	queryTotal   prometheus.Counter
 	hitTotal     prometheus.Counter
 	lazyHitTotal prometheus.Counter
-	size         prometheus.GaugeFunc
+	negHitTotal  prometheus.Counter
+	sfHitTotal   prometheus.Counter
+	refHitTotal  prometheus.Counter
+
+	prefetchTotal    prometheus.Counter
+	prefetchHitTotal prometheus.Counter
+	size             prometheus.GaugeFunc
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	c := NewCache(args.(*Args), Opts{
+	c, err := NewCache(args.(*Args), Opts{
 		Logger:     bp.L(),
 		MetricsTag: bp.Tag(),
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
 		return nil, fmt.Errorf("failed to register metrics, %w", err)
@@ -121,7 +194,7 @@ func quickSetupCache(bq sequence.BQ, s string) (any, error) {
 		size = i
 	}
 	// Don't register metrics in quick setup.
-	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()}), nil
+	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()})
 }
 
 type Opts struct {
@@ -129,7 +202,7 @@ type Opts struct {
 	MetricsTag string
 }
 
-func NewCache(args *Args, opts Opts) *Cache {
+func NewCache(args *Args, opts Opts) (*Cache, error) {
 	args.init()
 
 	logger := opts.Logger
@@ -137,7 +210,29 @@ func NewCache(args *Args, opts Opts) *Cache {
 		logger = zap.NewNop()
 	}
 
-	backend := cache.New[key, *item](cache.Opts{Size: args.Size})
+	var backend cacheBackend
+	if len(args.Redis) > 0 {
+		prefix := args.RedisKeyPrefix
+		if len(prefix) == 0 {
+			prefix = "mosdns_cache:"
+			if len(opts.MetricsTag) > 0 {
+				prefix += opts.MetricsTag + ":"
+			}
+		}
+		rb, err := newRedisBackend(redisOpts{
+			URL:     args.Redis,
+			Prefix:  prefix,
+			Timeout: time.Duration(args.RedisTimeout) * time.Millisecond,
+			L1Size:  args.RedisL1Size,
+			Logger:  logger,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backend = rb
+	} else {
+		backend = newMemBackend(args.Size)
+	}
 	lb := map[string]string{"tag": opts.MetricsTag}
 	p := &Cache{
 		args:        args,
@@ -160,6 +255,31 @@ func NewCache(args *Args, opts Opts) *Cache {
 			Help:        "The total number of queries that hit the expired cache",
 			ConstLabels: lb,
 		}),
+		negHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "negative_hit_total",
+			Help:        "The total number of queries that hit a cached NXDOMAIN or NODATA response",
+			ConstLabels: lb,
+		}),
+		sfHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "servfail_hit_total",
+			Help:        "The total number of queries that hit a cached SERVFAIL response",
+			ConstLabels: lb,
+		}),
+		refHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "refused_hit_total",
+			Help:        "The total number of queries that hit a cached REFUSED response",
+			ConstLabels: lb,
+		}),
+		prefetchTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "prefetch_total",
+			Help:        "The total number of issued prefetches",
+			ConstLabels: lb,
+		}),
+		prefetchHitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "prefetch_hit_total",
+			Help:        "The total number of queries that hit an entry refreshed by prefetch",
+			ConstLabels: lb,
+		}),
 		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name:        "size_current",
 			Help:        "Current cache size in records",
@@ -169,16 +289,24 @@ func NewCache(args *Args, opts Opts) *Cache {
 		}),
 	}
 
+	if args.ECS {
+		p.ecsIndex = newEcsIndex(args.Size, args.ECSMaxSubnets, backend)
+	}
+	if args.Prefetch {
+		p.hits = cache.New[key, *hitCounter](cache.Opts{Size: args.Size})
+		p.prefetchSem = make(chan struct{}, args.PrefetchConcurrency)
+	}
+
 	if err := p.loadDump(); err != nil {
 		p.logger.Error("failed to load cache dump", zap.Error(err))
 	}
 	p.startDumpLoop()
 
-	return p
+	return p, nil
 }
 
 func (c *Cache) RegMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.size} {
+	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.negHitTotal, c.sfHitTotal, c.refHitTotal, c.prefetchTotal, c.prefetchHitTotal, c.size} {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
@@ -195,32 +323,136 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 		return next.ExecNext(ctx, qCtx)
 	}
 
-	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	cachedResp, hitKey, v, lazyHit := c.lookup(msgKey, qCtx)
 	if lazyHit {
 		c.lazyHitTotal.Inc()
-		c.doLazyUpdate(msgKey, qCtx, next)
+		c.doLazyUpdate(hitKey, msgKey, qCtx, next)
+	} else if cachedResp != nil && c.prefetchSem != nil {
+		c.checkPrefetch(msgKey, hitKey, v, qCtx, next)
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
+		c.countHit(cachedResp)
 		cachedResp.Id = q.Id // change msg id
 		qCtx.SetResponse(cachedResp)
+		if lazyHit {
+			qCtx.SetEDE(dns.ExtendedErrorCodeStaleAnswer, "")
+		}
 	}
 
 	err := next.ExecNext(ctx, qCtx)
 
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
-		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
+		c.store(msgKey, qCtx)
+	} else if r == nil && cachedResp == nil && c.args.NoResponseTTL > 0 {
+		k, scope, isVariant := c.variantKey(msgKey, qCtx)
+		saveNoRespToCache(k, q, c.backend, c.args.NoResponseTTL)
+		if isVariant {
+			c.ecsIndex.add(msgKey, scope)
+		}
 		c.updatedKey.Add(1)
 	}
 	return err
 }
 
+// lookup looks up the response of qCtx from the cache. If ecs is enabled and
+// the query has ecs, it returns the variant with the longest matching scope.
+// It also returns the key and the item of the hit entry.
+func (c *Cache) lookup(msgKey string, qCtx *query_context.Context) (*dns.Msg, string, *item, bool) {
+	lazyEnabled := c.args.LazyCacheTTL > 0
+	src, ok := c.querySubnet(qCtx)
+	if !ok {
+		r, v, lazyHit := getRespFromCache(msgKey, c.backend, lazyEnabled, expiredMsgTtl)
+		return r, msgKey, v, lazyHit
+	}
+	keys := c.ecsIndex.lookup(msgKey, src)
+	bks := make([]key, len(keys))
+	for i, k := range keys {
+		bks[i] = key(k)
+	}
+	for i, v := range getBatch(c.backend, bks) {
+		k := keys[i]
+		r, v, lazyHit := respFromItem(v, lazyEnabled, expiredMsgTtl)
+		if r != nil {
+			scope := netip.Prefix{}
+			if scopeLen := int(k[len(msgKey)+1]); scopeLen > 0 {
+				scope, _ = src.Addr().Prefix(scopeLen)
+			}
+			r.Extra = append(r.Extra, newECSOpt(src, scope))
+			return r, k, v, lazyHit
+		}
+	}
+	return nil, "", nil, false
+}
+
+// store saves the response of qCtx to the cache.
+func (c *Cache) store(msgKey string, qCtx *query_context.Context) {
+	k, scope, isVariant := c.variantKey(msgKey, qCtx)
+	if saveRespToCache(k, qCtx.R(), c.backend, c.args) {
+		if c.hits != nil {
+			c.hits.Delete(key(k))
+		}
+		if isVariant {
+			c.ecsIndex.add(msgKey, scope)
+		}
+		c.updatedKey.Add(1)
+	}
+}
+
+// variantKey returns the key that the response of qCtx should be stored
+// with and its scope. It returns msgKey and false if ecs is disabled or
+// the query has no ecs.
+func (c *Cache) variantKey(msgKey string, qCtx *query_context.Context) (string, netip.Prefix, bool) {
+	src, ok := c.querySubnet(qCtx)
+	if !ok {
+		return msgKey, netip.Prefix{}, false
+	}
+	scope := 0
+	if ecs := getECS(qCtx.UpstreamOpt()); ecs != nil {
+		scope = int(ecs.SourceScope)
+	}
+	p := ecsScope(src, scope)
+	return ecsKey(msgKey, p), p, true
+}
+
+// querySubnet returns the ecs source subnet of the query. It returns false
+// if ecs is disabled or the query has no valid ecs.
+func (c *Cache) querySubnet(qCtx *query_context.Context) (netip.Prefix, bool) {
+	if c.ecsIndex == nil {
+		return netip.Prefix{}, false
+	}
+	ecs := getECS(qCtx.QOpt())
+	if ecs == nil {
+		return netip.Prefix{}, false
+	}
+	return ecsSource(ecs)
+}
+
+// countHit increases the hit counter of the cached response's kind.
+func (c *Cache) countHit(r *dns.Msg) {
+	switch r.Rcode {
+	case dns.RcodeNameError:
+		c.negHitTotal.Inc()
+	case dns.RcodeSuccess:
+		if len(r.Answer) == 0 {
+			c.negHitTotal.Inc()
+		}
+	case dns.RcodeServerFailure:
+		c.sfHitTotal.Inc()
+	case dns.RcodeRefused:
+		c.refHitTotal.Inc()
+	}
+}
+
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
-// It has an inner singleflight.Group to de-duplicate same msgKey.
-func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
+// It has an inner singleflight.Group to de-duplicate updates of the same hitKey,
+// which is the key of the entry to be updated.
+// The returned channel receives a result when the update is done. Its error
+// is not nil if next failed.
+func (c *Cache) doLazyUpdate(hitKey, msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) <-chan singleflight.Result {
 	qCtxCopy := qCtx.Copy()
 	lazyUpdateFunc := func() (any, error) {
-		defer c.lazyUpdateSF.Forget(msgKey)
+		defer c.lazyUpdateSF.Forget(hitKey)
 		qCtx := qCtxCopy
 
 		c.logger.Debug("start lazy cache update", qCtx.InfoField())
@@ -232,15 +464,13 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 			c.logger.Warn("failed to update lazy cache", qCtx.InfoField(), zap.Error(err))
 		}
 
-		r := qCtx.R()
-		if r != nil {
-			saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-			c.updatedKey.Add(1)
+		if qCtx.R() != nil {
+			c.store(msgKey, qCtx)
 		}
 		c.logger.Debug("lazy cache updated", qCtx.InfoField())
-		return nil, nil
+		return nil, err
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+	return c.lazyUpdateSF.DoChan(hitKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
 func (c *Cache) Close() error {
@@ -250,6 +480,12 @@ func (c *Cache) Close() error {
 	c.closeOnce.Do(func() {
 		close(c.closeNotify)
 	})
+	if c.ecsIndex != nil {
+		_ = c.ecsIndex.close()
+	}
+	if c.hits != nil {
+		_ = c.hits.Close()
+	}
 	return c.backend.Close()
 }
 
@@ -321,6 +557,12 @@ func (c *Cache) Api() *chi.Mux {
 	r := chi.NewRouter()
 	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
 		c.backend.Flush()
+		if c.ecsIndex != nil {
+			c.ecsIndex.flush()
+		}
+		if c.hits != nil {
+			c.hits.Flush()
+		}
 	})
 	r.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("content-type", "application/octet-stream")
@@ -460,6 +702,9 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 				expirationTime: msgExpTime,
 			}
 			c.backend.Store(key(entry.GetKey()), i, cacheExpTime)
+			if c.ecsIndex != nil {
+				c.ecsIndex.addKey(string(entry.GetKey()))
+			}
 		}
 		return nil
 	}
@@ -21,14 +21,27 @@ package cache
 
 import (
 	"bytes"
-	"github.com/miekg/dns"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func Test_cachePlugin_Dump(t *testing.T) {
-	c := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	c, err := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	resp := new(dns.Msg)
 	resp.SetQuestion("test.", dns.TypeA)
@@ -60,3 +73,348 @@ func Test_cachePlugin_Dump(t *testing.T) {
 		t.Fatalf("read err, wrote %d entries, read %d", enw, enr)
 	}
 }
+
+func Test_saveRespToCache_ttl(t *testing.T) {
+	soa := func(ttl, minTtl uint32) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "ns.test.",
+			Mbox:   "mail.test.",
+			Minttl: minTtl,
+		}
+	}
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}
+	}
+	msg := func(rcode int, ans []dns.RR, ns []dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("test.", dns.TypeA)
+		m.Response = true
+		m.Rcode = rcode
+		m.Answer = ans
+		m.Ns = ns
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		args    Args
+		r       *dns.Msg
+		wantTtl time.Duration // 0 means not cached.
+	}{
+		{"nxdomain soa ttl", Args{}, msg(dns.RcodeNameError, nil, []dns.RR{soa(60, 120)}), 60 * time.Second},
+		{"nxdomain soa minimum", Args{}, msg(dns.RcodeNameError, nil, []dns.RR{soa(120, 60)}), 60 * time.Second},
+		{"nxdomain max negative", Args{MaxNegativeTTL: 30}, msg(dns.RcodeNameError, nil, []dns.RR{soa(120, 60)}), 30 * time.Second},
+		{"nxdomain default max negative", Args{}, msg(dns.RcodeNameError, nil, []dns.RR{soa(3600, 3600)}), 300 * time.Second},
+		{"nxdomain no soa", Args{}, msg(dns.RcodeNameError, nil, nil), 30 * time.Second},
+		{"nxdomain no soa disabled", Args{NegativeTTL: -1}, msg(dns.RcodeNameError, nil, nil), 0},
+		{"nxdomain no soa negative_ttl", Args{NegativeTTL: 10}, msg(dns.RcodeNameError, nil, nil), 10 * time.Second},
+		{"nodata soa", Args{}, msg(dns.RcodeSuccess, nil, []dns.RR{soa(60, 20)}), 20 * time.Second},
+		{"nodata min ttl", Args{MinTTL: 40}, msg(dns.RcodeSuccess, nil, []dns.RR{soa(60, 20)}), 40 * time.Second},
+		{"servfail default", Args{}, msg(dns.RcodeServerFailure, nil, nil), 5 * time.Second},
+		{"servfail disabled", Args{ServfailTTL: -1}, msg(dns.RcodeServerFailure, nil, nil), 0},
+		{"refused default", Args{}, msg(dns.RcodeRefused, nil, nil), 0},
+		{"refused", Args{RefusedTTL: 3}, msg(dns.RcodeRefused, nil, nil), 3 * time.Second},
+		{"answer", Args{}, msg(dns.RcodeSuccess, []dns.RR{a(100)}, nil), 100 * time.Second},
+		{"answer max ttl", Args{MaxTTL: 50}, msg(dns.RcodeSuccess, []dns.RR{a(100)}, nil), 50 * time.Second},
+		{"answer min ttl", Args{MinTTL: 200}, msg(dns.RcodeSuccess, []dns.RR{a(100)}, nil), 200 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			args.init()
+			c, err := NewCache(&args, Opts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			msgKey := getMsgKey(tt.r)
+			saved := saveRespToCache(msgKey, tt.r, c.backend, &args)
+			if saved != (tt.wantTtl > 0) {
+				t.Fatalf("saved = %v, want ttl %s", saved, tt.wantTtl)
+			}
+			if !saved {
+				return
+			}
+			v, _, _ := c.backend.Get(key(msgKey))
+			if ttl := v.expirationTime.Sub(v.storedTime); ttl != tt.wantTtl {
+				t.Fatalf("ttl = %s, want %s", ttl, tt.wantTtl)
+			}
+			if args.MaxTTL > 0 && dnsutils.GetMinimalTTL(v.resp) > uint32(args.MaxTTL) {
+				t.Fatalf("record ttl is not clamped, %s", v.resp)
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_noResponse(t *testing.T) {
+	c, err := NewCache(&Args{NoResponseTTL: 10}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.", dns.TypeA)
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: c}}, nil)
+	if err := cw.ExecNext(context.Background(), query_context.NewContext(q)); err != nil {
+		t.Fatal(err)
+	}
+
+	qCtx := query_context.NewContext(q)
+	if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want cached SERVFAIL, got %v", r)
+	}
+}
+
+// ecsUpstream answers A queries that have no response yet with an address
+// that identifies the call, and returns ecs with scope.
+type ecsUpstream struct {
+	calls int
+	scope uint8
+}
+
+func (u *ecsUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if qCtx.R() != nil {
+		return nil
+	}
+	u.calls++
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(10, 0, 0, byte(u.calls)),
+	}}
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	if ecs := getECS(qCtx.QOpt()); ecs != nil {
+		e := *ecs
+		e.SourceScope = u.scope
+		opt.Option = append(opt.Option, &e)
+	}
+	r.Extra = []dns.RR{opt}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_cachePlugin_ecs(t *testing.T) {
+	c, err := NewCache(&Args{ECS: true, ECSMaxSubnets: 2}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	u := new(ecsUpstream)
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: c}, {E: u}}, nil)
+
+	// query returns the answer id and response scope.
+	query := func(subnet string) (byte, uint8) {
+		t.Helper()
+		p := netip.MustParsePrefix(subnet)
+		q := new(dns.Msg)
+		q.SetQuestion("test.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		qCtx.QOpt().Option = append(qCtx.QOpt().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(p.Bits()),
+			Address:       p.Addr().AsSlice(),
+		})
+		if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		ecs := getECS(qCtx.UpstreamOpt())
+		if ecs == nil {
+			t.Fatal("response has no ecs")
+		}
+		return qCtx.R().Answer[0].(*dns.A).A.To4()[3], ecs.SourceScope
+	}
+	check := func(subnet string, wantId byte, wantScope uint8) {
+		t.Helper()
+		id, scope := query(subnet)
+		if id != wantId || scope != wantScope {
+			t.Fatalf("%s: got answer %d scope %d, want answer %d scope %d", subnet, id, scope, wantId, wantScope)
+		}
+	}
+
+	u.scope = 16
+	check("1.2.3.0/24", 1, 16)
+	check("1.2.99.0/24", 1, 16) // hit, same /16
+	check("1.3.0.0/24", 2, 16)  // miss
+
+	u.scope = 24
+	check("1.2.3.0/24", 1, 16) // still hits the /16 entry
+
+	// Longest scope wins.
+	c.backend.Flush()
+	c.ecsIndex.flush()
+	u.scope = 24
+	check("1.2.3.0/24", 3, 24)
+	u.scope = 16
+	check("1.2.4.0/24", 4, 16)
+	check("1.2.3.0/24", 3, 24)
+	check("1.2.5.0/24", 4, 16)
+
+	// Only 2 variants are allowed. The oldest one (1.2.3.0/24) is evicted.
+	u.scope = 24
+	check("1.3.0.0/24", 5, 24)
+	check("1.2.3.0/24", 4, 16)
+
+	// Scope 0 is valid for all subnets.
+	c.backend.Flush()
+	c.ecsIndex.flush()
+	u.scope = 0
+	check("1.2.3.0/24", 6, 0)
+	check("8.8.8.0/24", 6, 0)
+}
+
+func Test_cachePlugin_prefetch(t *testing.T) {
+	c, err := NewCache(&Args{Prefetch: true}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var calls atomic.Int32
+	upstream := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil {
+			return nil
+		}
+		calls.Add(1)
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(1, 2, 3, 4),
+		}}
+		qCtx.SetResponse(r)
+		return nil
+	})
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: c}, {E: upstream}}, nil)
+	exec := func() {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("test.", dns.TypeA)
+		if err := cw.ExecNext(context.Background(), query_context.NewContext(q)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec() // Stores the entry.
+	exec()
+	exec()
+	if calls.Load() != 1 || testutil.ToFloat64(c.prefetchTotal) != 0 {
+		t.Fatal("fresh entry should not be prefetched")
+	}
+
+	// Entry is in the last 10% of its ttl.
+	q := new(dns.Msg)
+	q.SetQuestion("test.", dns.TypeA)
+	msgKey := getMsgKey(q)
+	v, _, _ := c.backend.Get(key(msgKey))
+	now := time.Now()
+	c.backend.Store(key(msgKey), &item{
+		resp:           v.resp,
+		storedTime:     now.Add(-time.Second * 290),
+		expirationTime: now.Add(time.Second * 10),
+	}, now.Add(time.Second*10))
+	c.hits.Delete(key(msgKey)) // As store does.
+
+	exec() // 1st hit of the new entry.
+	if testutil.ToFloat64(c.prefetchTotal) != 0 {
+		t.Fatal("entry is not popular and should not be prefetched")
+	}
+	exec() // 2nd hit.
+	if testutil.ToFloat64(c.prefetchTotal) != 1 {
+		t.Fatal("popular entry is not prefetched")
+	}
+	exec() // Issued.
+	if testutil.ToFloat64(c.prefetchTotal) != 1 {
+		t.Fatal("duplicated prefetch")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(c.prefetchHitTotal) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("prefetched entry is not hit")
+		}
+		time.Sleep(time.Millisecond * 10)
+		exec()
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("want 2 upstream calls, got %d", calls.Load())
+	}
+}
+
+func Test_cachePlugin_prefetchRetry(t *testing.T) {
+	c, err := NewCache(&Args{Prefetch: true, PrefetchMinHits: 1}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var fail atomic.Bool
+	upstream := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil {
+			return nil
+		}
+		if fail.Load() {
+			return errors.New("upstream failed")
+		}
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(1, 2, 3, 4),
+		}}
+		qCtx.SetResponse(r)
+		return nil
+	})
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: c}, {E: upstream}}, nil)
+	q := new(dns.Msg)
+	q.SetQuestion("test.", dns.TypeA)
+	exec := func() {
+		t.Helper()
+		if err := cw.ExecNext(context.Background(), query_context.NewContext(q.Copy())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec() // Stores the entry.
+	msgKey := getMsgKey(q)
+	v, _, _ := c.backend.Get(key(msgKey))
+	now := time.Now()
+	c.backend.Store(key(msgKey), &item{
+		resp:           v.resp,
+		storedTime:     now.Add(-time.Second * 290),
+		expirationTime: now.Add(time.Second * 10),
+	}, now.Add(time.Second*10))
+	c.hits.Delete(key(msgKey))
+
+	fail.Store(true)
+	exec() // Prefetch fails.
+	if testutil.ToFloat64(c.prefetchTotal) != 1 {
+		t.Fatal("popular entry is not prefetched")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		hc, _, _ := c.hits.Get(key(msgKey))
+		if hc != nil && !hc.issued.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed prefetch is not reset")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	fail.Store(false)
+	exec() // Prefetch again.
+	if testutil.ToFloat64(c.prefetchTotal) != 2 {
+		t.Fatal("entry is not prefetched again after a failed prefetch")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsIndexTtl = time.Hour * 24
+
+	ecsFamilyAny = 0 // scope 0, the response is valid for all subnets.
+	ecsFamilyV4  = 1
+	ecsFamilyV6  = 2
+)
+
+// ecsVariants holds the subnet variants of a msg key, oldest first.
+// Scope 0 variant is an invalid (zero) netip.Prefix.
+type ecsVariants struct {
+	sync.Mutex
+	prefixes []netip.Prefix
+}
+
+type ecsIndex struct {
+	maxVariants int
+	backend     cacheBackend
+	m           *cache.Cache[key, *ecsVariants]
+}
+
+func newEcsIndex(size, maxVariants int, backend cacheBackend) *ecsIndex {
+	return &ecsIndex{
+		maxVariants: maxVariants,
+		backend:     backend,
+		m:           cache.New[key, *ecsVariants](cache.Opts{Size: size}),
+	}
+}
+
+// lookup returns the keys of variants that match src, longest scope first.
+// Variants may have been expired in the backend.
+func (idx *ecsIndex) lookup(msgKey string, src netip.Prefix) []string {
+	vs, _, _ := idx.m.Get(key(msgKey))
+	if vs == nil {
+		return nil
+	}
+	vs.Lock()
+	defer vs.Unlock()
+
+	var matched []netip.Prefix
+	for _, p := range vs.prefixes {
+		if !p.IsValid() || (p.Addr().Is4() == src.Addr().Is4() && p.Bits() <= src.Bits() && p.Contains(src.Addr())) {
+			matched = append(matched, p)
+		}
+	}
+
+	keys := make([]string, 0, len(matched))
+	for len(matched) > 0 {
+		longest := 0
+		for i, p := range matched {
+			if p.Bits() > matched[longest].Bits() {
+				longest = i
+			}
+		}
+		keys = append(keys, ecsKey(msgKey, matched[longest]))
+		matched = append(matched[:longest], matched[longest+1:]...)
+	}
+	return keys
+}
+
+// add adds the variant p of msgKey to the index. If msgKey has too many variants, the oldest one will be removed
+// from the cache.
+func (idx *ecsIndex) add(msgKey string, p netip.Prefix) {
+	vs, _, _ := idx.m.Get(key(msgKey))
+	if vs == nil {
+		vs = new(ecsVariants)
+	}
+	idx.m.Store(key(msgKey), vs, time.Now().Add(ecsIndexTtl))
+
+	vs.Lock()
+	defer vs.Unlock()
+	for i, e := range vs.prefixes {
+		if e == p {
+			vs.prefixes = append(vs.prefixes[:i], vs.prefixes[i+1:]...)
+			break
+		}
+	}
+	vs.prefixes = append(vs.prefixes, p)
+	for len(vs.prefixes) > idx.maxVariants {
+		idx.backend.Delete(key(ecsKey(msgKey, vs.prefixes[0])))
+		vs.prefixes = vs.prefixes[1:]
+	}
+}
+
+// addKey adds a key generated by ecsKey to the index. It is a noop if k is
+// not a variant key. Used to rebuild the index from a dump.
+func (idx *ecsIndex) addKey(k string) {
+	if len(k) < 4 {
+		return
+	}
+	n := 4 + int(k[3]) // See getMsgKey.
+	if len(k) < n+2 {
+		return
+	}
+	msgKey, suffix := k[:n], k[n:]
+	var p netip.Prefix
+	switch suffix[0] {
+	case ecsFamilyAny:
+	case ecsFamilyV4, ecsFamilyV6:
+		addr, ok := netip.AddrFromSlice([]byte(suffix[2:]))
+		if !ok || (suffix[0] == ecsFamilyV4) != addr.Is4() {
+			return
+		}
+		p = netip.PrefixFrom(addr, int(suffix[1]))
+		if !p.IsValid() {
+			return
+		}
+	default:
+		return
+	}
+	idx.add(msgKey, p)
+}
+
+func (idx *ecsIndex) flush() {
+	idx.m.Flush()
+}
+
+func (idx *ecsIndex) close() error {
+	return idx.m.Close()
+}
+
+// ecsKey returns the cache key of the variant p of msgKey.
+// Format: msgKey + family + scope prefix length + masked address.
+func ecsKey(msgKey string, p netip.Prefix) string {
+	if !p.IsValid() {
+		return msgKey + string([]byte{ecsFamilyAny, 0})
+	}
+	family := byte(ecsFamilyV6)
+	if p.Addr().Is4() {
+		family = ecsFamilyV4
+	}
+	b := make([]byte, 0, len(msgKey)+2+16)
+	b = append(b, msgKey...)
+	b = append(b, family, byte(p.Bits()))
+	b = append(b, p.Masked().Addr().AsSlice()...)
+	return string(b)
+}
+
+// getECS returns the first EDNS0_SUBNET option in opt. It returns nil if
+// opt is nil or has no ecs.
+func getECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// ecsSource returns the masked source prefix of ecs.
+func ecsSource(ecs *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	var ip net.IP
+	switch ecs.Family {
+	case 1:
+		ip = ecs.Address.To4()
+	case 2:
+		ip = ecs.Address.To16()
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	p, err := addr.Prefix(int(ecs.SourceNetmask))
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+// ecsScope returns the prefix that a response with scope prefix length
+// scope, to a query from src, is valid for.
+// RFC 7871 7.3.1: A scope longer than the source prefix length is treated
+// as the source prefix length. Scope 0 means the response is valid
+// for all clients.
+func ecsScope(src netip.Prefix, scope int) netip.Prefix {
+	if scope <= 0 {
+		return netip.Prefix{}
+	}
+	p, _ := src.Addr().Prefix(min(scope, src.Bits()))
+	return p
+}
+
+// newECSOpt returns an OPT with the ecs of src and the scope of p.
+// It is added to cached responses, so the scope is sent back to the
+// client (e.g. by ecs_handler).
+func newECSOpt(src netip.Prefix, p netip.Prefix) *dns.OPT {
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: uint8(src.Bits()),
+		SourceScope:   uint8(max(p.Bits(), 0)),
+		Address:       src.Addr().AsSlice(),
+	}
+	if src.Addr().Is4() {
+		ecs.Family = 1
+	}
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.Option = []dns.EDNS0{ecs}
+	return opt
+}
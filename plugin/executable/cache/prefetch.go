@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+// hitCounter counts the hits of a cache entry since it was stored.
+type hitCounter struct {
+	hits       atomic.Uint32
+	issued     atomic.Bool // a prefetch of this entry was issued.
+	prefetched bool        // the entry was stored by a prefetch.
+}
+
+// checkPrefetch counts a hit of the entry v, which was hit by hitKey. If the
+// entry is popular and is in the last prefetch_percent of its ttl, checkPrefetch
+// refreshes it in the background.
+func (c *Cache) checkPrefetch(msgKey, hitKey string, v *item, qCtx *query_context.Context, next sequence.ChainWalker) {
+	hc, _, _ := c.hits.Get(key(hitKey))
+	if hc == nil {
+		hc = new(hitCounter)
+		c.hits.Store(key(hitKey), hc, v.expirationTime)
+	}
+	if hc.prefetched {
+		c.prefetchHitTotal.Inc()
+	}
+	if int(hc.hits.Add(1)) < c.args.PrefetchMinHits {
+		return
+	}
+	ttl := v.expirationTime.Sub(v.storedTime)
+	if time.Until(v.expirationTime)*100 > ttl*time.Duration(c.args.PrefetchPercent) {
+		return
+	}
+	if !hc.issued.CompareAndSwap(false, true) {
+		return
+	}
+
+	select {
+	case c.prefetchSem <- struct{}{}:
+	default:
+		hc.issued.Store(false) // Too many prefetches. Try it on next hit.
+		return
+	}
+	c.prefetchTotal.Inc()
+	done := c.doLazyUpdate(hitKey, msgKey, qCtx, next)
+	go func() {
+		res := <-done
+		<-c.prefetchSem
+		if res.Err != nil {
+			hc.issued.Store(false) // Try it again on next hit.
+			return
+		}
+		if nv, _, ok := c.backend.Get(key(hitKey)); ok && !nv.storedTime.Equal(v.storedTime) {
+			c.hits.Store(key(hitKey), &hitCounter{prefetched: true}, nv.expirationTime)
+		}
+	}()
+}
@@ -0,0 +1,376 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	redisScanCount     = 512
+	redisBatchTimeout  = time.Second * 10
+	redisLenInterval   = time.Minute
+	redisItemHeaderLen = 8 + 8 // stored time + msg expiration time
+)
+
+// redisBackend stores items in redis, so they can be shared by multiple
+// mosdns instances. Items are stored in packed wire format with the
+// cache ttl. An optional in-memory l1 cache is placed in front of redis.
+type redisBackend struct {
+	client  *redis.Client
+	prefix  string
+	timeout time.Duration
+	l1      *cache.Cache[key, *item] // nil if l1 is disabled.
+	logger  *zap.Logger
+
+	// n is the number of keys counted by the last scan of lenLoop.
+	n           atomic.Int64
+	closed      atomic.Bool
+	closeNotify chan struct{}
+}
+
+type redisOpts struct {
+	URL     string // redis://<user>:<password>@<host>:<port>/<db_number>
+	Prefix  string
+	Timeout time.Duration
+	L1Size  int // 0 disables l1.
+	Logger  *zap.Logger
+}
+
+func newRedisBackend(opts redisOpts) (*redisBackend, error) {
+	ro, err := redis.ParseURL(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url, %w", err)
+	}
+	b := &redisBackend{
+		client:  redis.NewClient(ro),
+		prefix:  opts.Prefix,
+		timeout: opts.Timeout,
+		logger:  opts.Logger,
+
+		closeNotify: make(chan struct{}),
+	}
+	if opts.L1Size > 0 {
+		b.l1 = newMemBackend(opts.L1Size)
+	}
+	go b.lenLoop()
+	return b, nil
+}
+
+var (
+	_ cacheBackend = (*redisBackend)(nil)
+	_ batchGetter  = (*redisBackend)(nil)
+)
+
+func (b *redisBackend) Get(k key) (*item, time.Time, bool) {
+	if b.l1 != nil {
+		if v, exp, ok := b.l1.Get(k); ok {
+			return v, exp, true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	v, exp, err := b.get(ctx, b.prefix+string(k))
+	if err != nil {
+		b.logger.Warn("failed to get entry from redis", zap.Error(err))
+		return nil, time.Time{}, false
+	}
+	if v == nil {
+		return nil, time.Time{}, false
+	}
+	if b.l1 != nil {
+		b.l1.Store(k, v, exp)
+	}
+	return v, exp, true
+}
+
+// GetBatch implements batchGetter. Keys that are not in l1 are fetched
+// from redis in one round trip.
+func (b *redisBackend) GetBatch(ks []key) []*item {
+	vs := make([]*item, len(ks))
+	var missed []int
+	for i, k := range ks {
+		if b.l1 != nil {
+			if v, _, ok := b.l1.Get(k); ok {
+				vs[i] = v
+				continue
+			}
+		}
+		missed = append(missed, i)
+	}
+	if len(missed) == 0 {
+		return vs
+	}
+
+	rks := make([]string, 0, len(missed))
+	for _, i := range missed {
+		rks = append(rks, b.prefix+string(ks[i]))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	rvs, exps, err := b.getMulti(ctx, rks)
+	if err != nil {
+		b.logger.Warn("failed to get entries from redis", zap.Error(err))
+		return vs
+	}
+	for j, i := range missed {
+		if rvs[j] == nil {
+			continue
+		}
+		vs[i] = rvs[j]
+		if b.l1 != nil {
+			b.l1.Store(ks[i], rvs[j], exps[j])
+		}
+	}
+	return vs
+}
+
+// get returns nil item if rk does not exist.
+func (b *redisBackend) get(ctx context.Context, rk string) (*item, time.Time, error) {
+	vs, exps, err := b.getMulti(ctx, []string{rk})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return vs[0], exps[0], nil
+}
+
+// getMulti gets items of rks in one round trip. Items of keys that do not
+// exist are nil.
+func (b *redisBackend) getMulti(ctx context.Context, rks []string) ([]*item, []time.Time, error) {
+	getCmds := make([]*redis.StringCmd, len(rks))
+	ttlCmds := make([]*redis.DurationCmd, len(rks))
+	_, err := b.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, rk := range rks {
+			getCmds[i] = p.Get(ctx, rk)
+			ttlCmds[i] = p.PTTL(ctx, rk)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, nil, err
+	}
+
+	vs := make([]*item, len(rks))
+	exps := make([]time.Time, len(rks))
+	for i, rk := range rks {
+		data, err := getCmds[i].Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ttl := ttlCmds[i].Val()
+		if ttl <= 0 { // Key has no ttl, or it just expired.
+			continue
+		}
+		v, err := unpackItem(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid entry %q, %w", rk, err)
+		}
+		vs[i], exps[i] = v, time.Now().Add(ttl)
+	}
+	return vs, exps, nil
+}
+
+func (b *redisBackend) Store(k key, v *item, cacheExpirationTime time.Time) {
+	ttl := time.Until(cacheExpirationTime)
+	if ttl <= 0 {
+		return
+	}
+	if b.l1 != nil {
+		b.l1.Store(k, v, cacheExpirationTime)
+	}
+
+	data, err := packItem(v)
+	if err != nil {
+		b.logger.Warn("failed to pack cache entry", zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	if err := b.client.Set(ctx, b.prefix+string(k), data, ttl).Err(); err != nil {
+		b.logger.Warn("failed to store entry in redis", zap.Error(err))
+	}
+}
+
+func (b *redisBackend) Delete(k key) {
+	if b.l1 != nil {
+		b.l1.Delete(k)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	if err := b.client.Del(ctx, b.prefix+string(k)).Err(); err != nil {
+		b.logger.Warn("failed to delete entry from redis", zap.Error(err))
+	}
+}
+
+// scan calls f with batches of keys that have the prefix.
+func (b *redisBackend) scan(f func(ctx context.Context, keys []string) error) error {
+	match := escapeGlob(b.prefix) + "*"
+	var cursor uint64
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), redisBatchTimeout)
+		keys, next, err := b.client.Scan(ctx, cursor, match, redisScanCount).Result()
+		if err == nil && len(keys) > 0 {
+			err = f(ctx, keys)
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Range calls f through all entries in redis. l1 is skipped because
+// it is a subset of redis.
+func (b *redisBackend) Range(f func(k key, v *item, cacheExpirationTime time.Time) error) error {
+	return b.scan(func(ctx context.Context, keys []string) error {
+		vs, exps, err := b.getMulti(ctx, keys)
+		if err != nil {
+			return err
+		}
+		for i, rk := range keys {
+			if vs[i] == nil {
+				continue
+			}
+			if err := f(key(strings.TrimPrefix(rk, b.prefix)), vs[i], exps[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Len returns the number of keys that have the prefix in redis. Keys are
+// counted by a scan every redisLenInterval, so Len is cheap but may be
+// stale, and other data in the same database is not counted.
+func (b *redisBackend) Len() int {
+	return int(b.n.Load())
+}
+
+func (b *redisBackend) lenLoop() {
+	b.refreshLen()
+	ticker := time.NewTicker(redisLenInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closeNotify:
+			return
+		case <-ticker.C:
+			b.refreshLen()
+		}
+	}
+}
+
+// refreshLen counts the keys by scanning. The last count is kept if
+// redis is unavailable.
+func (b *redisBackend) refreshLen() {
+	n := 0
+	err := b.scan(func(_ context.Context, keys []string) error {
+		n += len(keys)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	b.n.Store(int64(n))
+}
+
+// Flush removes all entries that have the prefix from redis.
+func (b *redisBackend) Flush() {
+	if b.l1 != nil {
+		b.l1.Flush()
+	}
+	err := b.scan(func(ctx context.Context, keys []string) error {
+		return b.client.Del(ctx, keys...).Err()
+	})
+	if err != nil {
+		b.logger.Warn("failed to flush redis", zap.Error(err))
+	}
+}
+
+func (b *redisBackend) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		close(b.closeNotify)
+	}
+	if b.l1 != nil {
+		_ = b.l1.Close()
+	}
+	return b.client.Close()
+}
+
+// packItem packs v into stored time (unix milli, 8 bytes) + msg expiration
+// time (unix milli, 8 bytes) + msg in wire format.
+func packItem(v *item) ([]byte, error) {
+	msg, err := v.resp.Pack()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, redisItemHeaderLen, redisItemHeaderLen+len(msg))
+	binary.BigEndian.PutUint64(b[0:8], uint64(v.storedTime.UnixMilli()))
+	binary.BigEndian.PutUint64(b[8:16], uint64(v.expirationTime.UnixMilli()))
+	return append(b, msg...), nil
+}
+
+func unpackItem(b []byte) (*item, error) {
+	if len(b) < redisItemHeaderLen {
+		return nil, errors.New("entry is too short")
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(b[redisItemHeaderLen:]); err != nil {
+		return nil, err
+	}
+	return &item{
+		resp:           resp,
+		storedTime:     time.UnixMilli(int64(binary.BigEndian.Uint64(b[0:8]))),
+		expirationTime: time.UnixMilli(int64(binary.BigEndian.Uint64(b[8:16]))),
+	}, nil
+}
+
+// escapeGlob escapes redis glob-style pattern special characters in s.
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '?', '[', ']', '\\', '^', '-':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+)
+
+func newTestRedisCache(t *testing.T, mr *miniredis.Miniredis, args Args) *Cache {
+	t.Helper()
+	args.Redis = "redis://" + mr.Addr()
+	args.RedisTimeout = 1000
+	c, err := NewCache(&args, Opts{MetricsTag: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testItem(storedTime, expirationTime time.Time) *item {
+	resp := new(dns.Msg)
+	resp.SetQuestion("test.", dns.TypeA)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{1, 2, 3, 4},
+	}}
+	return &item{resp: resp, storedTime: storedTime, expirationTime: expirationTime}
+}
+
+func Test_redisBackend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestRedisCache(t, mr, Args{})
+	b := c.backend
+
+	now := time.Now()
+	b.Store("k", testItem(now, now.Add(time.Minute)), now.Add(time.Minute))
+	if !mr.Exists("mosdns_cache:test:k") {
+		t.Fatalf("key is not stored with prefix, keys: %v", mr.Keys())
+	}
+	v, exp, ok := b.Get("k")
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	if v.resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" || v.expirationTime.UnixMilli() != now.Add(time.Minute).UnixMilli() {
+		t.Fatalf("unexpected item %v", v)
+	}
+	if d := time.Until(exp); d <= 0 || d > time.Minute {
+		t.Fatalf("unexpected cache expiration time %s", exp)
+	}
+	// Keys without the prefix are not counted.
+	mr.Set("other", "v")
+	b.(*redisBackend).refreshLen()
+	if l := b.Len(); l != 1 {
+		t.Fatalf("want len 1, got %d", l)
+	}
+
+	// Expired in redis.
+	mr.FastForward(time.Minute)
+	if _, _, ok := b.Get("k"); ok {
+		t.Fatal("expired entry is returned")
+	}
+
+	// Flush only removes keys with the prefix.
+	mr.Set("other", "v")
+	b.Store("k", testItem(now, now.Add(time.Minute)), now.Add(time.Minute))
+	b.Flush()
+	if keys := mr.Keys(); len(keys) != 1 || keys[0] != "other" {
+		t.Fatalf("unexpected keys after flush %v", keys)
+	}
+}
+
+func Test_redisBackend_l1(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestRedisCache(t, mr, Args{RedisL1Size: 16})
+
+	now := time.Now()
+	c.backend.Store("k", testItem(now, now.Add(time.Minute)), now.Add(time.Minute))
+	mr.FlushAll()
+	if _, _, ok := c.backend.Get("k"); !ok {
+		t.Fatal("l1 miss")
+	}
+}
+
+func Test_redisBackend_GetBatch(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestRedisCache(t, mr, Args{RedisL1Size: 16})
+	b := c.backend.(*redisBackend)
+
+	now := time.Now()
+	b.Store("k1", testItem(now, now.Add(time.Minute)), now.Add(time.Minute))
+	b.Store("k2", testItem(now, now.Add(time.Minute)), now.Add(time.Minute))
+	b.l1.Delete("k2") // k1 is from l1, k2 is from redis.
+	vs := b.GetBatch([]key{"k1", "missing", "k2"})
+	if vs[0] == nil || vs[1] != nil || vs[2] == nil {
+		t.Fatalf("unexpected items %v", vs)
+	}
+	if _, _, ok := b.l1.Get("k2"); !ok {
+		t.Fatal("k2 is not stored in l1")
+	}
+}
+
+func Test_cachePlugin_redisShared(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c1 := newTestRedisCache(t, mr, Args{})
+	c2 := newTestRedisCache(t, mr, Args{})
+
+	calls := 0
+	upstream := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		if qCtx.R() != nil {
+			return nil
+		}
+		calls++
+		qCtx.SetResponse(testItem(time.Time{}, time.Time{}).resp)
+		return nil
+	})
+	exec := func(c *Cache) {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion("test.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: c}, {E: upstream}}, nil)
+		if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		if qCtx.R() == nil || len(qCtx.R().Answer) != 1 {
+			t.Fatalf("unexpected response %v", qCtx.R())
+		}
+	}
+	exec(c1)
+	exec(c2) // Warmed by c1.
+	if calls != 1 {
+		t.Fatalf("want 1 upstream call, got %d", calls)
+	}
+}
+
+func Test_cachePlugin_redisLazy(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestRedisCache(t, mr, Args{LazyCacheTTL: 3600})
+
+	now := time.Now()
+	c.backend.Store("k", testItem(now.Add(-time.Minute), now.Add(-time.Second)), now.Add(time.Hour))
+	r, _, lazyHit := getRespFromCache("k", c.backend, true, expiredMsgTtl)
+	if r == nil || !lazyHit {
+		t.Fatalf("want lazy hit, got %v, %v", r, lazyHit)
+	}
+}
+
+func Test_cachePlugin_redisDump(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := newTestRedisCache(t, mr, Args{})
+
+	now := time.Now()
+	for _, k := range []key{"a", "b", "c"} {
+		c.backend.Store(k, testItem(now, now.Add(time.Minute)), now.Add(time.Minute))
+	}
+	buf := new(bytes.Buffer)
+	enw, err := c.writeDump(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.backend.Flush()
+	enr, err := c.readDump(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enw != 3 || enr != 3 {
+		t.Fatalf("wrote %d entries, read %d", enw, enr)
+	}
+	if _, _, ok := c.backend.Get("b"); !ok {
+		t.Fatal("entry is not loaded")
+	}
+}
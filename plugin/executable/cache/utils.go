@@ -23,7 +23,6 @@ import (
 	"hash/maphash"
 	"time"
 
-	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/miekg/dns"
@@ -129,14 +128,19 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
-// getRespFromCache returns the cached response from cache.
+// getRespFromCache returns the cached response from cache and its item.
 // The ttl of returned msg will be changed properly.
 // Returned bool indicates whether this response is hit by lazy cache.
 // Note: Caller SHOULD change the msg id because it's not same as query's.
-func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, bool) {
+func getRespFromCache(msgKey string, backend cacheBackend, lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, *item, bool) {
 	// Lookup cache
 	v, _, _ := backend.Get(key(msgKey))
+	return respFromItem(v, lazyCacheEnabled, lazyTtl)
+}
 
+// respFromItem returns a copy of the response in v with its ttl updated.
+// v may be nil.
+func respFromItem(v *item, lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, *item, bool) {
 	// Cache hit
 	if v != nil {
 		now := time.Now()
@@ -145,7 +149,7 @@ func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCache
 		if now.Before(v.expirationTime) {
 			r := v.resp.Copy()
 			dnsutils.SubtractTTL(r, uint32(now.Sub(v.storedTime).Seconds()))
-			return r, false
+			return r, v, false
 		}
 
 		// Msg expired but cache isn't. This is a lazy cache enabled entry.
@@ -153,40 +157,44 @@ func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCache
 		if lazyCacheEnabled {
 			r := v.resp.Copy()
 			dnsutils.SetTTL(r, uint32(lazyTtl))
-			return r, true
+			return r, v, true
 		}
 	}
 
 	// cache miss
-	return nil, false
+	return nil, nil, false
 }
 
 // saveRespToCache saves r to cache backend. It returns false if r
 // should not be cached and was skipped.
-func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item], lazyCacheTtl int) bool {
+func saveRespToCache(msgKey string, r *dns.Msg, backend cacheBackend, args *Args) bool {
 	if r.Truncated != false {
 		return false
 	}
 
 	var msgTtl time.Duration
 	var cacheTtl time.Duration
+	clamp := false
 	switch r.Rcode {
 	case dns.RcodeNameError:
-		msgTtl = time.Second * 30
+		msgTtl = negativeTtl(r, args)
 		cacheTtl = msgTtl
+		clamp = true
 	case dns.RcodeServerFailure:
-		msgTtl = time.Second * 5
+		msgTtl = time.Duration(args.ServfailTTL) * time.Second
+		cacheTtl = msgTtl
+	case dns.RcodeRefused:
+		msgTtl = time.Duration(args.RefusedTTL) * time.Second
 		cacheTtl = msgTtl
 	case dns.RcodeSuccess:
-		minTTL := dnsutils.GetMinimalTTL(r)
-		if len(r.Answer) == 0 { // Empty answer. Set ttl between 0~300.
-			const maxEmtpyAnswerTtl = 300
-			msgTtl = time.Duration(min(minTTL, maxEmtpyAnswerTtl)) * time.Second
+		clamp = true
+		if len(r.Answer) == 0 { // NODATA
+			msgTtl = negativeTtl(r, args)
 			cacheTtl = msgTtl
 		} else {
-			msgTtl = time.Duration(minTTL) * time.Second
-			if lazyCacheTtl > 0 {
-				cacheTtl = time.Duration(lazyCacheTtl) * time.Second
+			msgTtl = clampTtl(time.Duration(dnsutils.GetMinimalTTL(r))*time.Second, args)
+			if args.LazyCacheTTL > 0 {
+				cacheTtl = time.Duration(args.LazyCacheTTL) * time.Second
 			} else {
 				cacheTtl = msgTtl
 			}
@@ -197,11 +205,72 @@ func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item]
 	}
 
 	now := time.Now()
+	resp := copyNoOpt(r)
+	if clamp {
+		if args.MinTTL > 0 {
+			dnsutils.ApplyMinimalTTL(resp, uint32(args.MinTTL))
+		}
+		if args.MaxTTL > 0 {
+			dnsutils.ApplyMaximumTTL(resp, uint32(args.MaxTTL))
+		}
+	}
 	v := &item{
-		resp:           copyNoOpt(r),
+		resp:           resp,
 		storedTime:     now,
 		expirationTime: now.Add(msgTtl),
 	}
 	backend.Store(key(msgKey), v, now.Add(cacheTtl))
 	return true
 }
+
+// saveNoRespToCache caches a SERVFAIL response for q, which had no
+// response at all, for ttl seconds.
+func saveNoRespToCache(msgKey string, q *dns.Msg, backend cacheBackend, ttl int) {
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeServerFailure)
+	now := time.Now()
+	exp := now.Add(time.Duration(ttl) * time.Second)
+	v := &item{
+		resp:           copyNoOpt(r),
+		storedTime:     now,
+		expirationTime: exp,
+	}
+	backend.Store(key(msgKey), v, exp)
+}
+
+// negativeTtl returns the ttl of a negative (NXDOMAIN or NODATA) response.
+// RFC 2308 5: The TTL of a negative answer is the minimum of the SOA
+// record's TTL and the SOA MINIMUM field. Responses without SOA use
+// args.NegativeTTL.
+func negativeTtl(r *dns.Msg, args *Args) time.Duration {
+	ttl := -1
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = int(min(soa.Hdr.Ttl, soa.Minttl))
+			break
+		}
+	}
+	if ttl < 0 {
+		ttl = args.NegativeTTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	ttl = min(ttl, args.MaxNegativeTTL)
+	return clampTtl(time.Duration(ttl)*time.Second, args)
+}
+
+// clampTtl applies min_ttl and max_ttl to ttl. A zero ttl is kept
+// as zero, which means the response is not cacheable.
+func clampTtl(ttl time.Duration, args *Args) time.Duration {
+	if ttl <= 0 {
+		return 0
+	}
+	if args.MinTTL > 0 {
+		ttl = max(ttl, time.Duration(args.MinTTL)*time.Second)
+	}
+	if args.MaxTTL > 0 {
+		ttl = min(ttl, time.Duration(args.MaxTTL)*time.Second)
+	}
+	return ttl
+}
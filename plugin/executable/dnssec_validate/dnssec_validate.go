@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnssec"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnssec_validate"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+const (
+	modeEnforce = "enforce"
+	modeLog     = "log"
+	modeStrip   = "strip"
+)
+
+var _ sequence.RecursiveExecutable = (*DnssecValidate)(nil)
+
+type Args struct {
+	// Mode is one of
+	// "enforce" (default): bogus responses are replaced by SERVFAIL with
+	// an Extended DNS Error.
+	// "log": bogus responses are logged and passed without AD bit.
+	// "strip": no validation. Only strips DNSSEC records for clients
+	// without DO bit.
+	// In all modes, RRSIG, NSEC and NSEC3 records are removed from
+	// responses to clients without DO bit.
+	Mode string `yaml:"mode"`
+
+	// TrustAnchors are DS records of the root zone in presentation
+	// format. Default is the IANA root trust anchors.
+	TrustAnchors []string `yaml:"trust_anchors"`
+
+	// CacheSize is the size of the validated zone key cache.
+	CacheSize int `yaml:"cache_size"`
+}
+
+// DnssecValidate validates responses from the following executables.
+// DNSKEY and DS records are also fetched through them.
+type DnssecValidate struct {
+	mode   string
+	v      *dnssec.Validator // nil in strip mode
+	logger *zap.Logger
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewDnssecValidate(args.(*Args), bp.L())
+}
+
+// QuickSetup format: [enforce|log|strip]
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	return NewDnssecValidate(&Args{Mode: strings.TrimSpace(s)}, bq.L())
+}
+
+func NewDnssecValidate(args *Args, logger *zap.Logger) (*DnssecValidate, error) {
+	mode := args.Mode
+	switch mode {
+	case "":
+		mode = modeEnforce
+	case modeEnforce, modeLog, modeStrip:
+	default:
+		return nil, fmt.Errorf("invalid mode %s", mode)
+	}
+
+	d := &DnssecValidate{mode: mode, logger: logger}
+	if mode == modeStrip {
+		return d, nil
+	}
+
+	var anchors []*dns.DS
+	for _, s := range args.TrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %s, %w", s, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %s is not a DS record", s)
+		}
+		anchors = append(anchors, ds)
+	}
+	v, err := dnssec.NewValidator(dnssec.Opts{TrustAnchors: anchors, CacheSize: args.CacheSize})
+	if err != nil {
+		return nil, err
+	}
+	d.v = v
+	return d, nil
+}
+
+func (d *DnssecValidate) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	clientOpt := qCtx.ClientOpt()
+	clientDo := clientOpt != nil && clientOpt.Do()
+	clientCd := q.CheckingDisabled
+	clientAd := q.AuthenticatedData
+
+	if d.v != nil {
+		qCtx.QOpt().SetDo()
+		q.CheckingDisabled = true
+	}
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+
+	// If the client sets CD bit, it will validate the response itself.
+	if d.v != nil && !clientCd {
+		r.AuthenticatedData = false
+		res, err := d.v.Validate(ctx, qCtx.QQuestion(), r, subQueryExchange(qCtx, next))
+		switch res {
+		case dnssec.Secure:
+			// RFC 6840 5.8.
+			r.AuthenticatedData = clientDo || clientAd
+		case dnssec.Bogus:
+			d.logger.Warn("bogus response", qCtx.InfoField(), zap.Error(err))
+			if d.mode == modeEnforce {
+				code := dns.ExtendedErrorCodeDNSSECIndeterminate
+				var ve *dnssec.Error
+				if errors.As(err, &ve) {
+					code = ve.Code
+				}
+				resp := new(dns.Msg)
+				resp.SetRcode(q, dns.RcodeServerFailure)
+				qCtx.SetResponse(resp)
+				qCtx.SetEDE(code, err.Error())
+				return nil
+			}
+		}
+	}
+
+	if !clientDo {
+		stripDNSSEC(r, qCtx.QQuestion().Qtype)
+	}
+	return nil
+}
+
+func (d *DnssecValidate) Close() error {
+	if d.v != nil {
+		return d.v.Close()
+	}
+	return nil
+}
+
+var errNoResponse = errors.New("no response")
+
+// subQueryExchange returns a dnssec.ExchangeFunc that sends queries
+// through next.
+func subQueryExchange(qCtx *query_context.Context, next sequence.ChainWalker) dnssec.ExchangeFunc {
+	return func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		subCtx := query_context.NewContext(q)
+		subCtx.ServerMeta = qCtx.ServerMeta
+		subCtx.QOpt().SetDo()
+		subCtx.Q().CheckingDisabled = true
+		if err := next.ExecNext(ctx, subCtx); err != nil {
+			return nil, err
+		}
+		if subCtx.R() == nil {
+			return nil, errNoResponse
+		}
+		return subCtx.R(), nil
+	}
+}
+
+// stripDNSSEC removes DNSSEC records that are not queried explicitly
+// (RFC 4035 3.2.1).
+func stripDNSSEC(m *dns.Msg, qtype uint16) {
+	m.Answer = filterDNSSEC(m.Answer, qtype)
+	m.Ns = filterDNSSEC(m.Ns, 0)
+	m.Extra = filterDNSSEC(m.Extra, 0)
+}
+
+func filterDNSSEC(rrs []dns.RR, keep uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != keep {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
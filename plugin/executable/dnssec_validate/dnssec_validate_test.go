@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func Test_DnssecValidate(t *testing.T) {
+	// The root DNSKEY is not signed, so every response is bogus.
+	rootKey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	if _, err := rootKey.Generate(256); err != nil {
+		t.Fatal(err)
+	}
+	upstream := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		q := qCtx.Q()
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.AuthenticatedData = true
+		switch q.Question[0].Qtype {
+		case dns.TypeDNSKEY:
+			r.Answer = []dns.RR{dns.Copy(rootKey)}
+		case dns.TypeA:
+			a, _ := dns.NewRR("example. 60 IN A 192.0.2.1")
+			sig, _ := dns.NewRR("example. 60 IN RRSIG A 13 1 60 20300101000000 20200101000000 1 . AAAA")
+			r.Answer = []dns.RR{a, sig}
+		}
+		qCtx.SetResponse(r)
+		return nil
+	})
+	chain := []*sequence.ChainNode{{E: upstream}}
+
+	newQuery := func(do, cd bool) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.", dns.TypeA)
+		q.SetEdns0(1232, do)
+		q.CheckingDisabled = cd
+		return query_context.NewContext(q)
+	}
+	hasRRSIG := func(m *dns.Msg) bool {
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		do, cd    bool
+		wantRcode int
+		wantEDE   uint16
+		wantAD    bool
+		wantSig   bool
+	}{
+		{name: "enforce", mode: modeEnforce, do: true, wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeRRSIGsMissing},
+		{name: "log", mode: modeLog, do: true, wantRcode: dns.RcodeSuccess, wantSig: true},
+		{name: "log no do", mode: modeLog, wantRcode: dns.RcodeSuccess},
+		{name: "client cd", mode: modeEnforce, do: true, cd: true, wantRcode: dns.RcodeSuccess, wantAD: true, wantSig: true},
+		{name: "strip", mode: modeStrip, wantRcode: dns.RcodeSuccess, wantAD: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDnssecValidate(&Args{Mode: tt.mode, TrustAnchors: []string{rootKey.ToDS(dns.SHA256).String()}}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			qCtx := newQuery(tt.do, tt.cd)
+			if err := d.Exec(context.Background(), qCtx, sequence.NewChainWalker(chain, nil)); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %d, want %d", r.Rcode, tt.wantRcode)
+			}
+			if r.AuthenticatedData != tt.wantAD {
+				t.Fatalf("AD = %v, want %v", r.AuthenticatedData, tt.wantAD)
+			}
+			if got := hasRRSIG(r); got != tt.wantSig {
+				t.Fatalf("has RRSIG = %v, want %v", got, tt.wantSig)
+			}
+			if tt.wantEDE != 0 {
+				var code uint16
+				for _, o := range qCtx.RespOpt().Option {
+					if ede, ok := o.(*dns.EDNS0_EDE); ok {
+						code = ede.InfoCode
+					}
+				}
+				if code != tt.wantEDE {
+					t.Fatalf("EDE = %d, want %d", code, tt.wantEDE)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ede
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "ede"
+
+func init() {
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Executable = (*EDE)(nil)
+
+// EDE attaches an Extended DNS Error (RFC 8914) to the response.
+type EDE struct {
+	code uint16
+	text string
+}
+
+// QuickSetup format: [code] [text]
+// code can be a number or a name, e.g. "15" and "blocked". Spaces in
+// names should be replaced by "_", e.g. "stale_answer".
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	codeStr, text, _ := strings.Cut(strings.TrimSpace(s), " ")
+	code, err := parseCode(codeStr)
+	if err != nil {
+		return nil, err
+	}
+	return &EDE{code: code, text: strings.TrimSpace(text)}, nil
+}
+
+func parseCode(s string) (uint16, error) {
+	if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	name := strings.ReplaceAll(s, "_", " ")
+	for code, codeName := range dns.ExtendedErrorCodeToString {
+		if strings.EqualFold(name, codeName) {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid ede code [%s]", s)
+}
+
+func (e *EDE) Exec(_ context.Context, qCtx *query_context.Context) error {
+	qCtx.SetEDE(e.code, e.text)
+	return nil
+}
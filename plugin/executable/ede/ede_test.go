@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package ede
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func TestQuickSetup(t *testing.T) {
+	tests := []struct {
+		s        string
+		wantCode uint16
+		wantText string
+		wantErr  bool
+	}{
+		{"15", dns.ExtendedErrorCodeBlocked, "", false},
+		{"blocked", dns.ExtendedErrorCodeBlocked, "", false},
+		{"Stale_Answer", dns.ExtendedErrorCodeStaleAnswer, "", false},
+		{"filtered  by policy ", dns.ExtendedErrorCodeFiltered, "by policy", false},
+		{"65535 text", 65535, "text", false},
+		{"no_such_code", 0, "", true},
+		{"65536", 0, "", true},
+		{"", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			v, err := QuickSetup(nil, tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("QuickSetup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.", dns.TypeA)
+			q.SetEdns0(1232, false)
+			qCtx := query_context.NewContext(q)
+			if err := v.(*EDE).Exec(context.Background(), qCtx); err != nil {
+				t.Fatal(err)
+			}
+			var ede *dns.EDNS0_EDE
+			for _, o := range qCtx.RespOpt().Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+			if ede == nil || ede.InfoCode != tt.wantCode || ede.ExtraText != tt.wantText {
+				t.Fatalf("unexpected ede %v, want code %d text %q", ede, tt.wantCode, tt.wantText)
+			}
+		})
+	}
+}
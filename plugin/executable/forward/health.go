@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxFails         = 3
+	defaultEjectTime        = 10  // seconds
+	defaultMaxEjectTime     = 300 // seconds
+	defaultHealthCheckQuery = ". NS"
+)
+
+type healthOpts struct {
+	maxFails     int
+	ejectTime    time.Duration
+	maxEjectTime time.Duration
+}
+
+// health tracks the health status of an upstream. An upstream will be
+// ejected after maxFails consecutive failures. The ejection time doubles
+// every time the upstream is ejected again without a success in between.
+type health struct {
+	opts *healthOpts // nil if health check is disabled.
+
+	m            sync.Mutex
+	fails        int // consecutive failures
+	ejections    int // consecutive ejections
+	ejectedUntil time.Time
+}
+
+func (h *health) report(ok bool) {
+	if h.opts == nil {
+		return
+	}
+	now := time.Now()
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	ejected := now.Before(h.ejectedUntil)
+	if ok {
+		h.fails = 0
+		if !ejected {
+			h.ejections = 0
+		}
+		return
+	}
+
+	h.fails++
+	if h.fails >= h.opts.maxFails && !ejected {
+		d := h.opts.ejectTime
+		for i := 0; i < h.ejections && d < h.opts.maxEjectTime; i++ {
+			d *= 2
+		}
+		if d > h.opts.maxEjectTime {
+			d = h.opts.maxEjectTime
+		}
+		h.ejectedUntil = now.Add(d)
+		h.ejections++
+		h.fails = 0
+	}
+}
+
+func (h *health) healthy() bool {
+	if h.opts == nil {
+		return true
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	return !time.Now().Before(h.ejectedUntil)
+}
+
+type healthStatus struct {
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+}
+
+func (h *health) status() healthStatus {
+	h.m.Lock()
+	defer h.m.Unlock()
+	s := healthStatus{
+		Healthy:             h.opts == nil || !time.Now().Before(h.ejectedUntil),
+		ConsecutiveFailures: h.fails,
+		Ejections:           h.ejections,
+	}
+	if !s.Healthy {
+		t := h.ejectedUntil
+		s.EjectedUntil = &t
+	}
+	return s
+}
+
+// healthyUpstreams returns the healthy upstreams in us.
+// If no upstream is healthy, it returns us.
+func healthyUpstreams(us []*upstreamWrapper) []*upstreamWrapper {
+	n := 0
+	for _, u := range us {
+		if u.health.healthy() {
+			n++
+		}
+	}
+	if n == len(us) || n == 0 {
+		return us
+	}
+	hus := make([]*upstreamWrapper, 0, n)
+	for _, u := range us {
+		if u.health.healthy() {
+			hus = append(hus, u)
+		}
+	}
+	return hus
+}
+
+// parseProbeQuery parses the probe query from s.
+// Format: "name [qtype]", e.g. "example.com A". qtype defaults to A.
+func parseProbeQuery(s string) (*dns.Msg, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 || len(f) > 2 {
+		return nil, fmt.Errorf("invalid health check query [%s]", s)
+	}
+	qtype := dns.TypeA
+	if len(f) == 2 {
+		t, ok := utils.ParseNameOrNum(strings.ToUpper(f[1]), dns.StringToType)
+		if !ok {
+			return nil, fmt.Errorf("invalid qtype %s", f[1])
+		}
+		qtype = t
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(f[0]), qtype)
+	q.RecursionDesired = true
+	return q, nil
+}
+
+// startHealthCheck probes all upstreams every interval until f is closed.
+func (f *Forward) startHealthCheck(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, u := range f.us {
+					go f.probe(u)
+				}
+			case <-f.closeNotify:
+				return
+			}
+		}
+	}()
+}
+
+// probe sends the probe query to the upstream and reports the result.
+// A response that is not a SERVFAIL is considered as a success.
+func (f *Forward) probe(u *upstreamWrapper) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	q := u.probeQuery.Copy()
+	q.Id = dns.Id()
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		f.logger.Error("failed to pack probe query", zap.Error(err))
+		return
+	}
+	defer pool.ReleaseBuf(b)
+
+	respPayload, err := u.u.ExchangeContext(ctx, *b)
+	if err == nil {
+		r := new(dns.Msg)
+		err = r.Unpack(*respPayload)
+		pool.ReleaseBuf(respPayload)
+		if err == nil && r.Rcode == dns.RcodeServerFailure {
+			err = fmt.Errorf("probe got rcode %s", dns.RcodeToString[r.Rcode])
+		}
+	}
+	if err != nil {
+		f.logger.Debug("upstream health probe failed", zap.String("upstream", u.name()), zap.Error(err))
+	}
+	u.health.report(err == nil)
+}
+
+type upstreamInfo struct {
+	Name      string  `json:"name"`
+	Addr      string  `json:"addr"`
+	RttEWMAMs float64 `json:"rtt_ewma_ms"`
+	healthStatus
+}
+
+func (f *Forward) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/upstreams", func(w http.ResponseWriter, req *http.Request) {
+		infos := make([]upstreamInfo, 0, len(f.us))
+		for _, u := range f.us {
+			infos = append(infos, upstreamInfo{
+				Name:         u.name(),
+				Addr:         u.cfg.Addr,
+				RttEWMAMs:    float64(u.rttEWMA()) / float64(time.Millisecond),
+				healthStatus: u.health.status(),
+			})
+		}
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(infos); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return r
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_health(t *testing.T) {
+	h := &health{opts: &healthOpts{maxFails: 2, ejectTime: time.Minute, maxEjectTime: time.Minute * 3}}
+	h.report(false)
+	if !h.healthy() {
+		t.Fatal("upstream should not be ejected before reaching max fails")
+	}
+	h.report(false)
+	if h.healthy() {
+		t.Fatal("upstream should be ejected")
+	}
+
+	wantEjectTime := []time.Duration{time.Minute * 2, time.Minute * 3, time.Minute * 3}
+	for i, want := range wantEjectTime {
+		h.ejectedUntil = time.Time{} // re-admit
+		h.report(false)
+		h.report(false)
+		if d := time.Until(h.ejectedUntil).Round(time.Minute); d != want {
+			t.Fatalf("#%d ejection time = %s, want %s", i, d, want)
+		}
+	}
+
+	// A success after re-admission resets the back-off.
+	h.ejectedUntil = time.Time{}
+	h.report(true)
+	if h.ejections != 0 {
+		t.Fatalf("ejections should be reset, got %d", h.ejections)
+	}
+
+	us := []*upstreamWrapper{{health: h}, {health: &health{}}}
+	h.report(false)
+	h.report(false)
+	if hus := healthyUpstreams(us); len(hus) != 1 || hus[0] != us[1] {
+		t.Fatal("ejected upstream was selected")
+	}
+	us = us[:1]
+	if hus := healthyUpstreams(us); len(hus) != 1 {
+		t.Fatal("should fall back to all upstreams if no upstream is healthy")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindowSize is the number of recent rtt samples that are used to
+	// calculate the hedge delay percentile.
+	latencyWindowSize = 128
+	// minLatencySamples is the minimum number of samples that are required to
+	// calculate the percentile. Before that, the fixed hedge delay is used.
+	minLatencySamples   = 16
+	defaultHedgeDelayMs = 100
+)
+
+// latencyWindow keeps the most recent rtt samples of an upstream.
+type latencyWindow struct {
+	m       sync.Mutex
+	samples [latencyWindowSize]time.Duration
+	n       int // total number of samples
+}
+
+func (w *latencyWindow) observe(rtt time.Duration) {
+	w.m.Lock()
+	w.samples[w.n%latencyWindowSize] = rtt
+	w.n++
+	w.m.Unlock()
+}
+
+// percentile returns the p-th (0~100) percentile of recent samples.
+// ok is false if there are not enough samples.
+func (w *latencyWindow) percentile(p float64) (d time.Duration, ok bool) {
+	w.m.Lock()
+	n := min(w.n, latencyWindowSize)
+	if n < minLatencySamples {
+		w.m.Unlock()
+		return 0, false
+	}
+	s := slices.Clone(w.samples[:n])
+	w.m.Unlock()
+
+	slices.Sort(s)
+	i := int(float64(n-1) * p / 100)
+	return s[i], true
+}
+
+// hedgeOpts configures hedged requests. A query is sent to the first
+// upstream. If no answer arrives within the hedge delay, it will also be
+// sent to the next upstream.
+type hedgeOpts struct {
+	delay      time.Duration // fixed delay, also the fallback of percentile.
+	percentile float64       // 0 means always use the fixed delay.
+}
+
+// hedgeDelay returns the hedge delay after a query was sent to u.
+func (o *hedgeOpts) hedgeDelay(u *upstreamWrapper) time.Duration {
+	if o.percentile > 0 {
+		if d, ok := u.latency.percentile(o.percentile); ok {
+			return d
+		}
+	}
+	return o.delay
+}
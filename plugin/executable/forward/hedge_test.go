@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type delayUpstream struct {
+	delay time.Duration
+	ip    string
+}
+
+func (u *delayUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rr, _ := dns.NewRR(q.Question[0].Name + " 300 IN A " + u.ip)
+	r.Answer = append(r.Answer, rr)
+	return pool.PackBuffer(r)
+}
+
+func (u *delayUpstream) Close() error { return nil }
+
+func Test_hedgeExchange(t *testing.T) {
+	newForward := func(delays ...time.Duration) *Forward {
+		f, err := NewForward(&Args{
+			Upstreams:  []UpstreamConfig{{Addr: "127.0.0.1"}, {Addr: "127.0.0.2"}},
+			Concurrent: 2,
+			Policy:     policySequential,
+			HedgeDelay: 20,
+		}, Opts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, u := range f.us {
+			_ = u.u.Close()
+			u.u = &delayUpstream{delay: delays[i], ip: u.cfg.Addr}
+		}
+		return f
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The first upstream is fast, no hedge should be sent.
+	f := newForward(0, 0)
+	r, err := f.exchange(context.Background(), query_context.NewContext(q), f.us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Answer[0].(*dns.A).A.String(); got != "127.0.0.1" {
+		t.Fatalf("want response from the first upstream, got %s", got)
+	}
+	if n := testutil.ToFloat64(f.hedgeFired); n != 0 {
+		t.Fatalf("hedge should not fire, got %v", n)
+	}
+
+	// The first upstream is slow, the hedge should win.
+	f = newForward(time.Second, 0)
+	r, err = f.exchange(context.Background(), query_context.NewContext(q), f.us)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Answer[0].(*dns.A).A.String(); got != "127.0.0.2" {
+		t.Fatalf("want response from the hedged upstream, got %s", got)
+	}
+	if testutil.ToFloat64(f.hedgeFired) != 1 || testutil.ToFloat64(f.hedgeWon) != 1 {
+		t.Fatal("hedge metrics were not updated")
+	}
+}
+
+func Test_latencyWindow(t *testing.T) {
+	w := new(latencyWindow)
+	if _, ok := w.percentile(50); ok {
+		t.Fatal("percentile should not be available without samples")
+	}
+	for i := 1; i <= 100; i++ {
+		w.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d, _ := w.percentile(90); d != 90*time.Millisecond {
+		t.Fatalf("want p90 90ms, got %s", d)
+	}
+	if d, _ := w.percentile(100); d != 100*time.Millisecond {
+		t.Fatalf("want p100 100ms, got %s", d)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	policyRandom        = "random"
+	policyRoundRobin    = "round_robin"
+	policyWeighted      = "weighted"
+	policyLowestLatency = "lowest_latency"
+	policySequential    = "sequential"
+
+	// ewmaAlpha is the weight of the newest rtt sample.
+	ewmaAlpha = 0.2
+	// explorationRate is the probability that lowest_latency policy
+	// picks a random upstream first, so the latency of other upstreams can
+	// be updated.
+	explorationRate = 0.05
+)
+
+// selector orders upstreams for a query.
+type selector interface {
+	// pick returns n upstreams in the order they should be queried.
+	// us must not be empty. The returned upstreams may be duplicated
+	// if n > len(us).
+	pick(us []*upstreamWrapper, n int) []*upstreamWrapper
+}
+
+func newSelector(policy string) (selector, error) {
+	switch policy {
+	case "", policyRandom:
+		return randomSelector{}, nil
+	case policyRoundRobin:
+		return new(roundRobinSelector), nil
+	case policyWeighted:
+		return weightedSelector{}, nil
+	case policyLowestLatency:
+		return lowestLatencySelector{}, nil
+	case policySequential:
+		return sequentialSelector{}, nil
+	default:
+		return nil, fmt.Errorf("invalid policy %s", policy)
+	}
+}
+
+// pickFrom picks n upstreams from us, starting at us[start].
+func pickFrom(us []*upstreamWrapper, start, n int) []*upstreamWrapper {
+	p := make([]*upstreamWrapper, 0, n)
+	for i := 0; i < n; i++ {
+		p = append(p, us[(start+i)%len(us)])
+	}
+	return p
+}
+
+type randomSelector struct{}
+
+func (randomSelector) pick(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	return pickFrom(us, rand.IntN(len(us)), n)
+}
+
+type roundRobinSelector struct {
+	c atomic.Uint32
+}
+
+func (s *roundRobinSelector) pick(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	return pickFrom(us, int(s.c.Add(1)%uint32(len(us))), n)
+}
+
+type sequentialSelector struct{}
+
+func (sequentialSelector) pick(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	return pickFrom(us, 0, n)
+}
+
+type weightedSelector struct{}
+
+// pick picks upstreams by weighted random sampling without replacement.
+func (weightedSelector) pick(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	remain := slices.Clone(us)
+	p := make([]*upstreamWrapper, 0, n)
+	for len(p) < n {
+		if len(remain) == 0 {
+			remain = slices.Clone(us)
+		}
+		sum := 0
+		for _, u := range remain {
+			sum += u.weight()
+		}
+		r := rand.IntN(sum)
+		for i, u := range remain {
+			r -= u.weight()
+			if r < 0 {
+				p = append(p, u)
+				remain = slices.Delete(remain, i, i+1)
+				break
+			}
+		}
+	}
+	return p
+}
+
+type lowestLatencySelector struct{}
+
+// pick picks upstreams that have the lowest rtt ewma. Upstreams that have
+// no rtt sample yet are picked first.
+func (lowestLatencySelector) pick(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	sorted := slices.Clone(us)
+	slices.SortStableFunc(sorted, func(a, b *upstreamWrapper) int {
+		return cmp.Compare(a.rttEWMA(), b.rttEWMA())
+	})
+	if len(sorted) > 1 && rand.Float64() < explorationRate {
+		i := rand.IntN(len(sorted))
+		sorted[0], sorted[i] = sorted[i], sorted[0]
+	}
+	return pickFrom(sorted, 0, n)
+}
+
+// rttEWMA is a thread-safe exponentially weighted moving average of rtt.
+type rttEWMA struct {
+	v atomic.Int64 // nanoseconds, 0 means no sample.
+}
+
+func (e *rttEWMA) observe(rtt time.Duration) {
+	for {
+		old := e.v.Load()
+		var n int64
+		if old == 0 {
+			n = int64(rtt)
+		} else {
+			n = int64(ewmaAlpha*float64(rtt) + (1-ewmaAlpha)*float64(old))
+		}
+		if n <= 0 {
+			n = 1
+		}
+		if e.v.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func (e *rttEWMA) get() time.Duration {
+	return time.Duration(e.v.Load())
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_selectors(t *testing.T) {
+	newUs := func() []*upstreamWrapper {
+		us := make([]*upstreamWrapper, 3)
+		for i := range us {
+			us[i] = &upstreamWrapper{idx: i, health: &health{}}
+		}
+		return us
+	}
+
+	us := newUs()
+	if p := (sequentialSelector{}).pick(us, 2); p[0] != us[0] || p[1] != us[1] {
+		t.Fatal("sequential selector should pick upstreams in order")
+	}
+
+	rr := new(roundRobinSelector)
+	first := rr.pick(us, 1)[0]
+	if second := rr.pick(us, 1)[0]; second.idx != (first.idx+1)%len(us) {
+		t.Fatal("round robin selector should pick the next upstream")
+	}
+
+	us = newUs()
+	us[1].cfg.Weight = 1000
+	hits := 0
+	for i := 0; i < 100; i++ {
+		p := (weightedSelector{}).pick(us, 3)
+		if p[0] == us[1] {
+			hits++
+		}
+		if p[0] == p[1] || p[1] == p[2] || p[0] == p[2] {
+			t.Fatal("weighted selector picked duplicated upstreams")
+		}
+	}
+	if hits < 90 {
+		t.Fatalf("heavy upstream was picked first only %d times", hits)
+	}
+
+	us = newUs()
+	us[0].rtt.observe(time.Millisecond * 100)
+	us[1].rtt.observe(time.Millisecond * 10)
+	us[2].rtt.observe(time.Millisecond * 50)
+	hits = 0
+	for i := 0; i < 100; i++ {
+		if (lowestLatencySelector{}).pick(us, 1)[0] == us[1] {
+			hits++
+		}
+	}
+	if hits < 80 {
+		t.Fatalf("fastest upstream was picked first only %d times", hits)
+	}
+}
+
+func Test_rttEWMA(t *testing.T) {
+	var e rttEWMA
+	e.observe(time.Millisecond * 100)
+	if e.get() != time.Millisecond*100 {
+		t.Fatalf("first sample should be used as is, got %s", e.get())
+	}
+	e.observe(0)
+	if e.get() != time.Millisecond*80 {
+		t.Fatalf("want 80ms, got %s", e.get())
+	}
+}
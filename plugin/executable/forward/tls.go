@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var errNoPinMatched = errors.New("no certificate in the chain matches the spki pins")
+
+// newTLSConfig builds the tls config of the upstream from c.
+func newTLSConfig(c *UpstreamConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	if len(c.CAFile) > 0 {
+		pool, err := utils.LoadCertPool([]string{c.CAFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca file, %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(c.ClientCert)+len(c.ClientKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert, %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.SPKIPins) > 0 {
+		pins, err := parseSPKIPins(c.SPKIPins)
+		if err != nil {
+			return nil, err
+		}
+		// VerifyConnection instead of VerifyPeerCertificate, because the latter
+		// is not called on resumed connections.
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs, pins)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func parseSPKIPins(ss []string) ([][sha256.Size]byte, error) {
+	pins := make([][sha256.Size]byte, 0, len(ss))
+	for _, s := range ss {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spki pin %s, %w", s, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin %s, not a sha256 hash", s)
+		}
+		pins = append(pins, [sha256.Size]byte(b))
+	}
+	return pins, nil
+}
+
+// verifySPKIPins checks that at least one certificate in the chain has a
+// public key that matches one of the pins. If the chain was verified, the
+// verified chains will be checked. Otherwise (insecure_skip_verify is set),
+// only the leaf certificate will be checked, because other certificates
+// sent by the server are not bound to the connection and can be forged.
+func verifySPKIPins(cs tls.ConnectionState, pins [][sha256.Size]byte) error {
+	match := func(spki []byte) bool {
+		h := sha256.Sum256(spki)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(h[:], pin[:]) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(cs.VerifiedChains) > 0 {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if match(cert.RawSubjectPublicKeyInfo) {
+					return nil
+				}
+			}
+		}
+		return errNoPinMatched
+	}
+	if len(cs.PeerCertificates) > 0 && match(cs.PeerCertificates[0].RawSubjectPublicKeyInfo) {
+		return nil
+	}
+	return errNoPinMatched
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var errAny = errors.New("any error")
+
+func Test_newTLSConfig(t *testing.T) {
+	cert, err := utils.GenerateCertificate("dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(h[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		c       UpstreamConfig
+		wantErr error // nil: no error, errAny: any error
+	}{
+		{"system ca", UpstreamConfig{ServerName: "dns.example"}, errAny},
+		{"ca file", UpstreamConfig{CAFile: caFile, ServerName: "dns.example"}, nil},
+		{"ca file wrong name", UpstreamConfig{CAFile: caFile, ServerName: "other.example"}, errAny},
+		{"ca file with pin", UpstreamConfig{CAFile: caFile, ServerName: "dns.example", SPKIPins: []string{wrongPin, pin}}, nil},
+		{"ca file with wrong pin", UpstreamConfig{CAFile: caFile, ServerName: "dns.example", SPKIPins: []string{wrongPin}}, errNoPinMatched},
+		{"insecure with pin", UpstreamConfig{InsecureSkipVerify: true, SPKIPins: []string{pin}}, nil},
+		{"insecure with wrong pin", UpstreamConfig{InsecureSkipVerify: true, SPKIPins: []string{wrongPin}}, errNoPinMatched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(&tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := tls.Dial("tcp", l.Addr().String(), tlsConfig)
+			if err == nil {
+				c.Close()
+			}
+			switch {
+			case tt.wantErr == nil && err != nil,
+				tt.wantErr == errAny && err == nil,
+				tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("dial err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, pins := range [][]string{{"not base64!"}, {base64.StdEncoding.EncodeToString([]byte("short"))}} {
+		if _, err := newTLSConfig(&UpstreamConfig{SPKIPins: pins}); err == nil {
+			t.Fatalf("want err for invalid pins %v", pins)
+		}
+	}
+}
+
+func Test_verifySPKIPins_forgedChain(t *testing.T) {
+	pinned, err := utils.GenerateCertificate("dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := utils.GenerateCertificate("dns.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := [][sha256.Size]byte{sha256.Sum256(pinned.Leaf.RawSubjectPublicKeyInfo)}
+
+	// The pinned cert is public. An attacker can send it after its own leaf.
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{forged.Leaf, pinned.Leaf}}
+	if err := verifySPKIPins(cs, pins); !errors.Is(err, errNoPinMatched) {
+		t.Fatalf("forged chain should not match, err = %v", err)
+	}
+	cs.PeerCertificates = []*x509.Certificate{pinned.Leaf, forged.Leaf}
+	if err := verifySPKIPins(cs, pins); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -21,6 +21,7 @@ package fastforward
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
@@ -41,6 +42,12 @@ type upstreamWrapper struct {
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+
+	rtt        rttEWMA
+	latency    latencyWindow
+	health     *health
+	healthy    prometheus.GaugeFunc
+	probeQuery *dns.Msg // nil if active health check is disabled.
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -52,12 +59,24 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 	}
 }
 
-// newWrapper inits all metrics.
+// newWrapper inits all metrics. ho can be nil, which disables health check.
 // Note: upstreamWrapper.u still needs to be set.
-func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
+func newWrapper(idx int, cfg UpstreamConfig, pluginTag string, ho *healthOpts) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
+	h := &health{opts: ho}
 	return &upstreamWrapper{
-		cfg: cfg,
+		cfg:    cfg,
+		health: h,
+		healthy: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "healthy",
+			Help:        "Whether this upstream is healthy (1) or ejected (0)",
+			ConstLabels: lb,
+		}, func() float64 {
+			if h.healthy() {
+				return 1
+			}
+			return 0
+		}),
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
 			Help:        "The total number of queries processed by this upstream",
@@ -101,6 +120,7 @@ func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
+		uw.healthy,
 	} {
 		if err := r.Register(collector); err != nil {
 			return err
@@ -109,6 +129,18 @@ func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
 	return nil
 }
 
+// weight returns the weight of this upstream. Default is 1.
+func (uw *upstreamWrapper) weight() int {
+	if uw.cfg.Weight > 0 {
+		return uw.cfg.Weight
+	}
+	return 1
+}
+
+func (uw *upstreamWrapper) rttEWMA() time.Duration {
+	return uw.rtt.get()
+}
+
 // name returns upstream tag if it was set in the config.
 // Otherwise, it returns upstream address.
 func (uw *upstreamWrapper) name() string {
@@ -128,9 +160,15 @@ func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]by
 
 	if err != nil {
 		uw.errTotal.Inc()
+		// Failures are considered as slow responses.
+		uw.rtt.observe(queryTimeout)
 	} else {
-		uw.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
+		rtt := time.Since(start)
+		uw.responseLatency.Observe(float64(rtt.Milliseconds()))
+		uw.rtt.observe(rtt)
+		uw.latency.observe(rtt)
 	}
+	uw.health.report(err == nil)
 	return r, err
 }
 
@@ -138,6 +176,65 @@ func (uw *upstreamWrapper) Close() error {
 	return uw.u.Close()
 }
 
+// tagUpstream looks up the upstream by tag on every query, so upstreams
+// can be used as bootstrap regardless of their order.
+type tagUpstream struct {
+	f   *Forward
+	tag string
+}
+
+func (u *tagUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	uw := u.f.tag2Upstream[u.tag]
+	if uw == nil {
+		return nil, fmt.Errorf("upstream %s is not initialized", u.tag)
+	}
+	return uw.ExchangeContext(ctx, m)
+}
+
+// Close is a noop. The upstream is closed by Forward.
+func (u *tagUpstream) Close() error {
+	return nil
+}
+
+// checkBootstrapUpstreams checks that bootstrap_upstream tags exist and
+// do not form a loop.
+func checkBootstrapUpstreams(args *Args) error {
+	next := make(map[string]string)
+	for _, c := range args.Upstreams {
+		if len(c.Tag) > 0 {
+			bu := c.BootstrapUpstream
+			if len(bu) == 0 && c.Tag != args.BootstrapUpstream {
+				bu = args.BootstrapUpstream
+			}
+			next[c.Tag] = bu
+		}
+	}
+	check := func(tag string) error {
+		seen := make(map[string]struct{})
+		for len(tag) > 0 {
+			if _, ok := seen[tag]; ok {
+				return fmt.Errorf("bootstrap upstream %s loops", tag)
+			}
+			seen[tag] = struct{}{}
+			bu, ok := next[tag]
+			if !ok {
+				return fmt.Errorf("bootstrap upstream %s not found", tag)
+			}
+			tag = bu
+		}
+		return nil
+	}
+	if err := check(args.BootstrapUpstream); err != nil {
+		return err
+	}
+	for _, c := range args.Upstreams {
+		if err := check(c.BootstrapUpstream); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type queryInfo dns.Msg
 
 func (q *queryInfo) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import "testing"
+
+func Test_checkBootstrapUpstreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    Args
+		wantErr bool
+	}{
+		{
+			name: "global",
+			args: Args{BootstrapUpstream: "b", Upstreams: []UpstreamConfig{{Tag: "a"}, {Tag: "b"}}},
+		},
+		{
+			name: "per upstream",
+			args: Args{Upstreams: []UpstreamConfig{{Tag: "a", BootstrapUpstream: "b"}, {Tag: "b"}}},
+		},
+		{
+			name:    "not found",
+			args:    Args{Upstreams: []UpstreamConfig{{Tag: "a", BootstrapUpstream: "c"}}},
+			wantErr: true,
+		},
+		{
+			name:    "self",
+			args:    Args{Upstreams: []UpstreamConfig{{Tag: "a", BootstrapUpstream: "a"}}},
+			wantErr: true,
+		},
+		{
+			name:    "loop",
+			args:    Args{BootstrapUpstream: "b", Upstreams: []UpstreamConfig{{Tag: "a"}, {Tag: "b", BootstrapUpstream: "a"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkBootstrapUpstreams(&tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("checkBootstrapUpstreams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "ip_rewrite"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*IPRewrite)(nil)
+
+type Args struct {
+	Rules []string `yaml:"rules"`
+	Files []string `yaml:"files"`
+
+	// Also rewrite ipv4hint and ipv6hint of HTTPS/SVCB records.
+	Hints bool `yaml:"hints"`
+}
+
+type IPRewrite struct {
+	t     *Table
+	hints bool
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	r, err := NewIPRewrite(args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.L().Info("ip rewrite rules loaded", zap.Int("length", r.Len()))
+	return r, nil
+}
+
+func NewIPRewrite(args *Args) (*IPRewrite, error) {
+	t := NewTable()
+	for i, rule := range args.Rules {
+		if err := LoadFromText(t, rule); err != nil {
+			return nil, fmt.Errorf("failed to load rule #%d %s, %w", i, rule, err)
+		}
+	}
+	for i, file := range args.Files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
+		}
+		if err := LoadFromReader(t, bytes.NewReader(b)); err != nil {
+			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
+		}
+	}
+	return &IPRewrite{t: t, hints: args.Hints}, nil
+}
+
+// Exec rewrites addresses in the answer section of the response.
+// Records' TTLs are kept.
+func (r *IPRewrite) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if resp := qCtx.R(); resp != nil {
+		r.rewriteMsg(resp)
+	}
+	return nil
+}
+
+func (r *IPRewrite) rewriteMsg(m *dns.Msg) {
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			rr.A = r.rewriteIP(rr.A, false)
+		case *dns.AAAA:
+			rr.AAAA = r.rewriteIP(rr.AAAA, true)
+		case *dns.SVCB:
+			if r.hints {
+				r.rewriteHints(rr.Value)
+			}
+		case *dns.HTTPS:
+			if r.hints {
+				r.rewriteHints(rr.Value)
+			}
+		}
+	}
+}
+
+func (r *IPRewrite) rewriteHints(kvs []dns.SVCBKeyValue) {
+	for _, kv := range kvs {
+		switch kv := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			for i := range kv.Hint {
+				kv.Hint[i] = r.rewriteIP(kv.Hint[i], false)
+			}
+		case *dns.SVCBIPv6Hint:
+			for i := range kv.Hint {
+				kv.Hint[i] = r.rewriteIP(kv.Hint[i], true)
+			}
+		}
+	}
+}
+
+// rewriteIP returns ip itself if it does not match any rule.
+// If v6 is true, ip is from an AAAA record or an ipv6hint, and the
+// result is always in 16-byte form.
+func (r *IPRewrite) rewriteIP(ip net.IP, v6 bool) net.IP {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ip
+	}
+	if v6 {
+		// Keep IPv4-mapped addresses mapped. Table.Rewrite does so.
+		addr = netip.AddrFrom16(addr.As16())
+	} else {
+		addr = addr.Unmap() // net.IPv4() is in 16-byte form.
+	}
+	newAddr, ok := r.t.Rewrite(addr)
+	if !ok {
+		return ip
+	}
+	return newAddr.AsSlice()
+}
+
+func (r *IPRewrite) Len() int {
+	return r.t.Len()
+}
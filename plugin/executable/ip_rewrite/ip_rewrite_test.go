@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTable_Rewrite(t *testing.T) {
+	tb := NewTable()
+	err := LoadFromReader(tb, strings.NewReader(`
+# comment
+10.0.0.0/8     172.16.0.0/8
+10.1.0.0/16    192.168.0.0/16 # longer prefix
+10.2.0.0/16    192.168.100.1
+fd00::/64      fd01:1::/64
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"10.3.4.5", "172.3.4.5", true},
+		{"10.1.2.3", "192.168.2.3", true},
+		{"10.2.2.3", "192.168.100.1", true},
+		{"::ffff:10.1.2.3", "::ffff:192.168.2.3", true},
+		{"fd00::1", "fd01:1::1", true},
+		{"11.0.0.1", "", false},
+		{"fd00:1::1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok := tb.Rewrite(netip.MustParseAddr(tt.in))
+			if ok != tt.ok {
+				t.Fatalf("Rewrite() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && got != netip.MustParseAddr(tt.want) {
+				t.Fatalf("Rewrite() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTable_Add(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr bool
+	}{
+		{"10.0.0.0/24 192.168.0.0/24", false},
+		{"10.0.0.0/24 192.168.0.1", false},
+		{"10.0.0.0/24 192.168.0.0/16", true},
+		{"10.0.0.0/24 fd00::1", true},
+		{"10.0.0.0/24", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			if err := LoadFromText(NewTable(), tt.rule); (err != nil) != tt.wantErr {
+				t.Fatalf("LoadFromText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIPRewrite_rewriteMsg(t *testing.T) {
+	r, err := NewIPRewrite(&Args{Rules: []string{"1.0.0.0/8 2.0.0.0/8"}, Hints: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	hdr := dns.RR_Header{Name: "example.", Class: dns.ClassINET, Ttl: 100}
+	hdr.Rrtype = dns.TypeA
+	m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(1, 2, 3, 4)})
+	hdr.Rrtype = dns.TypeHTTPS
+	m.Answer = append(m.Answer, &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:    hdr,
+		Target: ".",
+		Value:  []dns.SVCBKeyValue{&dns.SVCBIPv4Hint{Hint: []net.IP{net.IPv4(1, 1, 1, 1), net.IPv4(3, 3, 3, 3)}}},
+	}})
+	r.rewriteMsg(m)
+
+	a := m.Answer[0].(*dns.A)
+	if !a.A.Equal(net.IPv4(2, 2, 3, 4)) || a.Hdr.Ttl != 100 {
+		t.Fatalf("unexpected A record %s", a)
+	}
+	hint := m.Answer[1].(*dns.HTTPS).Value[0].(*dns.SVCBIPv4Hint).Hint
+	if !hint[0].Equal(net.IPv4(2, 1, 1, 1)) || !hint[1].Equal(net.IPv4(3, 3, 3, 3)) {
+		t.Fatalf("unexpected hints %v", hint)
+	}
+}
+
+func TestIPRewrite_rewriteMsg_mapped(t *testing.T) {
+	r, err := NewIPRewrite(&Args{Rules: []string{"1.0.0.0/8 2.0.0.0/8"}, Hints: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.", dns.TypeAAAA)
+	hdr := dns.RR_Header{Name: "example.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 100}
+	m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("::ffff:1.2.3.4")})
+	r.rewriteMsg(m)
+
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := new(dns.Msg)
+	if err := m2.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if aaaa := m2.Answer[0].(*dns.AAAA); !aaaa.AAAA.Equal(net.ParseIP("::ffff:2.2.3.4")) {
+		t.Fatalf("unexpected AAAA record %s", aaaa)
+	}
+
+	// miekg/dns does not pack mapped ipv6hints, but they should be kept
+	// in 16-byte form anyway.
+	hint := &dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("::ffff:1.1.1.1")}}
+	r.rewriteHints([]dns.SVCBKeyValue{hint})
+	if ip := hint.Hint[0]; len(ip) != net.IPv6len || !ip.Equal(net.ParseIP("::ffff:2.1.1.1")) {
+		t.Fatalf("unexpected hint %v", []byte(ip))
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ip_rewrite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// Table maps addresses from source prefixes to target prefixes.
+// The longest matched source prefix wins.
+type Table struct {
+	m     map[netip.Prefix]netip.Prefix // masked source prefix -> target prefix
+	bits4 []int                         // distinct ipv4 source prefix lengths, in descending order.
+	bits6 []int                         // distinct ipv6 source prefix lengths, in descending order.
+}
+
+func NewTable() *Table {
+	return &Table{m: make(map[netip.Prefix]netip.Prefix)}
+}
+
+// Len returns the number of rules in this Table.
+func (t *Table) Len() int {
+	return len(t.m)
+}
+
+// Add adds a rule that maps from to to.
+// If to is a single address (/32 or /128), all addresses in from are replaced
+// by it. Otherwise, from and to must have the same prefix length, and the host
+// bits of the address are preserved.
+func (t *Table) Add(from, to netip.Prefix) error {
+	if !from.IsValid() || !to.IsValid() {
+		return fmt.Errorf("invalid prefix")
+	}
+	from = netip.PrefixFrom(from.Addr().Unmap(), from.Bits()).Masked()
+	to = netip.PrefixFrom(to.Addr().Unmap(), to.Bits()).Masked()
+	if from.Addr().Is4() != to.Addr().Is4() {
+		return fmt.Errorf("%s and %s are not in the same address family", from, to)
+	}
+	if to.Bits() != to.Addr().BitLen() && to.Bits() != from.Bits() {
+		return fmt.Errorf("prefix length of %s and %s mismatched", from, to)
+	}
+
+	if _, dup := t.m[from]; !dup {
+		if from.Addr().Is4() {
+			t.bits4 = insertBits(t.bits4, from.Bits())
+		} else {
+			t.bits6 = insertBits(t.bits6, from.Bits())
+		}
+	}
+	t.m[from] = to
+	return nil
+}
+
+func insertBits(s []int, b int) []int {
+	i := sort.Search(len(s), func(i int) bool { return s[i] <= b })
+	if i < len(s) && s[i] == b {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = b
+	return s
+}
+
+// Rewrite returns the rewritten address of addr.
+// If addr does not match any rule, ok will be false.
+// IPv4-mapped IPv6 addresses match IPv4 rules, and the result is
+// also IPv4-mapped.
+func (t *Table) Rewrite(addr netip.Addr) (_ netip.Addr, ok bool) {
+	mapped := addr.Is4In6()
+	addr = addr.Unmap()
+	bits := t.bits6
+	if addr.Is4() {
+		bits = t.bits4
+	}
+	for _, b := range bits {
+		p, _ := addr.Prefix(b)
+		if to, ok := t.m[p]; ok {
+			r := mapAddr(addr, to)
+			if mapped {
+				r = netip.AddrFrom16(r.As16())
+			}
+			return r, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// mapAddr replaces the network bits of addr with to.
+// addr and to must be in the same address family.
+func mapAddr(addr netip.Addr, to netip.Prefix) netip.Addr {
+	a := addr.AsSlice()
+	b := to.Addr().AsSlice()
+	n := to.Bits()
+	for i := range b {
+		switch {
+		case n >= 8:
+			n -= 8
+		case n > 0:
+			hostMask := byte(0xff) >> n
+			b[i] = b[i]&^hostMask | a[i]&hostMask
+			n = 0
+		default:
+			b[i] = a[i]
+		}
+	}
+	r, _ := netip.AddrFromSlice(b)
+	return r
+}
+
+// LoadFromText loads a rule from s.
+// Format: "[from_ip|from_cidr] [to_ip|to_cidr]".
+func LoadFromText(t *Table, s string) error {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return fmt.Errorf("rule must have 2 fields, but got %d", len(f))
+	}
+	from, err := parsePrefix(f[0])
+	if err != nil {
+		return err
+	}
+	to, err := parsePrefix(f[1])
+	if err != nil {
+		return err
+	}
+	return t.Add(from, to)
+}
+
+// LoadFromReader loads rules from a reader. One rule per line.
+// Texts after "#" are comments.
+func LoadFromReader(t *Table, reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+
+	// count how many lines we have read.
+	lineCounter := 0
+	for scanner.Scan() {
+		lineCounter++
+		s := utils.RemoveComment(scanner.Text(), "#")
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		if err := LoadFromText(t, s); err != nil {
+			return fmt.Errorf("invalid data at line #%d: %w", lineCounter, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.ContainsRune(s, '/') {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return addr.Prefix(addr.BitLen())
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rebind_protect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "rebind_protect"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*RebindProtect)(nil)
+
+const (
+	modeFilter   = "filter"
+	modeRefused  = "refused"
+	modeNXDomain = "nxdomain"
+)
+
+// defaultIPs will be used if no ip is configured.
+var defaultIPs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10", // CGNAT
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type Args struct {
+	// Addresses that should not appear in answers of external names.
+	// If all empty, private, loopback, link-local and CGNAT ranges are used.
+	IPs     []string `yaml:"ips"`
+	IPSets  []string `yaml:"ip_sets"`
+	IPFiles []string `yaml:"ip_files"`
+
+	// Internal domains that are allowed to have those addresses.
+	AllowDomains     []string `yaml:"allow_domains"`
+	AllowDomainSets  []string `yaml:"allow_domain_sets"`
+	AllowDomainFiles []string `yaml:"allow_domain_files"`
+
+	// Mode is one of "filter" (default), "refused" and "nxdomain".
+	// "filter" removes the blocked records from the answer.
+	// The others replace the whole response.
+	Mode string `yaml:"mode"`
+}
+
+type RebindProtect struct {
+	logger *zap.Logger
+	ipm    netlist.Matcher
+	allow  domain.Matcher[struct{}]
+	mode   string
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewRebindProtect(bp, args.(*Args))
+}
+
+func NewRebindProtect(bp *coremain.BP, args *Args) (*RebindProtect, error) {
+	p := &RebindProtect{logger: bp.L()}
+
+	switch args.Mode {
+	case "", modeFilter:
+		p.mode = modeFilter
+	case modeRefused, modeNXDomain:
+		p.mode = args.Mode
+	default:
+		return nil, fmt.Errorf("invalid mode %s", args.Mode)
+	}
+
+	var ipmg ip_set.MatcherGroup
+	ips := args.IPs
+	if len(args.IPs)+len(args.IPSets)+len(args.IPFiles) == 0 {
+		ips = defaultIPs
+	}
+	l := netlist.NewList()
+	if err := ip_set.LoadFromIPsAndFiles(ips, args.IPFiles, l); err != nil {
+		return nil, err
+	}
+	l.Sort()
+	if l.Len() > 0 {
+		ipmg = append(ipmg, l)
+	}
+	for _, tag := range args.IPSets {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.IPMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("cannot find ipset %s", tag)
+		}
+		ipmg = append(ipmg, provider.GetIPMatcher())
+	}
+	p.ipm = ipmg
+
+	var dmg domain_set.MatcherGroup
+	m := domain.NewDomainMixMatcher()
+	if err := domain_set.LoadExpsAndFiles(args.AllowDomains, args.AllowDomainFiles, m); err != nil {
+		return nil, err
+	}
+	if m.Len() > 0 {
+		dmg = append(dmg, m)
+	}
+	for _, tag := range args.AllowDomainSets {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("cannot find domain set %s", tag)
+		}
+		dmg = append(dmg, provider.GetDomainMatcher())
+	}
+	p.allow = dmg
+	return p, nil
+}
+
+// Exec checks the response. It should be placed after the upstream.
+func (p *RebindProtect) Exec(_ context.Context, qCtx *query_context.Context) error {
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+	if _, ok := p.allow.Match(qCtx.QQuestion().Name); ok {
+		return nil
+	}
+
+	blocked := p.findBlocked(r)
+	if !blocked.IsValid() {
+		return nil
+	}
+	p.logger.Warn(
+		"possible dns rebinding blocked",
+		qCtx.InfoField(),
+		zap.Stringer("addr", blocked),
+		zap.String("mode", p.mode),
+	)
+
+	qCtx.SetEDE(dns.ExtendedErrorCodeFiltered, "")
+	switch p.mode {
+	case modeRefused:
+		qCtx.SetResponse(dnsutils.GenEmptyReply(qCtx.Q(), dns.RcodeRefused))
+	case modeNXDomain:
+		qCtx.SetResponse(dnsutils.GenEmptyReply(qCtx.Q(), dns.RcodeNameError))
+	default:
+		p.filter(r)
+	}
+	return nil
+}
+
+// findBlocked returns the first blocked address in the answer of m.
+// It returns an invalid netip.Addr if no address was blocked.
+func (p *RebindProtect) findBlocked(m *dns.Msg) netip.Addr {
+	for _, rr := range m.Answer {
+		if addr := rrAddr(rr); addr.IsValid() && p.ipm.Match(addr) {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// filter removes blocked address records from the answer of m. If no
+// address record is left, a fake SOA is added so the empty answer can be
+// negatively cached.
+func (p *RebindProtect) filter(m *dns.Msg) {
+	out := m.Answer[:0]
+	hasAddr := false
+	for _, rr := range m.Answer {
+		addr := rrAddr(rr)
+		if addr.IsValid() && p.ipm.Match(addr) {
+			continue
+		}
+		hasAddr = hasAddr || addr.IsValid()
+		out = append(out, rr)
+	}
+	m.Answer = out
+	if !hasAddr && len(m.Question) > 0 {
+		m.Ns = []dns.RR{dnsutils.FakeSOA(m.Question[0].Name)}
+	}
+}
+
+func rrAddr(rr dns.RR) netip.Addr {
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	default:
+		return netip.Addr{}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
+}
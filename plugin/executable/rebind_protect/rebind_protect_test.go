@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rebind_protect
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func TestRebindProtect_Exec(t *testing.T) {
+	newQCtx := func(name string) *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}
+		r.Answer = []dns.RR{
+			&dns.A{Hdr: hdr, A: net.IPv4(1, 1, 1, 1)},
+			&dns.A{Hdr: hdr, A: net.IPv4(192, 168, 1, 1)},
+		}
+		qCtx.SetResponse(r)
+		return qCtx
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		qname     string
+		wantRcode int
+		wantAns   int
+	}{
+		{"filter", "", "example.com.", dns.RcodeSuccess, 1},
+		{"refused", "refused", "example.com.", dns.RcodeRefused, 0},
+		{"nxdomain", "nxdomain", "example.com.", dns.RcodeNameError, 0},
+		{"allowed", "refused", "nas.lan.", dns.RcodeSuccess, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bp := coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(nil))
+			p, err := NewRebindProtect(bp, &Args{AllowDomains: []string{"lan"}, Mode: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			qCtx := newQCtx(tt.qname)
+			if err := p.Exec(context.Background(), qCtx); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAns {
+				t.Fatalf("got rcode %d with %d answers, want rcode %d with %d answers", r.Rcode, len(r.Answer), tt.wantRcode, tt.wantAns)
+			}
+		})
+	}
+}
+
+func TestRebindProtect_filterAll(t *testing.T) {
+	bp := coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(nil))
+	p, err := NewRebindProtect(bp, &Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "nas.example.com."},
+		&dns.A{Hdr: dns.RR_Header{Name: "nas.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 168, 1, 1)},
+	}
+	qCtx.SetResponse(r)
+	if err := p.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r = qCtx.R()
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %s", r)
+	}
+	if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("want a soa in ns for negative caching, got %v", r.Ns)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/recursor"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "recursor"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Recursor)(nil)
+
+type Args struct {
+	// RootHints are addresses ("ip[:port]") of the root servers.
+	// Default is the IANA root servers.
+	RootHints []string `yaml:"root_hints"`
+	// Port is the port of name servers learnt from referrals.
+	// Default is 53.
+	Port int `yaml:"port"`
+	// QueryTimeout is the timeout in seconds of a query to one name server.
+	// Default is 2.
+	QueryTimeout int `yaml:"query_timeout"`
+
+	DisableQNAMEMinimisation bool `yaml:"disable_qname_minimisation"`
+	Disable0x20              bool `yaml:"disable_0x20"`
+
+	// CacheSize is the size of the delegation cache.
+	CacheSize int `yaml:"cache_size"`
+}
+
+// Recursor resolves queries iteratively from the root servers.
+type Recursor struct {
+	r *recursor.Resolver
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	utils.SetDefaultUnsignNum(&a.QueryTimeout, 2)
+	if a.Port < 0 || a.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", a.Port)
+	}
+
+	var roots []netip.AddrPort
+	for _, s := range a.RootHints {
+		ap, err := parseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root hint %s, %w", s, err)
+		}
+		roots = append(roots, ap)
+	}
+	r := recursor.NewResolver(recursor.Opts{
+		RootHints:                roots,
+		Port:                     uint16(a.Port),
+		QueryTimeout:             time.Duration(a.QueryTimeout) * time.Second,
+		DisableQNAMEMinimisation: a.DisableQNAMEMinimisation,
+		Disable0x20:              a.Disable0x20,
+		CacheSize:                a.CacheSize,
+		Logger:                   bp.L(),
+	})
+	return &Recursor{r: r}, nil
+}
+
+// parseAddr parses "ip" or "ip:port". Default port is 53.
+func parseAddr(s string) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, 53), nil
+}
+
+func (r *Recursor) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.QQuestion()
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	m, err := r.r.Resolve(ctx, q.Name, q.Qtype)
+	if err != nil {
+		return err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(qCtx.Q())
+	resp.RecursionAvailable = true
+	resp.Rcode = m.Rcode
+	resp.Answer = m.Answer
+	resp.Ns = m.Ns
+	qCtx.SetResponse(resp)
+	return nil
+}
+
+func (r *Recursor) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func Test_parseAddr(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.1", "192.0.2.1:53", false},
+		{"192.0.2.1:5353", "192.0.2.1:5353", false},
+		{"2001:db8::1", "[2001:db8::1]:53", false},
+		{"[2001:db8::1]:5353", "[2001:db8::1]:5353", false},
+		{"a.root-servers.net", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseAddr(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseAddr(%s) err = %v", tt.s, err)
+		}
+		if err == nil && got.String() != tt.want {
+			t.Fatalf("parseAddr(%s) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestRecursor(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The root server is authoritative for all names.
+	root := &dns.Server{PacketConn: c, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		if q := req.Question[0]; q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+			resp.Answer = append(resp.Answer, rr)
+		}
+		_ = w.WriteMsg(resp)
+	})}
+	go root.ActivateAndServe()
+	defer root.Shutdown()
+
+	bp := coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(nil))
+	for _, args := range []*Args{{Port: 65536}, {RootHints: []string{"root"}}} {
+		if _, err := Init(bp, args); err == nil {
+			t.Fatalf("want err for invalid args %+v", args)
+		}
+	}
+	p, err := Init(bp, &Args{RootHints: []string{c.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := p.(*Recursor)
+	defer r.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := r.Exec(ctx, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	resp := qCtx.R()
+	if resp == nil || resp.Id != q.Id || !resp.RecursionAvailable || len(resp.Answer) != 1 {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected answer %v", resp.Answer[0])
+	}
+
+	// Non-IN queries are ignored.
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	qCtx = query_context.NewContext(q)
+	if err := r.Exec(ctx, qCtx); err != nil || qCtx.R() != nil {
+		t.Fatalf("non-IN query should be ignored, err = %v", err)
+	}
+}
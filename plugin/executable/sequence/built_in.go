@@ -50,6 +50,7 @@ func (a ActionReject) Exec(_ context.Context, qCtx *query_context.Context, _ Cha
 	r.SetReply(qCtx.Q())
 	r.Rcode = a.Rcode
 	qCtx.SetResponse(r)
+	qCtx.SetEDE(dns.ExtendedErrorCodeBlocked, "")
 	return nil
 }
 
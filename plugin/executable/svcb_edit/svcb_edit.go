@@ -0,0 +1,365 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package svcb_edit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	PluginType = "svcb_edit"
+
+	defaultSubRoutineTimeout = time.Second * 5
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*SVCBEdit)(nil)
+
+// Args configures SVCBEdit. Use sequence matchers (e.g. qname) to limit the
+// scope of the edits.
+type Args struct {
+	// Drop removes all SVCB/HTTPS records from the answer.
+	Drop bool `yaml:"drop"`
+
+	// RemoveKeys removes SvcParams with those keys. Key can be its
+	// name (e.g. "ipv4hint", "ech") or number.
+	RemoveKeys []string `yaml:"remove_keys"`
+
+	// Prefer is "ipv4" or "ipv6". If a record has hints of the
+	// preferred family, hints of the other family are removed.
+	Prefer string `yaml:"prefer"`
+
+	// Synthesize synthesizes an HTTPS record from A/AAAA answers
+	// if the HTTPS query has no HTTPS answer. Synthesis requires
+	// this plugin to be placed before the upstream (e.g. forward).
+	Synthesize bool     `yaml:"synthesize"`
+	Alpn       []string `yaml:"alpn"` // alpn of synthesized records.
+}
+
+type SVCBEdit struct {
+	logger *zap.Logger
+
+	drop       bool
+	removeKeys map[dns.SVCBKey]struct{}
+	prefer     dns.SVCBKey // 0, dns.SVCB_IPV4HINT or dns.SVCB_IPV6HINT
+	synthesize bool
+	alpn       []string
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewSVCBEdit(args.(*Args), bp.L())
+}
+
+var svcbKeys = map[string]dns.SVCBKey{
+	"mandatory":       dns.SVCB_MANDATORY,
+	"alpn":            dns.SVCB_ALPN,
+	"no-default-alpn": dns.SVCB_NO_DEFAULT_ALPN,
+	"port":            dns.SVCB_PORT,
+	"ipv4hint":        dns.SVCB_IPV4HINT,
+	"ech":             dns.SVCB_ECHCONFIG,
+	"ipv6hint":        dns.SVCB_IPV6HINT,
+	"dohpath":         dns.SVCB_DOHPATH,
+	"ohttp":           dns.SVCB_OHTTP,
+}
+
+func NewSVCBEdit(args *Args, logger *zap.Logger) (*SVCBEdit, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	e := &SVCBEdit{
+		logger:     logger,
+		drop:       args.Drop,
+		removeKeys: make(map[dns.SVCBKey]struct{}),
+		synthesize: args.Synthesize,
+		alpn:       args.Alpn,
+	}
+	for _, s := range args.RemoveKeys {
+		k, err := parseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		e.removeKeys[k] = struct{}{}
+	}
+	switch args.Prefer {
+	case "":
+	case "ipv4":
+		e.prefer = dns.SVCB_IPV4HINT
+	case "ipv6":
+		e.prefer = dns.SVCB_IPV6HINT
+	default:
+		return nil, errors.New("prefer must be ipv4 or ipv6")
+	}
+	return e, nil
+}
+
+// parseKey parses a svc param key from its name, "keyNNNNN" or number.
+func parseKey(s string) (dns.SVCBKey, error) {
+	if k, ok := svcbKeys[s]; ok {
+		return k, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "key"), 10, 16)
+	if err != nil || n == 65535 {
+		return 0, fmt.Errorf("invalid svc param key %s", s)
+	}
+	return dns.SVCBKey(n), nil
+}
+
+func (e *SVCBEdit) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+
+	if e.synthesize && !e.drop && r.Rcode == dns.RcodeSuccess &&
+		qCtx.QQuestion().Qtype == dns.TypeHTTPS && !msgAnsHasSVCB(r) {
+		// Synthesize at the end of the CNAME chain. CNAME can not
+		// coexist with other data.
+		owner := cnameChainEnd(qCtx.QQuestion().Name, r.Answer)
+		if rr := e.synthesizeHTTPS(ctx, qCtx, next, owner); rr != nil {
+			r.Answer = append(r.Answer, rr)
+			r.Ns = removeSOA(r.Ns) // It is not a NODATA response anymore.
+		}
+	}
+	e.editMsg(r)
+	return nil
+}
+
+// editMsg applies drop, remove_keys and prefer to m.
+func (e *SVCBEdit) editMsg(m *dns.Msg) {
+	if e.drop {
+		m.Answer = filterSVCB(m.Answer)
+		m.Extra = filterSVCB(m.Extra)
+		return
+	}
+	for _, section := range [...][]dns.RR{m.Answer, m.Extra} {
+		for _, rr := range section {
+			switch rr := rr.(type) {
+			case *dns.SVCB:
+				rr.Value = e.editValue(rr.Value)
+			case *dns.HTTPS:
+				rr.Value = e.editValue(rr.Value)
+			}
+		}
+	}
+}
+
+func (e *SVCBEdit) editValue(kvs []dns.SVCBKeyValue) []dns.SVCBKeyValue {
+	var removePreferOther dns.SVCBKey
+	if e.prefer != 0 {
+		for _, kv := range kvs {
+			if kv.Key() == e.prefer {
+				removePreferOther = dns.SVCB_IPV6HINT
+				if e.prefer == dns.SVCB_IPV6HINT {
+					removePreferOther = dns.SVCB_IPV4HINT
+				}
+				break
+			}
+		}
+	}
+
+	out := kvs[:0]
+	for _, kv := range kvs {
+		k := kv.Key()
+		if _, remove := e.removeKeys[k]; remove || (removePreferOther != 0 && k == removePreferOther) {
+			continue
+		}
+		out = append(out, kv)
+	}
+
+	// Remove removed keys from mandatory. Remove mandatory
+	// if it becomes empty, which is invalid.
+	for i, kv := range out {
+		if mandatory, ok := kv.(*dns.SVCBMandatory); ok {
+			codes := mandatory.Code[:0]
+			for _, k := range mandatory.Code {
+				if _, remove := e.removeKeys[k]; remove || (removePreferOther != 0 && k == removePreferOther) {
+					continue
+				}
+				codes = append(codes, k)
+			}
+			mandatory.Code = codes
+			if len(codes) == 0 {
+				out = append(out[:i], out[i+1:]...)
+			}
+			break
+		}
+	}
+	return out
+}
+
+// synthesizeHTTPS queries A and AAAA of the question name through next and
+// builds an HTTPS record at owner from the answers. It returns nil if there
+// is no address.
+func (e *SVCBEdit) synthesizeHTTPS(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, owner string) dns.RR {
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(defaultSubRoutineTimeout)
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl uint32
+	}
+	lookup := func(qtype uint16, c chan<- result) {
+		qCtx := qCtx.Copy()
+		qCtx.Q().Question[0].Qtype = qtype
+		qCtx.SetResponse(nil)
+		ctx, cancel := context.WithDeadline(context.Background(), ddl)
+		defer cancel()
+		if err := next.ExecNext(ctx, qCtx); err != nil {
+			e.logger.Warn("synthesis sub query err", qCtx.InfoField(), zap.Error(err))
+			c <- result{}
+			return
+		}
+		var res result
+		if r := qCtx.R(); r != nil {
+			for _, rr := range r.Answer {
+				if !strings.EqualFold(rr.Header().Name, owner) {
+					continue // Not at the end of the CNAME chain.
+				}
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				if res.ips == nil || rr.Header().Ttl < res.ttl {
+					res.ttl = rr.Header().Ttl
+				}
+				res.ips = append(res.ips, ip)
+			}
+		}
+		c <- res
+	}
+
+	c4 := make(chan result, 1)
+	c6 := make(chan result, 1)
+	go lookup(dns.TypeA, c4)
+	go lookup(dns.TypeAAAA, c6)
+	var r4, r6 result
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case r4 = <-c4:
+		case r6 = <-c6:
+		}
+	}
+	if len(r4.ips) == 0 && len(r6.ips) == 0 {
+		return nil
+	}
+
+	ttl := r4.ttl
+	if len(r4.ips) == 0 || (len(r6.ips) > 0 && r6.ttl < ttl) {
+		ttl = r6.ttl
+	}
+	rr := &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeHTTPS,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Priority: 1,
+		Target:   ".",
+	}}
+	if len(e.alpn) > 0 {
+		rr.Value = append(rr.Value, &dns.SVCBAlpn{Alpn: e.alpn})
+	}
+	if len(r4.ips) > 0 {
+		rr.Value = append(rr.Value, &dns.SVCBIPv4Hint{Hint: r4.ips})
+	}
+	if len(r6.ips) > 0 {
+		rr.Value = append(rr.Value, &dns.SVCBIPv6Hint{Hint: r6.ips})
+	}
+	return rr
+}
+
+// cnameChainEnd follows the CNAME chain from name in rrs and returns
+// the last name.
+func cnameChainEnd(name string, rrs []dns.RR) string {
+	for i := 0; i < len(rrs); i++ { // Limit the steps in case of a loop.
+		found := false
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				name = cname.Target
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+func removeSOA(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func msgAnsHasSVCB(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeSVCB, dns.TypeHTTPS:
+			return true
+		}
+	}
+	return false
+}
+
+func filterSVCB(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeSVCB, dns.TypeHTTPS:
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package svcb_edit
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// dummyNext answers A and AAAA queries. If cname is set, the question name
+// is an alias of cname, and other queries get NODATA with a SOA.
+type dummyNext struct {
+	cname string
+}
+
+func (d *dummyNext) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	question := q.Question[0]
+	rrh := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: 300}
+	if len(d.cname) > 0 {
+		r.Answer = append(r.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: d.cname,
+		})
+		rrh.Name = d.cname
+	}
+	switch question.Qtype {
+	case dns.TypeA:
+		r.Answer = append(r.Answer, &dns.A{Hdr: rrh, A: net.IPv4(1, 2, 3, 4)})
+	case dns.TypeAAAA:
+		rrh.Ttl = 100
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: rrh, AAAA: net.ParseIP("fd00::1")})
+	default:
+		if len(d.cname) > 0 {
+			r.Ns = append(r.Ns, &dns.SOA{
+				Hdr:  dns.RR_Header{Name: d.cname, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+				Ns:   "ns.",
+				Mbox: "mbox.",
+			})
+		}
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func newHTTPS(kvs ...dns.SVCBKeyValue) *dns.HTTPS {
+	return &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: "example.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 300},
+		Priority: 1,
+		Target:   ".",
+		Value:    kvs,
+	}}
+}
+
+func TestSVCBEdit_editMsg(t *testing.T) {
+	e, err := NewSVCBEdit(&Args{RemoveKeys: []string{"ech", "key65000"}, Prefer: "ipv4"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		newHTTPS(
+			&dns.SVCBMandatory{Code: []dns.SVCBKey{dns.SVCB_ALPN, dns.SVCB_ECHCONFIG}},
+			&dns.SVCBAlpn{Alpn: []string{"h2"}},
+			&dns.SVCBIPv4Hint{Hint: []net.IP{net.IPv4(1, 1, 1, 1)}},
+			&dns.SVCBECHConfig{ECH: []byte{1}},
+			&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("fd00::1")}},
+			&dns.SVCBLocal{KeyCode: 65000, Data: []byte{1}},
+		),
+		newHTTPS(&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("fd00::1")}}),
+	}
+	e.editMsg(m)
+
+	got := m.Answer[0].(*dns.HTTPS).Value
+	wantKeys := []dns.SVCBKey{dns.SVCB_MANDATORY, dns.SVCB_ALPN, dns.SVCB_IPV4HINT}
+	if len(got) != len(wantKeys) {
+		t.Fatalf("unexpected value %v", got)
+	}
+	for i, k := range wantKeys {
+		if got[i].Key() != k {
+			t.Fatalf("unexpected key #%d %s, want %s", i, got[i].Key(), k)
+		}
+	}
+	if c := got[0].(*dns.SVCBMandatory).Code; len(c) != 1 || c[0] != dns.SVCB_ALPN {
+		t.Fatalf("unexpected mandatory keys %v", c)
+	}
+
+	// No ipv4hint, ipv6hint should be kept.
+	if got := m.Answer[1].(*dns.HTTPS).Value; len(got) != 1 {
+		t.Fatalf("unexpected value %v", got)
+	}
+
+	e, _ = NewSVCBEdit(&Args{Drop: true}, nil)
+	e.editMsg(m)
+	if len(m.Answer) != 0 {
+		t.Fatalf("svcb records are not dropped")
+	}
+}
+
+func TestSVCBEdit_synthesize(t *testing.T) {
+	e, err := NewSVCBEdit(&Args{Synthesize: true, Alpn: []string{"h2"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeHTTPS)
+	qCtx := query_context.NewContext(q)
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: &dummyNext{}}}, nil)
+	if err := e.Exec(context.Background(), qCtx, cw); err != nil {
+		t.Fatal(err)
+	}
+
+	r := qCtx.R()
+	if len(r.Answer) != 1 {
+		t.Fatalf("want 1 answer, got %d", len(r.Answer))
+	}
+	rr := r.Answer[0].(*dns.HTTPS)
+	if rr.Hdr.Ttl != 100 || len(rr.Value) != 3 {
+		t.Fatalf("unexpected synthesized record %s", rr)
+	}
+}
+
+func TestSVCBEdit_synthesizeCNAME(t *testing.T) {
+	e, err := NewSVCBEdit(&Args{Synthesize: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeHTTPS)
+	qCtx := query_context.NewContext(q)
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: &dummyNext{cname: "target.example."}}}, nil)
+	if err := e.Exec(context.Background(), qCtx, cw); err != nil {
+		t.Fatal(err)
+	}
+
+	r := qCtx.R()
+	if len(r.Answer) != 2 {
+		t.Fatalf("want 2 answers, got %v", r.Answer)
+	}
+	rr := r.Answer[1].(*dns.HTTPS)
+	if rr.Hdr.Name != "target.example." || len(rr.Value) != 2 {
+		t.Fatalf("unexpected synthesized record %s", rr)
+	}
+	if len(r.Ns) != 0 {
+		t.Fatalf("NODATA SOA is not removed, %v", r.Ns)
+	}
+}
+
+func TestSVCBEdit_emptyMandatory(t *testing.T) {
+	e, err := NewSVCBEdit(&Args{RemoveKeys: []string{"ech"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{newHTTPS(
+		&dns.SVCBMandatory{Code: []dns.SVCBKey{dns.SVCB_ECHCONFIG}},
+		&dns.SVCBECHConfig{ECH: []byte{1}},
+		&dns.SVCBAlpn{Alpn: []string{"h2"}},
+	)}
+	e.editMsg(m)
+	got := m.Answer[0].(*dns.HTTPS).Value
+	if len(got) != 1 || got[0].Key() != dns.SVCB_ALPN {
+		t.Fatalf("unexpected value %v", got)
+	}
+	if _, err := m.Pack(); err != nil {
+		t.Fatal(err)
+	}
+}
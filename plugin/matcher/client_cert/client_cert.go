@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_cert
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "client_cert"
+
+func init() {
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Matcher = (*Matcher)(nil)
+
+// Matcher matches the verified client certificate of the query.
+type Matcher struct {
+	cn  map[string]struct{}
+	san map[string]struct{}
+}
+
+func (m *Matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	return m.match(qCtx), nil
+}
+
+func (m *Matcher) match(qCtx *query_context.Context) bool {
+	cc := qCtx.ServerMeta.ClientCert
+	if cc == nil {
+		return false
+	}
+	if len(m.cn) == 0 && len(m.san) == 0 {
+		return true // any verified cert
+	}
+	if _, ok := m.cn[cc.CommonName]; ok {
+		return true
+	}
+	for _, san := range cc.SANs {
+		if _, ok := m.san[san]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// QuickSetup format: "[cn=common_name|san=subject_alt_name]..."
+// It matches if any of the given names matches the client cert.
+// If no name is given, it matches any verified client cert.
+func QuickSetup(_ sequence.BQ, s string) (sequence.Matcher, error) {
+	m := &Matcher{
+		cn:  make(map[string]struct{}),
+		san: make(map[string]struct{}),
+	}
+	for _, f := range strings.Fields(s) {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok || len(v) == 0 {
+			return nil, fmt.Errorf("invalid arg %s", f)
+		}
+		switch k {
+		case "cn":
+			m.cn[v] = struct{}{}
+		case "san":
+			m.san[v] = struct{}{}
+		default:
+			return nil, fmt.Errorf("invalid arg key %s", k)
+		}
+	}
+	return m, nil
+}
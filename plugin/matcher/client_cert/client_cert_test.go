@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_cert
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	r := require.New(t)
+	qc := query_context.NewContext(new(dns.Msg))
+	noCert := query_context.NewContext(new(dns.Msg))
+	qc.ServerMeta = query_context.ServerMeta{ClientCert: &server.ClientCert{
+		Subject:    "CN=device1,O=example",
+		CommonName: "device1",
+		SANs:       []string{"device1.example.com", "10.0.0.1"},
+	}}
+
+	doTest := func(arg string, qCtx *query_context.Context, want bool) {
+		t.Helper()
+		m, err := QuickSetup(nil, arg)
+		r.NoError(err)
+		got, err := m.Match(context.Background(), qCtx)
+		r.NoError(err)
+		r.Equal(want, got)
+	}
+
+	doTest("", qc, true)
+	doTest("", noCert, false)
+	doTest("cn=device1", qc, true)
+	doTest("cn=device2 cn=device1", qc, true)
+	doTest("cn=device2", qc, false)
+	doTest("cn=device1", noCert, false)
+	doTest("san=10.0.0.1", qc, true)
+	doTest("san=device1.example.com", qc, true)
+	doTest("san=device1", qc, false)
+	doTest("cn=device2 san=device1.example.com", qc, true)
+
+	for _, s := range []string{"cn", "cn=", "ou=a"} {
+		_, err := QuickSetup(nil, s)
+		r.Error(err, s)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt_server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnscrypt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnscrypt_server"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	Entry       string `yaml:"entry"`
+	Listen      string `yaml:"listen"` // Both udp and tcp.
+	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// ProviderName is the provider name, e.g. "2.dnscrypt-cert.example.com".
+	// Required.
+	ProviderName string `yaml:"provider_name"`
+	// ProviderKey is the path of the hex encoded ed25519 provider secret key.
+	// If the file does not exist, a new key will be generated and saved to it.
+	// If it is empty and no Certs is configured, a temporary key will be
+	// used, which means the server stamp changes on every restart.
+	ProviderKey string `yaml:"provider_key"`
+	// ESVersions can be "xsalsa20poly1305" and "xchacha20poly1305".
+	// Default is both.
+	ESVersions []string `yaml:"es_versions"`
+	// CertTTL is the validity period (in seconds) of generated certs.
+	// Default is 86400.
+	CertTTL int `yaml:"cert_ttl"`
+	// KeyRotateInterval is the interval (in seconds) of short-term key
+	// rotation. Default is CertTTL / 2.
+	KeyRotateInterval int `yaml:"key_rotate_interval"`
+	// Certs are pre-signed certs. Optional.
+	Certs []CertConfig `yaml:"certs"`
+}
+
+type CertConfig struct {
+	Cert string `yaml:"cert"` // Path of the binary cert.
+	Key  string `yaml:"key"`  // Path of the resolver secret key, raw or hex encoded.
+}
+
+func (a *Args) init() {
+	utils.SetDefaultString(&a.Listen, "127.0.0.1:443")
+}
+
+type DNSCryptServer struct {
+	args *Args
+
+	s  *dnscrypt.Server
+	uc net.PacketConn
+	l  net.Listener
+}
+
+func (s *DNSCryptServer) Close() error {
+	_ = s.uc.Close()
+	_ = s.l.Close()
+	return s.s.Close()
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return StartServer(bp, args.(*Args))
+}
+
+func StartServer(bp *coremain.BP, args *Args) (*DNSCryptServer, error) {
+	args.init()
+	opts, err := buildServerOpts(args)
+	if err != nil {
+		return nil, err
+	}
+	opts.Logger = bp.L()
+	if len(args.ProviderKey) == 0 && opts.ProviderSk != nil {
+		bp.L().Warn("provider_key is not set, a temporary provider key is used")
+	}
+
+	dh, err := server_utils.NewHandler(bp, args.Entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dns handler, %w", err)
+	}
+	cs, err := dnscrypt.NewServer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dnscrypt server, %w", err)
+	}
+
+	socketOpt := server_utils.ListenerSocketOpts{
+		SO_REUSEPORT: true,
+		SO_RCVBUF:    64 * 1024,
+	}
+	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
+	if err != nil {
+		_ = cs.Close()
+		return nil, fmt.Errorf("failed to create udp socket, %w", err)
+	}
+	l, err := lc.Listen(context.Background(), "tcp", uc.LocalAddr().String())
+	if err != nil {
+		_ = uc.Close()
+		_ = cs.Close()
+		return nil, fmt.Errorf("failed to listen tcp socket, %w", err)
+	}
+
+	logFields := []zap.Field{zap.Stringer("addr", uc.LocalAddr())}
+	if opts.ProviderSk != nil {
+		pk := opts.ProviderSk.Public().(ed25519.PublicKey)
+		logFields = append(logFields, zap.String("provider_pk", hex.EncodeToString(pk)))
+		if ap, err := netip.ParseAddrPort(uc.LocalAddr().String()); err == nil && !ap.Addr().IsUnspecified() {
+			stamp := &dnscrypt.Stamp{ServerAddr: ap, ProviderPk: pk, ProviderName: args.ProviderName}
+			logFields = append(logFields, zap.Stringer("stamp", stamp))
+		}
+	}
+	bp.L().Info("dnscrypt server started", logFields...)
+
+	serveOpts := dnscrypt.ServeOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
+	go func() {
+		defer uc.Close()
+		err := dnscrypt.ServeUDP(uc, dh, cs, serveOpts)
+		bp.M().GetSafeClose().SendCloseSignal(err)
+	}()
+	go func() {
+		defer l.Close()
+		err := dnscrypt.ServeTCP(l, dh, cs, serveOpts)
+		bp.M().GetSafeClose().SendCloseSignal(err)
+	}()
+	return &DNSCryptServer{
+		args: args,
+		s:    cs,
+		uc:   uc,
+		l:    l,
+	}, nil
+}
+
+func buildServerOpts(args *Args) (dnscrypt.ServerOpts, error) {
+	opts := dnscrypt.ServerOpts{
+		ProviderName:   args.ProviderName,
+		CertTTL:        time.Duration(args.CertTTL) * time.Second,
+		RotateInterval: time.Duration(args.KeyRotateInterval) * time.Second,
+	}
+	if len(args.ProviderName) == 0 {
+		return opts, errors.New("missing provider_name")
+	}
+
+	for _, s := range args.ESVersions {
+		switch strings.ToLower(s) {
+		case "xsalsa20poly1305":
+			opts.ESVersions = append(opts.ESVersions, dnscrypt.XSalsa20Poly1305)
+		case "xchacha20poly1305":
+			opts.ESVersions = append(opts.ESVersions, dnscrypt.XChaCha20Poly1305)
+		default:
+			return opts, fmt.Errorf("invalid es version %s", s)
+		}
+	}
+
+	for i, cc := range args.Certs {
+		sc, err := loadCert(cc)
+		if err != nil {
+			return opts, fmt.Errorf("failed to load cert #%d, %w", i, err)
+		}
+		opts.StaticCerts = append(opts.StaticCerts, sc)
+	}
+
+	if len(args.ProviderKey) > 0 || len(args.Certs) == 0 {
+		sk, err := loadOrGenProviderKey(args.ProviderKey)
+		if err != nil {
+			return opts, fmt.Errorf("failed to load provider key, %w", err)
+		}
+		opts.ProviderSk = sk
+	}
+	return opts, nil
+}
+
+// loadOrGenProviderKey loads the provider key from file f. If f does not
+// exist, it generates a new key and saves it to f. If f is empty, it
+// generates a temporary key.
+func loadOrGenProviderKey(f string) (ed25519.PrivateKey, error) {
+	if len(f) > 0 {
+		b, err := os.ReadFile(f)
+		if err == nil {
+			k, err := hex.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil {
+				return nil, err
+			}
+			switch len(k) {
+			case ed25519.SeedSize:
+				return ed25519.NewKeyFromSeed(k), nil
+			case ed25519.PrivateKeySize:
+				return ed25519.PrivateKey(k), nil
+			default:
+				return nil, fmt.Errorf("invalid key length %d", len(k))
+			}
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(f) > 0 {
+		if err := os.WriteFile(f, []byte(hex.EncodeToString(sk)), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save generated key, %w", err)
+		}
+	}
+	return sk, nil
+}
+
+func loadCert(cc CertConfig) (dnscrypt.StaticCert, error) {
+	var sc dnscrypt.StaticCert
+	b, err := os.ReadFile(cc.Cert)
+	if err != nil {
+		return sc, err
+	}
+	sc.Cert, err = dnscrypt.UnmarshalCert(b)
+	if err != nil {
+		return sc, err
+	}
+	b, err = os.ReadFile(cc.Key)
+	if err != nil {
+		return sc, err
+	}
+	if k, err := hex.DecodeString(strings.TrimSpace(string(b))); err == nil {
+		b = k
+	}
+	if len(b) != len(sc.Sk) {
+		return sc, fmt.Errorf("invalid key length %d", len(b))
+	}
+	copy(sc.Sk[:], b)
+	return sc, nil
+}
@@ -21,16 +21,25 @@ package tcp_server
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/odoh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
@@ -45,12 +54,58 @@ type Args struct {
 	Entries []struct {
 		Exec string `yaml:"exec"`
 		Path string `yaml:"path"`
+		// JSON enables the DoH JSON API (application/dns-json) on this
+		// path, e.g. "/resolve?name=example.com&type=A".
+		JSON bool `yaml:"json"`
+		// AllowedOrigins are the origins that browsers may read JSON API
+		// responses from (CORS), e.g. "https://example.com". "*" allows
+		// all origins. Default is none.
+		AllowedOrigins []string `yaml:"allowed_origins"`
 	} `yaml:"entries"`
 	Listen      string `yaml:"listen"`
 	SrcIPHeader string `yaml:"src_ip_header"`
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+	// Certs are additional cert/key pairs, which will be selected by SNI.
+	// Certs are reloaded automatically when the files are changed.
+	Certs []server_utils.CertArgs `yaml:"certs"`
+
+	// ClientCA is the path of the CA bundle to verify client certificates
+	// (mutual TLS). The verified certificate identity can be matched by the
+	// client_cert matcher.
+	ClientCA string `yaml:"client_ca"`
+	// RequireClientCert rejects clients without a valid certificate.
+	RequireClientCert bool `yaml:"require_client_cert"`
+
+	// ProxyProtocol enables the PROXY protocol v1/v2 on the tcp listener.
+	ProxyProtocol server_utils.ProxyProtocolArgs `yaml:"proxy_protocol"`
+
+	// ODoHTarget enables Oblivious DoH (RFC 9230) target support on all
+	// entries. The configs will be served at "/.well-known/odohconfigs".
+	ODoHTarget bool `yaml:"odoh_target"`
+	// ODoHKey is the path of the hex encoded X25519 secret key of the target.
+	// If the file does not exist, a new key will be generated and saved to it.
+	// If it is empty, a temporary key will be used.
+	ODoHKey string `yaml:"odoh_key"`
+	// ODoHRelayPath enables the ODoH proxy (relay) at this path. Optional.
+	ODoHRelayPath string `yaml:"odoh_relay_path"`
+	// ODoHRelayTargets are the allowed target hosts of the relay.
+	// It is required if ODoHRelayPath is set.
+	ODoHRelayTargets []string `yaml:"odoh_relay_targets"`
+
+	// EnableHTTP3 enables the HTTP/3 (DoH3) listener. It requires cert and key.
+	// The TCP listener will advertise it via the Alt-Svc header.
+	EnableHTTP3 bool `yaml:"enable_http3"`
+	// HTTP3Listen is the udp address of the HTTP/3 listener.
+	// Default is the same as Listen.
+	HTTP3Listen string `yaml:"http3_listen"`
+	// HTTP3IdleTimeout is the idle timeout (in seconds) of HTTP/3 connections.
+	// Default is 30.
+	HTTP3IdleTimeout int `yaml:"http3_idle_timeout"`
+	// HTTP3MaxStreams is the max number of concurrent streams per
+	// HTTP/3 connection. Default is 100.
+	HTTP3MaxStreams int `yaml:"http3_max_streams"`
 }
 
 func (a *Args) init() {
@@ -60,10 +115,18 @@ func (a *Args) init() {
 type HttpServer struct {
 	args *Args
 
-	server *http.Server
+	server  *http.Server
+	h3      *http3.Server // maybe nil
+	closers []io.Closer
 }
 
 func (s *HttpServer) Close() error {
+	if s.h3 != nil {
+		_ = s.h3.Close()
+	}
+	for _, c := range s.closers {
+		_ = c.Close()
+	}
 	return s.server.Close()
 }
 
@@ -73,6 +136,24 @@ func Init(bp *coremain.BP, args any) (any, error) {
 
 func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	mux := http.NewServeMux()
+	var odohKey *odoh.KeyPair
+	if args.ODoHTarget {
+		var err error
+		odohKey, err = loadOrGenODoHKey(args.ODoHKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load odoh key, %w", err)
+		}
+		mux.Handle(odoh.ConfigsPath, server.ODoHConfigsHandler(odohKey))
+	}
+	if len(args.ODoHRelayPath) > 0 {
+		if len(args.ODoHRelayTargets) == 0 {
+			return nil, errors.New("odoh relay requires odoh_relay_targets")
+		}
+		mux.Handle(args.ODoHRelayPath, server.NewODoHRelay(server.ODoHRelayOpts{
+			AllowedTargets: args.ODoHRelayTargets,
+			Logger:         bp.L(),
+		}))
+	}
 	for _, entry := range args.Entries {
 		dh, err := server_utils.NewHandler(bp, entry.Exec)
 		if err != nil {
@@ -81,6 +162,9 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
 			Logger:             bp.L(),
+			ODoHKey:            odohKey,
+			EnableJSON:         entry.JSON,
+			AllowedOrigins:     entry.AllowedOrigins,
 		}
 		hh := server.NewHttpHandler(dh, hhOpts)
 		mux.Handle(entry.Path, hh)
@@ -96,17 +180,81 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	if strings.HasPrefix(args.Listen, "@") {
 		listenerNetwork = "unix"
 	}
+
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}
+
+	// Init tls
+	certStore, err := server_utils.NewCertStore(bp, args.Cert, args.Key, args.Certs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	}
+	var tlsConfig *tls.Config
+	if certStore != nil {
+		closers = append(closers, certStore)
+		tlsConfig = &tls.Config{GetCertificate: certStore.GetCertificate}
+		if err := server.LoadClientCA(tlsConfig, args.ClientCA, args.RequireClientCert); err != nil {
+			closeAll()
+			return nil, err
+		}
+	} else if len(args.ClientCA) > 0 || args.RequireClientCert {
+		return nil, errors.New("client certificate verification requires a tls certificate")
+	}
+
+	var h3 *http3.Server
+	var h3l *quic.EarlyListener
+	if args.EnableHTTP3 {
+		if tlsConfig == nil {
+			return nil, errors.New("http3 requires a tls certificate")
+		}
+		var qt *quic.Transport
+		h3, qt, h3l, err = startHTTP3(bp, args, lc, mux, tlsConfig)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		closers = append(closers, h3l, qt)
+	}
+
 	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
 	if err != nil {
+		closeAll()
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
+	l, err = args.ProxyProtocol.WrapListener(l)
+	if err != nil {
+		_ = l.Close()
+		closeAll()
+		return nil, fmt.Errorf("invalid proxy protocol args, %w", err)
+	}
 	bp.L().Info("http server started", zap.Stringer("addr", l.Addr()))
 
+	var handler http.Handler = mux
+	if h3 != nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Advertise the HTTP/3 listener.
+			_ = h3.SetQUICHeaders(w.Header())
+			mux.ServeHTTP(w, req)
+		})
+		go func() {
+			err := h3.ServeListener(h3l)
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}()
+	}
+
 	hs := &http.Server{
-		Handler:        mux,
+		Handler:        handler,
 		ReadTimeout:    time.Second,
 		IdleTimeout:    time.Duration(args.IdleTimeout) * time.Second,
 		MaxHeaderBytes: 512,
+		TLSConfig:      tlsConfig,
 	}
 	if err := http2.ConfigureServer(hs, &http2.Server{
 		MaxReadFrameSize:             16 * 1024,
@@ -114,20 +262,97 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		MaxUploadBufferPerConnection: 65535,
 		MaxUploadBufferPerStream:     65535,
 	}); err != nil {
+		_ = l.Close()
+		closeAll()
 		return nil, fmt.Errorf("failed to setup http2 server, %w", err)
 	}
 
 	go func() {
 		var err error
-		if len(args.Key)+len(args.Cert) > 0 {
-			err = hs.ServeTLS(l, args.Cert, args.Key)
+		if tlsConfig != nil {
+			err = hs.ServeTLS(l, "", "") // certs are from hs.TLSConfig.GetCertificate
 		} else {
 			err = hs.Serve(l)
 		}
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &HttpServer{
-		args:   args,
-		server: hs,
+		args:    args,
+		server:  hs,
+		h3:      h3,
+		closers: closers,
 	}, nil
 }
+
+func startHTTP3(bp *coremain.BP, args *Args, lc net.ListenConfig, h http.Handler, tlsConfig *tls.Config) (*http3.Server, *quic.Transport, *quic.EarlyListener, error) {
+	utils.SetDefaultString(&args.HTTP3Listen, args.Listen)
+	utils.SetDefaultNum(&args.HTTP3IdleTimeout, 30)
+	utils.SetDefaultNum(&args.HTTP3MaxStreams, 100)
+	idleTimeout := time.Duration(args.HTTP3IdleTimeout) * time.Second
+
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.HTTP3Listen)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to listen udp socket, %w", err)
+	}
+	srk, _, err := utils.InitQUICSrkFromIfaceMac()
+	if err != nil {
+		bp.L().Warn("failed to init quic stateless reset key, it will be disabled", zap.Error(err))
+	}
+	qt := &quic.Transport{
+		Conn:              uc,
+		StatelessResetKey: (*quic.StatelessResetKey)(srk),
+	}
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:                 idleTimeout,
+		MaxIncomingStreams:             int64(args.HTTP3MaxStreams),
+		InitialStreamReceiveWindow:     4 * 1024,
+		MaxStreamReceiveWindow:         4 * 1024,
+		InitialConnectionReceiveWindow: 8 * 1024,
+		MaxConnectionReceiveWindow:     64 * 1024,
+		Allow0RTT:                      false,
+	}
+	ql, err := qt.ListenEarly(http3.ConfigureTLSConfig(tlsConfig), quicConfig)
+	if err != nil {
+		_ = qt.Close()
+		return nil, nil, nil, fmt.Errorf("failed to listen quic, %w", err)
+	}
+	bp.L().Info("http3 server started", zap.Stringer("addr", ql.Addr()))
+
+	h3 := &http3.Server{
+		Handler:        h,
+		QUICConfig:     quicConfig,
+		IdleTimeout:    idleTimeout,
+		MaxHeaderBytes: 512,
+	}
+	return h3, qt, ql, nil
+}
+
+// loadOrGenODoHKey loads the key from file f. If f does not exist, it
+// generates a new key and saves it to f. If f is empty, it generates a
+// temporary key.
+func loadOrGenODoHKey(f string) (*odoh.KeyPair, error) {
+	if len(f) > 0 {
+		b, err := os.ReadFile(f)
+		if err == nil {
+			sk, err := hex.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil {
+				return nil, err
+			}
+			return odoh.NewKeyPair(sk)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	kp, err := odoh.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if len(f) > 0 {
+		if err := os.WriteFile(f, []byte(hex.EncodeToString(kp.SecretKey())), 0600); err != nil {
+			return nil, fmt.Errorf("failed to save generated key, %w", err)
+		}
+	}
+	return kp, nil
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tcp_server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	c, err := utils.GenerateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestHttpServer_HTTP3(t *testing.T) {
+	entry := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		rr, _ := dns.NewRR(qCtx.Q().Question[0].Name + " 60 IN A 127.0.0.1")
+		r.Answer = append(r.Answer, rr)
+		qCtx.SetResponse(r)
+		return nil
+	})
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"entry": entry})
+
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	args := new(Args)
+	if err := utils.WeakDecode(map[string]any{
+		"entries":      []any{map[string]any{"exec": "entry", "path": "/dns-query"}},
+		"listen":       "127.0.0.1:0",
+		"cert":         certFile,
+		"key":          keyFile,
+		"enable_http3": true,
+	}, args); err != nil {
+		t.Fatal(err)
+	}
+	args.init()
+	s, err := StartServer(coremain.NewBP("test", m), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var h3Addr string
+	for _, c := range s.closers {
+		if l, ok := c.(*quic.EarlyListener); ok {
+			h3Addr = l.Addr().String()
+		}
+	}
+	if len(h3Addr) == 0 {
+		t.Fatal("http3 listener is not started")
+	}
+
+	u, err := upstream.NewUpstream("https://"+h3Addr+"/dns-query", upstream.Opt{
+		EnableHTTP3: true,
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qb, _ := q.Pack()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	rb, err := u.ExchangeContext(ctx, qb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
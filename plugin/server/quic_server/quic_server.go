@@ -46,6 +46,16 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+	// Certs are additional cert/key pairs, which will be selected by SNI.
+	// Certs are reloaded automatically when the files are changed.
+	Certs []server_utils.CertArgs `yaml:"certs"`
+
+	// ClientCA is the path of the CA bundle to verify client certificates
+	// (mutual TLS). The verified certificate identity can be matched by the
+	// client_cert matcher.
+	ClientCA string `yaml:"client_ca"`
+	// RequireClientCert rejects clients without a valid certificate.
+	RequireClientCert bool `yaml:"require_client_cert"`
 }
 
 func (a *Args) init() {
@@ -55,10 +65,12 @@ func (a *Args) init() {
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	l         *quic.Listener
+	certStore *server.CertStore
 }
 
 func (s *QuicServer) Close() error {
+	_ = s.certStore.Close()
 	return s.l.Close()
 }
 
@@ -75,17 +87,23 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	}
 
 	// Init tls
-	if len(args.Key) == 0 || len(args.Cert) == 0 {
+	certStore, err := server_utils.NewCertStore(bp, args.Cert, args.Key, args.Certs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	}
+	if certStore == nil {
 		return nil, errors.New("quic server requires a tls certificate")
 	}
-	tlsConfig := new(tls.Config)
-	if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
-		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	tlsConfig := &tls.Config{GetCertificate: certStore.GetCertificate}
+	if err := server.LoadClientCA(tlsConfig, args.ClientCA, args.RequireClientCert); err != nil {
+		_ = certStore.Close()
+		return nil, err
 	}
 	tlsConfig.NextProtos = []string{"doq"}
 
 	uc, err := net.ListenPacket("udp", args.Listen)
 	if err != nil {
+		_ = certStore.Close()
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
 
@@ -115,6 +133,7 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	quicListener, err := qt.Listen(tlsConfig, quicConfig)
 	if err != nil {
 		qt.Close()
+		_ = certStore.Close()
 		return nil, fmt.Errorf("failed to listen quic, %w", err)
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
@@ -126,7 +145,8 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &QuicServer{
-		args: args,
-		l:    quicListener,
+		args:      args,
+		l:         quicListener,
+		certStore: certStore,
 	}, nil
 }
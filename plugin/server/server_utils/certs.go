@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+)
+
+// CertArgs is a pair of PEM encoded cert and key file.
+type CertArgs struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// NewCertStore loads the cert/key pair and additional certs into a
+// server.CertStore, which reloads them when the files are changed and
+// selects them by SNI. It returns nil if no cert is configured.
+func NewCertStore(bp *coremain.BP, cert, key string, certs []CertArgs) (*server.CertStore, error) {
+	var files []server.CertFile
+	if len(cert)+len(key) > 0 {
+		files = append(files, server.CertFile{Cert: cert, Key: key})
+	}
+	for _, c := range certs {
+		files = append(files, server.CertFile{Cert: c.Cert, Key: c.Key})
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return server.NewCertStore(files, server.CertStoreOpts{Logger: bp.L()})
+}
@@ -29,15 +29,19 @@ import (
 )
 
 func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
+	return NewHandlerWithOpts(bp, entry, server_handler.EntryHandlerOpts{})
+}
+
+// NewHandlerWithOpts is like NewHandler but accepts more options.
+// The Logger and Entry in opts will be set by NewHandlerWithOpts.
+func NewHandlerWithOpts(bp *coremain.BP, entry string, opts server_handler.EntryHandlerOpts) (server.Handler, error) {
 	p := bp.M().GetPlugin(entry)
 	exec := sequence.ToExecutable(p)
 	if exec == nil {
 		return nil, fmt.Errorf("cannot find executable entry by tag %s", entry)
 	}
 
-	handlerOpts := server_handler.EntryHandlerOpts{
-		Logger: bp.L(),
-		Entry:  exec,
-	}
-	return server_handler.NewEntryHandler(handlerOpts), nil
+	opts.Logger = bp.L()
+	opts.Entry = exec
+	return server_handler.NewEntryHandler(opts), nil
 }
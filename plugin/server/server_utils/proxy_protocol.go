@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/proxy_protocol"
+)
+
+// ProxyProtocolArgs is the PROXY protocol config of server plugins.
+type ProxyProtocolArgs struct {
+	Enabled bool `yaml:"enabled"`
+	// TrustedCIDRs are the addresses of the proxies. Only connections or
+	// packets from them will be parsed. It is required if Enabled is true.
+	// Use "0.0.0.0/0" and "::/0" to trust all peers.
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
+}
+
+// TrustedFunc returns nil if the PROXY protocol is disabled.
+func (a *ProxyProtocolArgs) TrustedFunc() (proxy_protocol.TrustedFunc, error) {
+	if !a.Enabled {
+		return nil, nil
+	}
+	if len(a.TrustedCIDRs) == 0 {
+		return nil, errors.New("proxy protocol requires trusted_cidrs")
+	}
+	prefixes := make([]netip.Prefix, 0, len(a.TrustedCIDRs))
+	for _, s := range a.TrustedCIDRs {
+		var p netip.Prefix
+		var err error
+		if strings.ContainsRune(s, '/') {
+			p, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted cidr %s, %w", s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return proxy_protocol.PrefixesTrusted(prefixes), nil
+}
+
+// WrapListener wraps l with a proxy_protocol.Listener if the PROXY protocol
+// is enabled. Otherwise, l is returned.
+func (a *ProxyProtocolArgs) WrapListener(l net.Listener) (net.Listener, error) {
+	trusted, err := a.TrustedFunc()
+	if err != nil || trusted == nil {
+		return l, err
+	}
+	return proxy_protocol.NewListener(l, proxy_protocol.ListenerOpts{Trusted: trusted}), nil
+}
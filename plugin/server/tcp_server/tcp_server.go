@@ -22,6 +22,7 @@ package tcp_server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -46,6 +47,19 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+	// Certs are additional cert/key pairs, which will be selected by SNI.
+	// Certs are reloaded automatically when the files are changed.
+	Certs []server_utils.CertArgs `yaml:"certs"`
+
+	// ClientCA is the path of the CA bundle to verify client certificates
+	// (mutual TLS). The verified certificate identity can be matched by the
+	// client_cert matcher.
+	ClientCA string `yaml:"client_ca"`
+	// RequireClientCert rejects clients without a valid certificate.
+	RequireClientCert bool `yaml:"require_client_cert"`
+
+	// ProxyProtocol enables the PROXY protocol v1/v2.
+	ProxyProtocol server_utils.ProxyProtocolArgs `yaml:"proxy_protocol"`
 }
 
 func (a *Args) init() {
@@ -56,10 +70,14 @@ func (a *Args) init() {
 type TcpServer struct {
 	args *Args
 
-	l net.Listener
+	l         net.Listener
+	certStore *server.CertStore // maybe nil
 }
 
 func (s *TcpServer) Close() error {
+	if s.certStore != nil {
+		_ = s.certStore.Close()
+	}
 	return s.l.Close()
 }
 
@@ -74,12 +92,24 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	}
 
 	// Init tls
+	certStore, err := server_utils.NewCertStore(bp, args.Cert, args.Key, args.Certs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	}
+	closeCertStore := func() {
+		if certStore != nil {
+			_ = certStore.Close()
+		}
+	}
 	var tc *tls.Config
-	if len(args.Key)+len(args.Cert) > 0 {
-		tc = new(tls.Config)
-		if err := server.LoadCert(tc, args.Cert, args.Key); err != nil {
-			return nil, fmt.Errorf("failed to read tls cert, %w", err)
+	if certStore != nil {
+		tc = &tls.Config{GetCertificate: certStore.GetCertificate}
+		if err := server.LoadClientCA(tc, args.ClientCA, args.RequireClientCert); err != nil {
+			closeCertStore()
+			return nil, err
 		}
+	} else if len(args.ClientCA) > 0 || args.RequireClientCert {
+		return nil, errors.New("client certificate verification requires a tls certificate")
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
@@ -93,12 +123,19 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	}
 	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
 	if err != nil {
+		closeCertStore()
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
+	l, err = args.ProxyProtocol.WrapListener(l)
+	if err != nil {
+		_ = l.Close()
+		closeCertStore()
+		return nil, fmt.Errorf("invalid proxy protocol args, %w", err)
+	}
 	if tc != nil {
 		l = tls.NewListener(l, tc)
 	}
-	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
+	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil), zap.Bool("proxy_protocol", args.ProxyProtocol.Enabled))
 
 	go func() {
 		defer l.Close()
@@ -107,7 +144,8 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &TcpServer{
-		args: args,
-		l:    l,
+		args:      args,
+		l:         l,
+		certStore: certStore,
 	}, nil
 }
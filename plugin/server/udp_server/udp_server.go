@@ -21,14 +21,21 @@ package udp_server
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dns_cookie"
+	"github.com/IrineSistiana/mosdns/v5/pkg/rate_limiter"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/server/server_utils"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 const PluginType = "udp_server"
@@ -40,6 +47,21 @@ func init() {
 type Args struct {
 	Entry  string `yaml:"entry"`
 	Listen string `yaml:"listen"`
+
+	// DNS cookie (RFC 7873) options.
+	Cookie bool `yaml:"cookie"`
+	// CookieSecret is a hex encoded 16 bytes secret. Servers in the same
+	// anycast group should share the same secret. If it is empty, a random
+	// secret will be used and rotated every CookieRotateInterval seconds.
+	CookieSecret         string `yaml:"cookie_secret"`
+	CookieRotateInterval int    `yaml:"cookie_rotate_interval"`
+	// If CookieEnforceQps > 0, clients without a valid server cookie that
+	// exceed this rate will get BADCOOKIE or truncated responses.
+	CookieEnforceQps   float64 `yaml:"cookie_enforce_qps"`
+	CookieEnforceBurst int     `yaml:"cookie_enforce_burst"`
+
+	// ProxyProtocol enables the PROXY protocol v2.
+	ProxyProtocol server_utils.ProxyProtocolArgs `yaml:"proxy_protocol"`
 }
 
 func (a *Args) init() {
@@ -49,10 +71,14 @@ func (a *Args) init() {
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	c       net.PacketConn
+	closers []io.Closer
 }
 
 func (s *UdpServer) Close() error {
+	for _, c := range s.closers {
+		_ = c.Close()
+	}
 	return s.c.Close()
 }
 
@@ -61,8 +87,47 @@ func Init(bp *coremain.BP, args any) (any, error) {
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}
+	ppTrusted, err := args.ProxyProtocol.TrustedFunc()
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy protocol args, %w", err)
+	}
+
+	var handlerOpts server_handler.EntryHandlerOpts
+	if args.Cookie {
+		utils.SetDefaultUnsignNum(&args.CookieRotateInterval, 86400)
+		utils.SetDefaultUnsignNum(&args.CookieEnforceBurst, 10)
+		var secret []byte
+		rotateInterval := time.Duration(args.CookieRotateInterval) * time.Second
+		if len(args.CookieSecret) > 0 {
+			b, err := hex.DecodeString(args.CookieSecret)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cookie secret, %w", err)
+			}
+			secret = b
+			rotateInterval = 0
+		}
+		cs, err := dns_cookie.NewServer(secret, rotateInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init cookie server, %w", err)
+		}
+		closers = append(closers, cs)
+		handlerOpts.Cookie = cs
+		if args.CookieEnforceQps > 0 {
+			l := rate_limiter.NewRateLimiter(rate.Limit(args.CookieEnforceQps), args.CookieEnforceBurst)
+			closers = append(closers, l)
+			handlerOpts.CookieLimiter = l
+		}
+	}
+
+	dh, err := server_utils.NewHandlerWithOpts(bp, args.Entry, handlerOpts)
 	if err != nil {
+		closeAll()
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
@@ -73,17 +138,19 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
 	c, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
 	if err != nil {
+		closeAll()
 		return nil, fmt.Errorf("failed to create socket, %w", err)
 	}
 	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
 
 	go func() {
 		defer c.Close()
-		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
+		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L(), ProxyProtocol: ppTrusted})
 		bp.M().GetSafeClose().SendCloseSignal(err)
 	}()
 	return &UdpServer{
-		args: args,
-		c:    c,
+		args:    args,
+		c:       c,
+		closers: closers,
 	}, nil
 }